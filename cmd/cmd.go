@@ -17,6 +17,7 @@ package cmd
 import (
 	"errors"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/hashicorp/go-plugin"
@@ -43,8 +44,10 @@ var (
 	dsn             string
 	customTLSConfig string
 	poolSize        int
+	redactedPaths   cli.StringSlice
 
-	serveFlags = []cli.Flag{
+	// databaseFlags are shared by all the commands connecting to the database
+	databaseFlags = []cli.Flag{
 		&cli.StringFlag{
 			Name:        "driver",
 			Usage:       "Database driver (required)",
@@ -75,6 +78,26 @@ var (
 		},
 	}
 
+	redactedPathsFlag = &cli.StringSliceFlag{
+		Name: "redacted-paths",
+		Usage: "JSON paths to redact within the provider events object data, they replace the default ones. " +
+			`Use "none" to disable the redaction`,
+		Destination: &redactedPaths,
+		EnvVars:     []string{envPrefix + "REDACTED_PATHS"},
+		Required:    false,
+	}
+
+	slowSearchThresholdFlag = &cli.DurationFlag{
+		Name: "slow-search-threshold",
+		Usage: "Explain the searches taking longer than this duration, or hitting the query timeout, and log " +
+			"the query plan issues and the suggested indexes. 0 disables",
+		Destination: &db.SlowSearchThreshold,
+		EnvVars:     []string{envPrefix + "SLOW_SEARCH_THRESHOLD"},
+		Required:    false,
+	}
+
+	serveFlags = append(slices.Clone(databaseFlags), redactedPathsFlag, slowSearchThresholdFlag)
+
 	rootCmd = &cli.App{
 		Name:    "sftpgo-plugin-eventsearch",
 		Version: getVersionString(),
@@ -86,11 +109,21 @@ var (
 				Flags: serveFlags,
 				Action: func(_ *cli.Context) error {
 					logger.AppLogger.Info("starting sftpgo-plugin-eventsearch", "version", getVersionString(),
-						"database driver", driver, "instance id", instanceID, "pool size", poolSize)
+						"database driver", driver, "instance id", instanceID, "pool size", poolSize,
+						"slow search threshold", db.SlowSearchThreshold)
+					if err := setRedactedPaths(redactedPaths.Value()); err != nil {
+						logger.AppLogger.Error("invalid redacted paths", "error", err)
+						return err
+					}
 					if err := db.Initialize(driver, dsn, customTLSConfig, poolSize); err != nil {
 						logger.AppLogger.Error("unable to initialize database", "error", err)
 						return err
 					}
+					if err := checkSchema(); err != nil {
+						// SFTPGo may create the tables later, the schema is
+						// checked again when a search fails
+						logger.AppLogger.Warn("the events tables cannot be searched yet", "error", err)
+					}
 
 					plugin.Serve(&plugin.ServeConfig{
 						HandshakeConfig: eventsearcher.Handshake,
@@ -103,6 +136,11 @@ var (
 					return errors.New("the plugin exited unexpectedly")
 				},
 			},
+			searchCmd,
+			exportCmd,
+			statsCmd,
+			checkSchemaCmd,
+			explainCmd,
 		},
 	}
 )
@@ -112,6 +150,16 @@ func Execute() error {
 	return rootCmd.Run(os.Args)
 }
 
+func setRedactedPaths(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	if len(paths) == 1 && paths[0] == "none" {
+		return db.SetRedactedPaths(nil)
+	}
+	return db.SetRedactedPaths(paths)
+}
+
 func getVersionString() string {
 	var sb strings.Builder
 	sb.WriteString(version)
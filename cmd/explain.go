@@ -0,0 +1,194 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/db"
+)
+
+var (
+	explainFlags = []cli.Flag{
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "Maximum number of events to search, as for a search page",
+			Value: defaultPageSize,
+		},
+		&cli.BoolFlag{
+			Name:  "asc",
+			Usage: "Sort the events by ascending timestamp, default descending",
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Output format: table or json",
+			Value:   outputTable,
+		},
+	}
+
+	explainCmd = &cli.Command{
+		Name: "explain",
+		Usage: "Show the query plan for a search, report sequential scans, sorts and missing indexes and suggest " +
+			"the indexes to create",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "fs",
+				Usage: "Explain a filesystem events search",
+				Flags: getExplainFlags(fsFilterFlags),
+				Action: printError(func(c *cli.Context) error {
+					filters, err := getFsEventFilters(c)
+					if err != nil {
+						return err
+					}
+					filters.Limit = c.Int("limit")
+					filters.Enrichment = db.EnrichmentOptions{}
+					return runExplain(c, func() (*db.Explanation, error) {
+						return (&db.Searcher{}).ExplainFsEvents(filters)
+					})
+				}),
+			},
+			{
+				Name:  "provider",
+				Usage: "Explain a provider events search",
+				Flags: getExplainFlags(providerFilterFlags),
+				Action: printError(func(c *cli.Context) error {
+					filters, err := getProviderEventFilters(c)
+					if err != nil {
+						return err
+					}
+					filters.Limit = c.Int("limit")
+					// the object data is only omitted if requested, as for
+					// the searches from SFTPGo
+					filters.OmitObjectData = c.Bool("omit-data")
+					filters.Enrichment = db.EnrichmentOptions{}
+					return runExplain(c, func() (*db.Explanation, error) {
+						return (&db.Searcher{}).ExplainProviderEvents(filters)
+					})
+				}),
+			},
+			{
+				Name:  "log",
+				Usage: "Explain a log events search",
+				Flags: getExplainFlags(logFilterFlags),
+				Action: printError(func(c *cli.Context) error {
+					filters, err := getLogEventFilters(c)
+					if err != nil {
+						return err
+					}
+					filters.Limit = c.Int("limit")
+					filters.Enrichment = db.EnrichmentOptions{}
+					return runExplain(c, func() (*db.Explanation, error) {
+						return (&db.Searcher{}).ExplainLogEvents(filters)
+					})
+				}),
+			},
+		},
+	}
+)
+
+// getExplainFlags returns the database, filter and explain flags followed by
+// the given filter flags
+func getExplainFlags(flags []cli.Flag) []cli.Flag {
+	return slices.Concat(databaseFlags, filterFlags, explainFlags, flags)
+}
+
+func runExplain(c *cli.Context, explain func() (*db.Explanation, error)) error {
+	output := c.String("output")
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("unsupported output format %q", output)
+	}
+	if err := initializeDatabase(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	explanation, err := explain()
+	if err != nil {
+		return err
+	}
+	if output == outputJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(explanation)
+	}
+	return writeExplanation(os.Stdout, explanation)
+}
+
+func writeExplanation(out io.Writer, explanation *db.Explanation) error {
+	args := make([]string, 0, len(explanation.Args))
+	for _, arg := range explanation.Args {
+		if value, ok := arg.(string); ok {
+			args = append(args, fmt.Sprintf("%q", value))
+		} else {
+			args = append(args, fmt.Sprint(arg))
+		}
+	}
+	lines := []string{
+		"DRIVER: " + explanation.Driver,
+		"SQL: " + explanation.SQL,
+		"ARGS: " + joinOrDash(args),
+		"",
+		"PLAN",
+	}
+	for _, line := range explanation.Plan {
+		lines = append(lines, "  "+line)
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(out, line); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintln(out); err != nil {
+		return err
+	}
+	if len(explanation.Findings) == 0 {
+		_, err := fmt.Fprintln(out, "No issues found")
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	rows := [][]string{{"ISSUE", "TABLE", "DETAIL"}}
+	for _, finding := range explanation.Findings {
+		rows = append(rows, []string{finding.Issue, finding.Table, finding.Detail})
+	}
+	for _, row := range rows {
+		if _, err := fmt.Fprintln(tw, strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(explanation.SuggestedIndexes) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintln(out, "\nSUGGESTED INDEXES"); err != nil {
+		return err
+	}
+	for _, statement := range explanation.SuggestedIndexes {
+		if _, err := fmt.Fprintln(out, "  "+statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,539 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	parquetgzip "github.com/parquet-go/parquet-go/compress/gzip"
+	parquetzstd "github.com/parquet-go/parquet-go/compress/zstd"
+	"github.com/urfave/cli/v2"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/db"
+)
+
+// Supported export formats
+const (
+	exportCSV     = "csv"
+	exportNDJSON  = "ndjson"
+	exportParquet = "parquet"
+)
+
+// Supported export compressions
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+const defaultExportPageSize = 10000
+
+var (
+	exportFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:     "file",
+			Usage:    "Output file, if rotation is enabled a sequence number is added before the extension",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Output format: csv, ndjson or parquet",
+			Value: exportCSV,
+		},
+		&cli.StringFlag{
+			Name:  "compression",
+			Usage: "Compression: none, gzip or zstd. Parquet files are compressed internally",
+			Value: compressionNone,
+		},
+		&cli.StringFlag{
+			Name:  "max-file-size",
+			Usage: "Start a new file after reaching this size, for example 1GiB. Files are rotated between pages",
+		},
+		&cli.IntFlag{
+			Name:  "page-size",
+			Usage: "Number of events to fetch for each query",
+			Value: defaultExportPageSize,
+		},
+		&cli.BoolFlag{
+			Name:  "enrich",
+			Usage: "Add symbolic names and ISO 8601 timestamps",
+		},
+		timezoneFlag,
+	}
+
+	exportCmd = &cli.Command{
+		Name:  "export",
+		Usage: "Export the events matching the filters to files, in ascending order",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "fs",
+				Usage: "Export filesystem events",
+				Flags: getExportFlags(fsFilterFlags),
+				Action: printError(func(c *cli.Context) error {
+					filters, err := getFsEventFilters(c)
+					if err != nil {
+						return err
+					}
+					filters.Order = 1
+					return runExport(c, func(fromID string, limit int) (*db.Page[db.FsEvent], error) {
+						filters.FromID = fromID
+						filters.Limit = limit
+						return (&db.Searcher{}).SearchFsEventsPage(filters, db.CountOptions{Mode: db.CountNone})
+					}, fsEventColumns)
+				}),
+			},
+			{
+				Name:  "provider",
+				Usage: "Export provider events",
+				Flags: getExportFlags(providerFilterFlags),
+				Action: printError(func(c *cli.Context) error {
+					filters, err := getProviderEventFilters(c)
+					if err != nil {
+						return err
+					}
+					filters.Order = 1
+					return runExport(c, func(fromID string, limit int) (*db.Page[db.ProviderEvent], error) {
+						filters.FromID = fromID
+						filters.Limit = limit
+						return (&db.Searcher{}).SearchProviderEventsPage(filters, db.CountOptions{Mode: db.CountNone})
+					}, providerEventColumns)
+				}),
+			},
+			{
+				Name:  "log",
+				Usage: "Export log events",
+				Flags: getExportFlags(logFilterFlags),
+				Action: printError(func(c *cli.Context) error {
+					filters, err := getLogEventFilters(c)
+					if err != nil {
+						return err
+					}
+					filters.Order = 1
+					return runExport(c, func(fromID string, limit int) (*db.Page[db.LogEvent], error) {
+						filters.FromID = fromID
+						filters.Limit = limit
+						page, err := (&db.Searcher{}).SearchLogEventsPage(filters, db.CountOptions{Mode: db.CountNone})
+						if err != nil {
+							return nil, err
+						}
+						if info := page.MessageSearch; info != nil && info.BoundedStartTimestamp != 0 {
+							// an export must include all the matching events
+							return nil, fmt.Errorf("no full-text index found, the message search is limited to the "+
+								"events since %s: use --since to set the time range",
+								time.Unix(0, info.BoundedStartTimestamp).UTC().Format(time.RFC3339))
+						}
+						return page, nil
+					}, logEventColumns)
+				}),
+			},
+		},
+	}
+)
+
+func getExportFlags(flags []cli.Flag) []cli.Flag {
+	return slices.Concat(databaseFlags, filterFlags, exportFlags, flags)
+}
+
+type columnType int
+
+const (
+	columnString columnType = iota
+	columnInt
+	columnJSON
+)
+
+// exportColumn defines an exported field, value returns a string, an int64 or
+// a []byte for JSON columns
+type exportColumn[T any] struct {
+	name string
+	kind columnType
+	// enriched columns are only exported if the enrichment is enabled
+	enriched bool
+	value    func(*T) any
+}
+
+var (
+	fsEventColumns = []exportColumn[db.FsEvent]{
+		{name: "id", value: func(ev *db.FsEvent) any { return ev.ID }},
+		{name: "timestamp", kind: columnInt, value: func(ev *db.FsEvent) any { return ev.Timestamp }},
+		{name: "timestamp_iso", enriched: true, value: func(ev *db.FsEvent) any { return ev.TimestampISO }},
+		{name: "action", value: func(ev *db.FsEvent) any { return ev.Action }},
+		{name: "username", value: func(ev *db.FsEvent) any { return ev.Username }},
+		{name: "fs_path", value: func(ev *db.FsEvent) any { return ev.FsPath }},
+		{name: "fs_target_path", value: func(ev *db.FsEvent) any { return ev.FsTargetPath }},
+		{name: "virtual_path", value: func(ev *db.FsEvent) any { return ev.VirtualPath }},
+		{name: "virtual_target_path", value: func(ev *db.FsEvent) any { return ev.VirtualTargetPath }},
+		{name: "ssh_cmd", value: func(ev *db.FsEvent) any { return ev.SSHCmd }},
+		{name: "file_size", kind: columnInt, value: func(ev *db.FsEvent) any { return ev.FileSize }},
+		{name: "elapsed", kind: columnInt, value: func(ev *db.FsEvent) any { return ev.Elapsed }},
+		{name: "status", kind: columnInt, value: func(ev *db.FsEvent) any { return int64(ev.Status) }},
+		{name: "status_name", enriched: true, value: func(ev *db.FsEvent) any { return ev.StatusName }},
+		{name: "protocol", value: func(ev *db.FsEvent) any { return ev.Protocol }},
+		{name: "ip", value: func(ev *db.FsEvent) any { return ev.IP }},
+		{name: "session_id", value: func(ev *db.FsEvent) any { return ev.SessionID }},
+		{name: "fs_provider", kind: columnInt, value: func(ev *db.FsEvent) any { return int64(ev.FsProvider) }},
+		{name: "fs_provider_name", enriched: true, value: func(ev *db.FsEvent) any { return ev.FsProviderName }},
+		{name: "bucket", value: func(ev *db.FsEvent) any { return ev.Bucket }},
+		{name: "endpoint", value: func(ev *db.FsEvent) any { return ev.Endpoint }},
+		{name: "open_flags", kind: columnInt, value: func(ev *db.FsEvent) any { return int64(ev.OpenFlags) }},
+		{name: "role", value: func(ev *db.FsEvent) any { return ev.Role }},
+		{name: "instance_id", value: func(ev *db.FsEvent) any { return ev.InstanceID }},
+	}
+	providerEventColumns = []exportColumn[db.ProviderEvent]{
+		{name: "id", value: func(ev *db.ProviderEvent) any { return ev.ID }},
+		{name: "timestamp", kind: columnInt, value: func(ev *db.ProviderEvent) any { return ev.Timestamp }},
+		{name: "timestamp_iso", enriched: true, value: func(ev *db.ProviderEvent) any { return ev.TimestampISO }},
+		{name: "action", value: func(ev *db.ProviderEvent) any { return ev.Action }},
+		{name: "username", value: func(ev *db.ProviderEvent) any { return ev.Username }},
+		{name: "ip", value: func(ev *db.ProviderEvent) any { return ev.IP }},
+		{name: "object_type", value: func(ev *db.ProviderEvent) any { return ev.ObjectType }},
+		{name: "object_name", value: func(ev *db.ProviderEvent) any { return ev.ObjectName }},
+		{name: "object_data", kind: columnJSON, value: func(ev *db.ProviderEvent) any { return ev.ObjectData }},
+		{name: "role", value: func(ev *db.ProviderEvent) any { return ev.Role }},
+		{name: "instance_id", value: func(ev *db.ProviderEvent) any { return ev.InstanceID }},
+	}
+	logEventColumns = []exportColumn[db.LogEvent]{
+		{name: "id", value: func(ev *db.LogEvent) any { return ev.ID }},
+		{name: "timestamp", kind: columnInt, value: func(ev *db.LogEvent) any { return ev.Timestamp }},
+		{name: "timestamp_iso", enriched: true, value: func(ev *db.LogEvent) any { return ev.TimestampISO }},
+		{name: "event", kind: columnInt, value: func(ev *db.LogEvent) any { return int64(ev.Event) }},
+		{name: "event_name", enriched: true, value: func(ev *db.LogEvent) any { return ev.EventName }},
+		{name: "protocol", value: func(ev *db.LogEvent) any { return ev.Protocol }},
+		{name: "username", value: func(ev *db.LogEvent) any { return ev.Username }},
+		{name: "ip", value: func(ev *db.LogEvent) any { return ev.IP }},
+		{name: "message", value: func(ev *db.LogEvent) any { return ev.Message }},
+		{name: "role", value: func(ev *db.LogEvent) any { return ev.Role }},
+		{name: "instance_id", value: func(ev *db.LogEvent) any { return ev.InstanceID }},
+	}
+)
+
+// runExport fetches all the pages using search and writes the events to the
+// export files. Only one page is held in memory
+func runExport[T any](c *cli.Context, search func(string, int) (*db.Page[T], error), columns []exportColumn[T],
+) error {
+	e, err := newExporter(c, columns)
+	if err != nil {
+		return err
+	}
+	if err := initializeDatabase(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	pageSize := c.Int("page-size")
+	if pageSize <= 0 {
+		pageSize = defaultExportPageSize
+	}
+	var fromID string
+	var count int64
+	for {
+		page, err := search(fromID, pageSize)
+		if err != nil {
+			e.abort()
+			return err
+		}
+		for idx := range page.Events {
+			if err := e.write(&page.Events[idx]); err != nil {
+				e.abort()
+				return err
+			}
+		}
+		count += int64(len(page.Events))
+		if err := e.rotate(); err != nil {
+			e.abort()
+			return err
+		}
+		if !page.HasMore {
+			break
+		}
+		fromID = page.NextCursor
+	}
+	if err := e.close(); err != nil {
+		return err
+	}
+	fmt.Printf("exported %d events to %s\n", count, strings.Join(e.files, ", "))
+	return nil
+}
+
+// exporter writes the events to files, starting a new file when the maximum
+// size is reached
+type exporter[T any] struct {
+	path        string
+	format      string
+	compression string
+	maxSize     int64
+	columns     []exportColumn[T]
+	schema      *parquet.Schema
+	files       []string
+	// the current file and the writers on top of it
+	file       *os.File
+	counter    *countingWriter
+	compressor flushWriteCloser
+	buffer     *bufio.Writer
+	csv        *csv.Writer
+	parquet    *parquet.Writer
+}
+
+func newExporter[T any](c *cli.Context, columns []exportColumn[T]) (*exporter[T], error) {
+	e := &exporter[T]{
+		path:        c.String("file"),
+		format:      c.String("format"),
+		compression: c.String("compression"),
+	}
+	switch e.format {
+	case exportCSV, exportNDJSON, exportParquet:
+	default:
+		return nil, fmt.Errorf("unsupported export format %q", e.format)
+	}
+	switch e.compression {
+	case compressionNone, compressionGzip, compressionZstd:
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", e.compression)
+	}
+	if value := c.String("max-file-size"); value != "" {
+		size, err := db.ParseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		e.maxSize = size
+	}
+	enriched := c.Bool("enrich")
+	for _, column := range columns {
+		if !column.enriched || enriched {
+			e.columns = append(e.columns, column)
+		}
+	}
+	if e.format == exportParquet {
+		group := parquet.Group{}
+		for _, column := range e.columns {
+			switch column.kind {
+			case columnInt:
+				group[column.name] = parquet.Int(64)
+			case columnJSON:
+				group[column.name] = parquet.JSON()
+			default:
+				group[column.name] = parquet.String()
+			}
+		}
+		e.schema = parquet.NewSchema("event", group)
+	}
+	return e, nil
+}
+
+// getFileName returns the name for the file with the given index, the index
+// is added before the extensions if rotation is enabled
+func (e *exporter[T]) getFileName(index int) string {
+	if e.maxSize <= 0 {
+		return e.path
+	}
+	dir, name := filepath.Split(e.path)
+	base, ext, _ := strings.Cut(name, ".")
+	if ext != "" {
+		ext = "." + ext
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%06d%s", base, index, ext))
+}
+
+func (e *exporter[T]) open() error {
+	name := e.getFileName(len(e.files) + 1)
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	e.file = file
+	e.files = append(e.files, name)
+	e.counter = &countingWriter{w: file}
+
+	if e.format == exportParquet {
+		var codec compress.Codec = &parquet.Uncompressed
+		switch e.compression {
+		case compressionGzip:
+			codec = &parquetgzip.Codec{Level: parquetgzip.DefaultCompression}
+		case compressionZstd:
+			codec = &parquetzstd.Codec{Level: parquetzstd.DefaultLevel}
+		}
+		// the row groups are written unbuffered so the file size is known
+		// after each flush
+		e.parquet = parquet.NewWriter(e.counter, e.schema, parquet.Compression(codec), parquet.WriteBufferSize(0))
+		return nil
+	}
+	var out io.Writer = e.counter
+	switch e.compression {
+	case compressionGzip:
+		e.compressor = gzip.NewWriter(e.counter)
+		out = e.compressor
+	case compressionZstd:
+		e.compressor, err = zstd.NewWriter(e.counter)
+		if err != nil {
+			return err
+		}
+		out = e.compressor
+	}
+	e.buffer = bufio.NewWriterSize(out, 64*1024)
+	if e.format == exportCSV {
+		e.csv = csv.NewWriter(e.buffer)
+		header := make([]string, 0, len(e.columns))
+		for _, column := range e.columns {
+			header = append(header, column.name)
+		}
+		return e.csv.Write(header)
+	}
+	return nil
+}
+
+func (e *exporter[T]) write(ev *T) error {
+	if e.file == nil {
+		if err := e.open(); err != nil {
+			return err
+		}
+	}
+	switch e.format {
+	case exportParquet:
+		row := make(parquet.Row, 0, len(e.columns))
+		for _, column := range e.columns {
+			leaf, _ := e.schema.Lookup(column.name)
+			row = append(row, parquet.ValueOf(column.value(ev)).Level(0, 0, leaf.ColumnIndex))
+		}
+		slices.SortFunc(row, func(a, b parquet.Value) int {
+			return a.Column() - b.Column()
+		})
+		_, err := e.parquet.WriteRows([]parquet.Row{row})
+		return err
+	case exportCSV:
+		record := make([]string, 0, len(e.columns))
+		for _, column := range e.columns {
+			switch v := column.value(ev).(type) {
+			case int64:
+				record = append(record, strconv.FormatInt(v, 10))
+			case []byte:
+				record = append(record, string(v))
+			default:
+				record = append(record, fmt.Sprint(v))
+			}
+		}
+		return e.csv.Write(record)
+	default:
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		_, err = e.buffer.Write(append(data, '\n'))
+		return err
+	}
+}
+
+// rotate closes the current file if it reached the maximum size, the next
+// write will open a new one
+func (e *exporter[T]) rotate() error {
+	if e.maxSize <= 0 || e.file == nil {
+		return nil
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	if e.counter.n < e.maxSize {
+		return nil
+	}
+	return e.closeFile()
+}
+
+func (e *exporter[T]) flush() error {
+	if e.parquet != nil {
+		return e.parquet.Flush()
+	}
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if err := e.buffer.Flush(); err != nil {
+		return err
+	}
+	if e.compressor != nil {
+		// flush the compressed data so the file size can be checked
+		return e.compressor.Flush()
+	}
+	return nil
+}
+
+func (e *exporter[T]) closeFile() error {
+	var err error
+	if e.parquet != nil {
+		err = e.parquet.Close()
+	} else {
+		err = e.flush()
+		if e.compressor != nil {
+			err = errors.Join(err, e.compressor.Close())
+		}
+	}
+	err = errors.Join(err, e.file.Close())
+	e.file, e.counter, e.compressor, e.buffer, e.csv, e.parquet = nil, nil, nil, nil, nil, nil
+	return err
+}
+
+// close finalizes the export, a file is always created, even if there are
+// no events
+func (e *exporter[T]) close() error {
+	if e.file == nil && len(e.files) == 0 {
+		if err := e.open(); err != nil {
+			return err
+		}
+	}
+	if e.file == nil {
+		return nil
+	}
+	return e.closeFile()
+}
+
+// abort closes the current file after an error, the files already written
+// are left as they are
+func (e *exporter[T]) abort() {
+	if e.file != nil {
+		e.closeFile() //nolint:errcheck
+	}
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// countingWriter counts the bytes written to the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,206 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/db"
+)
+
+// getTestContext returns a context with the given flags parsed from args
+func getTestContext(t *testing.T, flags []cli.Flag, args ...string) *cli.Context {
+	set := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	for _, f := range flags {
+		assert.NoError(t, f.Apply(set))
+	}
+	assert.NoError(t, set.Parse(args))
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func getTestLogEvents(count int) []db.LogEvent {
+	events := make([]db.LogEvent, 0, count)
+	for idx := range count {
+		events = append(events, db.LogEvent{
+			ID:        fmt.Sprintf("id%d", idx),
+			Timestamp: int64(idx + 1),
+			Event:     1,
+			Protocol:  "SSH",
+			Username:  "user",
+			Message:   fmt.Sprintf("message, \"%d\"", idx),
+		})
+	}
+	return events
+}
+
+func TestExportFileName(t *testing.T) {
+	e := &exporter[db.LogEvent]{path: filepath.Join("dir", "events.csv.gz")}
+	assert.Equal(t, filepath.Join("dir", "events.csv.gz"), e.getFileName(1))
+	e.maxSize = 1024
+	assert.Equal(t, filepath.Join("dir", "events-000001.csv.gz"), e.getFileName(1))
+	assert.Equal(t, filepath.Join("dir", "events-000012.csv.gz"), e.getFileName(12))
+	e.path = "events"
+	assert.Equal(t, "events-000002", e.getFileName(2))
+}
+
+func TestExportCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.csv")
+	e, err := newExporter(getTestContext(t, exportFlags, "--file", path), logEventColumns)
+	if !assert.NoError(t, err) {
+		return
+	}
+	events := getTestLogEvents(2)
+	for idx := range events {
+		assert.NoError(t, e.write(&events[idx]))
+	}
+	assert.NoError(t, e.rotate())
+	assert.NoError(t, e.close())
+	assert.Equal(t, []string{path}, e.files)
+
+	f, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"id", "timestamp", "event", "protocol", "username", "ip", "message", "role", "instance_id"},
+		{"id0", "1", "1", "SSH", "user", "", `message, "0"`, "", ""},
+		{"id1", "2", "1", "SSH", "user", "", `message, "1"`, "", ""},
+	}, records)
+	// existing files are never overwritten
+	e, err = newExporter(getTestContext(t, exportFlags, "--file", path), logEventColumns)
+	if assert.NoError(t, err) {
+		assert.ErrorIs(t, e.close(), os.ErrExist)
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson.gz")
+	e, err := newExporter(getTestContext(t, exportFlags, "--file", path, "--format", exportNDJSON,
+		"--compression", compressionGzip, "--enrich"), logEventColumns)
+	if !assert.NoError(t, err) {
+		return
+	}
+	events := getTestLogEvents(2)
+	events[0].EventName = "login_failed"
+	for idx := range events {
+		assert.NoError(t, e.write(&events[idx]))
+	}
+	assert.NoError(t, e.close())
+
+	f, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"id0","timestamp":1,"event":1,"protocol":"SSH","username":"user","message":"message, \"0\"",`+
+		`"event_name":"login_failed"}`+"\n"+
+		`{"id":"id1","timestamp":2,"event":1,"protocol":"SSH","username":"user","message":"message, \"1\""}`+"\n",
+		string(data))
+}
+
+func TestExportRotation(t *testing.T) {
+	dir := t.TempDir()
+	e, err := newExporter(getTestContext(t, exportFlags, "--file", filepath.Join(dir, "events.csv"),
+		"--max-file-size", "200"), logEventColumns)
+	if !assert.NoError(t, err) {
+		return
+	}
+	events := getTestLogEvents(5)
+	// the first page is smaller than the maximum size
+	assert.NoError(t, e.write(&events[0]))
+	assert.NoError(t, e.rotate())
+	assert.Len(t, e.files, 1)
+	assert.NotNil(t, e.file)
+	// the size is reached, the file is closed and the next write opens a new one
+	for idx := 1; idx < 4; idx++ {
+		assert.NoError(t, e.write(&events[idx]))
+	}
+	assert.NoError(t, e.rotate())
+	assert.Nil(t, e.file)
+	assert.NoError(t, e.write(&events[4]))
+	assert.NoError(t, e.rotate())
+	assert.NoError(t, e.close())
+	assert.Equal(t, []string{
+		filepath.Join(dir, "events-000001.csv"),
+		filepath.Join(dir, "events-000002.csv"),
+	}, e.files)
+
+	var ids []string
+	for _, name := range e.files {
+		data, err := os.ReadFile(name)
+		if !assert.NoError(t, err) {
+			return
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		// each file has its own header
+		assert.True(t, strings.HasPrefix(lines[0], "id,timestamp,"))
+		for _, line := range lines[1:] {
+			ids = append(ids, strings.Split(line, ",")[0])
+		}
+	}
+	assert.Equal(t, []string{"id0", "id1", "id2", "id3", "id4"}, ids)
+	// a closed export does not create more files
+	assert.NoError(t, e.close())
+	assert.Len(t, e.files, 2)
+}
+
+func TestExportEmpty(t *testing.T) {
+	dir := t.TempDir()
+	e, err := newExporter(getTestContext(t, exportFlags, "--file", filepath.Join(dir, "events.csv"),
+		"--max-file-size", "1KB"), logEventColumns)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, e.rotate())
+	assert.NoError(t, e.close())
+	if assert.Equal(t, []string{filepath.Join(dir, "events-000001.csv")}, e.files) {
+		data, err := os.ReadFile(e.files[0])
+		assert.NoError(t, err)
+		assert.Equal(t, "id,timestamp,event,protocol,username,ip,message,role,instance_id\n", string(data))
+	}
+}
+
+func TestExportInvalidOptions(t *testing.T) {
+	for _, args := range [][]string{
+		{"--file", "events", "--format", "xml"},
+		{"--file", "events", "--compression", "lz4"},
+		{"--file", "events", "--max-file-size", "invalid"},
+	} {
+		_, err := newExporter(getTestContext(t, exportFlags, args...), logEventColumns)
+		assert.Error(t, err, args)
+	}
+}
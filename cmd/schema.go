@@ -0,0 +1,137 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/db"
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/logger"
+)
+
+var checkSchemaCmd = &cli.Command{
+	Name:  "check-schema",
+	Usage: "Detect the eventstore schema version of the events tables and report the missing columns and indexes",
+	Flags: slices.Concat(databaseFlags, []cli.Flag{
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Output format: table or json",
+			Value:   outputTable,
+		},
+	}),
+	Action: printError(func(c *cli.Context) error {
+		output := c.String("output")
+		if output != outputTable && output != outputJSON {
+			return fmt.Errorf("unsupported output format %q", output)
+		}
+		if err := db.Initialize(driver, dsn, customTLSConfig, poolSize); err != nil {
+			return err
+		}
+		defer db.Close()
+
+		report, err := db.CheckSchema()
+		if err != nil {
+			return err
+		}
+		if report == nil {
+			return errors.New("the configured backend cannot inspect its schema")
+		}
+		if output == outputJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(report); err != nil {
+				return err
+			}
+		} else if err := writeSchemaTable(os.Stdout, report); err != nil {
+			return err
+		}
+		return report.Err()
+	}),
+}
+
+// checkSchema returns an error if the schema cannot be inspected or none of
+// the events tables can be searched, the unavailable tables and the missing
+// columns and indexes are logged
+func checkSchema() error {
+	report, err := db.CheckSchema()
+	if err != nil || report == nil {
+		return err
+	}
+	var usable int
+	for _, table := range report.Tables {
+		switch {
+		case !table.IsUsable():
+			logger.AppLogger.Warn("the events table cannot be searched", "table", table.Table,
+				"exists", table.Exists, "missing columns", strings.Join(table.MissingColumns, ", "))
+			continue
+		case len(table.MissingColumns) > 0:
+			logger.AppLogger.Warn("the events table is outdated, searches using the missing columns are refused",
+				"table", table.Table, "version", table.Version, "latest version", table.LatestVersion,
+				"missing columns", strings.Join(table.MissingColumns, ", "))
+		}
+		if len(table.MissingIndexes) > 0 {
+			logger.AppLogger.Warn("the events table has no index on some columns, searches filtering on them can be slow",
+				"table", table.Table, "missing indexes", strings.Join(table.MissingIndexes, ", "))
+		}
+		usable++
+	}
+	if usable == 0 {
+		return report.Err()
+	}
+	return nil
+}
+
+func writeSchemaTable(out io.Writer, report *db.SchemaReport) error {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(tw, "TABLE\tVERSION\tSTATUS\tMISSING COLUMNS\tMISSING INDEXES"); err != nil {
+		return err
+	}
+	for _, table := range report.Tables {
+		status := "ok"
+		switch {
+		case !table.Exists:
+			status = "missing"
+		case !table.IsUsable():
+			status = "unsupported"
+		case len(table.MissingColumns) > 0:
+			status = "outdated"
+		case len(table.MissingIndexes) > 0:
+			status = "missing indexes"
+		}
+		_, err := fmt.Fprintf(tw, "%s\t%d/%d\t%s\t%s\t%s\n", table.Table, table.Version, table.LatestVersion, status,
+			joinOrDash(table.MissingColumns), joinOrDash(table.MissingIndexes))
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+func joinOrDash(values []string) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	return strings.Join(values, ", ")
+}
@@ -0,0 +1,606 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/urfave/cli/v2"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/db"
+)
+
+// Supported output formats
+const (
+	outputTable  = "table"
+	outputJSON   = "json"
+	outputNDJSON = "ndjson"
+)
+
+const defaultPageSize = 500
+
+var (
+	// filterFlags are the filters shared by all the event types
+	filterFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "Only events after this time, a duration such as 24h or 7d or a timestamp",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "Only events before this time, a duration such as 1h or a timestamp",
+		},
+		&cli.StringSliceFlag{
+			Name:  "user",
+			Usage: "Only events for these usernames",
+		},
+		&cli.StringSliceFlag{
+			Name:  "ip",
+			Usage: "Only events from these IP addresses",
+		},
+		&cli.StringSliceFlag{
+			Name:  "network",
+			Usage: "Only events from these networks, for example 192.168.1.0/24",
+		},
+		&cli.StringSliceFlag{
+			Name:  "role",
+			Usage: "Only events for these roles",
+		},
+		&cli.StringSliceFlag{
+			Name:  "instance",
+			Usage: "Only events from these SFTPGo instance IDs",
+		},
+		&cli.StringFlag{
+			Name:  "query",
+			Usage: `Textual query, for example "username:alice AND NOT action:delete"`,
+		},
+	}
+
+	searchOutputFlags = []cli.Flag{
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "Maximum number of events to return, 0 means no limit",
+			Value: 100,
+		},
+		&cli.IntFlag{
+			Name:  "page-size",
+			Usage: "Number of events to fetch for each query",
+			Value: defaultPageSize,
+		},
+		&cli.BoolFlag{
+			Name:  "asc",
+			Usage: "Sort the events by ascending timestamp, default descending",
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Output format: table, json or ndjson",
+			Value:   outputTable,
+		},
+		&cli.BoolFlag{
+			Name:  "enrich",
+			Usage: "Add symbolic names and ISO 8601 timestamps to the json and ndjson output, always enabled for tables",
+		},
+		timezoneFlag,
+	}
+
+	timezoneFlag = &cli.StringFlag{
+		Name:  "timezone",
+		Usage: "IANA time zone for the rendered timestamps",
+		Value: "UTC",
+	}
+
+	fsFilterFlags = []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "action",
+			Usage: "Only these actions, for example upload, download, delete",
+		},
+		&cli.StringSliceFlag{
+			Name:  "protocol",
+			Usage: "Only these protocols, for example SFTP, FTP, DAV, HTTP",
+		},
+		&cli.IntSliceFlag{
+			Name:  "status",
+			Usage: "Only these statuses: 1 ok, 2 error, 3 quota exceeded",
+		},
+		&cli.StringFlag{
+			Name:  "path",
+			Usage: "Only events for this virtual path, use a trailing * for a prefix match",
+		},
+		&cli.StringFlag{
+			Name:  "session",
+			Usage: "Only events for this session ID",
+		},
+		&cli.StringFlag{
+			Name:  "min-size",
+			Usage: "Minimum file size, for example 10MB",
+		},
+		&cli.StringFlag{
+			Name:  "max-size",
+			Usage: "Maximum file size, for example 1GiB",
+		},
+	}
+
+	providerFilterFlags = []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "action",
+			Usage: "Only these actions, for example add, update, delete",
+		},
+		&cli.StringSliceFlag{
+			Name:  "object-type",
+			Usage: "Only these object types, for example user, folder, admin",
+		},
+		&cli.StringSliceFlag{
+			Name:  "object-name",
+			Usage: "Only these object names",
+		},
+		&cli.StringSliceFlag{
+			Name:  "data",
+			Usage: `Predicates on the object data, for example 'filesystem.provider = 1'`,
+		},
+		&cli.BoolFlag{
+			Name:  "omit-data",
+			Usage: "Do not return the object data",
+		},
+		redactedPathsFlag,
+	}
+
+	logFilterFlags = []cli.Flag{
+		&cli.IntSliceFlag{
+			Name: "event",
+			Usage: "Only these events: 1 login failed, 2 login with a non-existent user, 3 no login tried, " +
+				"4 algorithm negotiation failed, 5 login ok",
+		},
+		&cli.StringSliceFlag{
+			Name:  "protocol",
+			Usage: "Only these protocols, for example SSH, FTP, DAV, HTTP",
+		},
+		&cli.StringFlag{
+			Name:  "message",
+			Usage: `Full-text search on the message, for example '"permission denied" key*'`,
+		},
+	}
+
+	searchCmd = &cli.Command{
+		Name:  "search",
+		Usage: "Search the events directly in the database",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "fs",
+				Usage: "Search filesystem events",
+				Flags: getSearchFlags(fsFilterFlags),
+				Action: printError(func(c *cli.Context) error {
+					filters, err := getFsEventFilters(c)
+					if err != nil {
+						return err
+					}
+					return runSearch(c, func(fromID string, limit int) (*db.Page[db.FsEvent], error) {
+						filters.FromID = fromID
+						filters.Limit = limit
+						return (&db.Searcher{}).SearchFsEventsPage(filters, db.CountOptions{Mode: db.CountNone})
+					}, fsEventsTable)
+				}),
+			},
+			{
+				Name:  "provider",
+				Usage: "Search provider events",
+				Flags: getSearchFlags(providerFilterFlags),
+				Action: printError(func(c *cli.Context) error {
+					filters, err := getProviderEventFilters(c)
+					if err != nil {
+						return err
+					}
+					return runSearch(c, func(fromID string, limit int) (*db.Page[db.ProviderEvent], error) {
+						filters.FromID = fromID
+						filters.Limit = limit
+						return (&db.Searcher{}).SearchProviderEventsPage(filters, db.CountOptions{Mode: db.CountNone})
+					}, providerEventsTable)
+				}),
+			},
+			{
+				Name:  "log",
+				Usage: "Search log events",
+				Flags: getSearchFlags(logFilterFlags),
+				Action: printError(func(c *cli.Context) error {
+					filters, err := getLogEventFilters(c)
+					if err != nil {
+						return err
+					}
+					var warned bool
+					return runSearch(c, func(fromID string, limit int) (*db.Page[db.LogEvent], error) {
+						filters.FromID = fromID
+						filters.Limit = limit
+						page, err := (&db.Searcher{}).SearchLogEventsPage(filters, db.CountOptions{Mode: db.CountNone})
+						if err == nil && !warned {
+							warned = warnBoundedMessageSearch(c.App.ErrWriter, page.MessageSearch)
+						}
+						return page, err
+					}, logEventsTable)
+				}),
+			},
+		},
+	}
+)
+
+// getSearchFlags returns the database, filter and output flags followed by the
+// given filter flags
+func getSearchFlags(flags []cli.Flag) []cli.Flag {
+	return slices.Concat(databaseFlags, filterFlags, searchOutputFlags, flags)
+}
+
+// printError prints the error returned by the given action, urfave/cli only
+// prints usage errors
+func printError(action cli.ActionFunc) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		err := action(c)
+		if err != nil {
+			fmt.Fprintf(c.App.ErrWriter, "Error: %v\n", err)
+		}
+		return err
+	}
+}
+
+// initializeDatabase connects to the database configured using the database
+// flags and checks its schema
+func initializeDatabase() error {
+	if err := setRedactedPaths(redactedPaths.Value()); err != nil {
+		return err
+	}
+	if err := db.Initialize(driver, dsn, customTLSConfig, poolSize); err != nil {
+		return err
+	}
+	if err := checkSchema(); err != nil {
+		db.Close()
+		return err
+	}
+	return nil
+}
+
+// tableFormat defines the table output for an event type
+type tableFormat[T any] struct {
+	header []string
+	row    func(*T) []string
+}
+
+var (
+	fsEventsTable = tableFormat[db.FsEvent]{
+		header: []string{"TIME", "ACTION", "USER", "PROTOCOL", "IP", "PATH", "SIZE", "ELAPSED", "STATUS"},
+		row: func(ev *db.FsEvent) []string {
+			path := ev.VirtualPath
+			if ev.VirtualTargetPath != "" {
+				path += " -> " + ev.VirtualTargetPath
+			}
+			return []string{ev.TimestampISO, ev.Action, ev.Username, ev.Protocol, ev.IP, path,
+				strconv.FormatInt(ev.FileSize, 10), (time.Duration(ev.Elapsed) * time.Millisecond).String(),
+				getName(ev.StatusName, ev.Status)}
+		},
+	}
+	providerEventsTable = tableFormat[db.ProviderEvent]{
+		header: []string{"TIME", "ACTION", "USER", "IP", "OBJECT TYPE", "OBJECT NAME", "ROLE"},
+		row: func(ev *db.ProviderEvent) []string {
+			return []string{ev.TimestampISO, ev.Action, ev.Username, ev.IP, ev.ObjectType, ev.ObjectName, ev.Role}
+		},
+	}
+	logEventsTable = tableFormat[db.LogEvent]{
+		header: []string{"TIME", "EVENT", "PROTOCOL", "USER", "IP", "MESSAGE"},
+		row: func(ev *db.LogEvent) []string {
+			return []string{ev.TimestampISO, getName(ev.EventName, ev.Event), ev.Protocol, ev.Username, ev.IP,
+				ev.Message}
+		},
+	}
+)
+
+func getName(name string, value int) string {
+	if name != "" {
+		return name
+	}
+	return strconv.Itoa(value)
+}
+
+// runSearch fetches the pages using search until the limit is reached and
+// writes the events in the requested format
+func runSearch[T any](c *cli.Context, search func(string, int) (*db.Page[T], error), table tableFormat[T]) error {
+	output := c.String("output")
+	if output != outputTable && output != outputJSON && output != outputNDJSON {
+		return fmt.Errorf("unsupported output format %q", output)
+	}
+	if err := initializeDatabase(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	w := newEventWriter(os.Stdout, output, table)
+	limit := c.Int("limit")
+	pageSize := c.Int("page-size")
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	var fromID string
+	for count := 0; limit <= 0 || count < limit; {
+		size := pageSize
+		if limit > 0 {
+			size = min(size, limit-count)
+		}
+		page, err := search(fromID, size)
+		if err != nil {
+			return err
+		}
+		for idx := range page.Events {
+			if err := w.write(&page.Events[idx]); err != nil {
+				return err
+			}
+		}
+		if err := w.flush(); err != nil {
+			return err
+		}
+		count += len(page.Events)
+		if !page.HasMore {
+			break
+		}
+		fromID = page.NextCursor
+	}
+	return w.close()
+}
+
+// eventWriter writes the events in the requested format
+type eventWriter[T any] struct {
+	format  string
+	out     io.Writer
+	table   tableFormat[T]
+	tw      *tabwriter.Writer
+	written int
+}
+
+func newEventWriter[T any](out io.Writer, format string, table tableFormat[T]) *eventWriter[T] {
+	return &eventWriter[T]{
+		format: format,
+		out:    out,
+		table:  table,
+		tw:     tabwriter.NewWriter(out, 0, 0, 2, ' ', 0),
+	}
+}
+
+func (w *eventWriter[T]) write(ev *T) error {
+	defer func() {
+		w.written++
+	}()
+
+	switch w.format {
+	case outputTable:
+		if w.written == 0 {
+			if _, err := fmt.Fprintln(w.tw, strings.Join(w.table.header, "\t")); err != nil {
+				return err
+			}
+		}
+		row := w.table.row(ev)
+		for idx := range row {
+			row[idx] = strings.Map(func(r rune) rune {
+				if r == '\t' || r == '\n' || r == '\r' {
+					return ' '
+				}
+				return r
+			}, row[idx])
+		}
+		_, err := fmt.Fprintln(w.tw, strings.Join(row, "\t"))
+		return err
+	default:
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		prefix := ""
+		if w.format == outputJSON {
+			prefix = ",\n"
+			if w.written == 0 {
+				prefix = "[\n"
+			}
+		} else {
+			data = append(data, '\n')
+		}
+		_, err = w.out.Write(append([]byte(prefix), data...))
+		return err
+	}
+}
+
+func (w *eventWriter[T]) flush() error {
+	if w.format == outputTable {
+		return w.tw.Flush()
+	}
+	return nil
+}
+
+func (w *eventWriter[T]) close() error {
+	if w.format != outputJSON {
+		return w.flush()
+	}
+	end := "\n]\n"
+	if w.written == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(w.out, end)
+	return err
+}
+
+// parseTimeFlag parses a time relative to now, such as 24h or 7d, or a
+// timestamp in one of the formats supported by db.ParseTimestamp
+func parseTimeFlag(value string, now time.Time) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n).UnixNano(), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d).UnixNano(), nil
+	}
+	return db.ParseTimestamp(value)
+}
+
+func getCommonSearchParams(c *cli.Context) (eventsearcher.CommonSearchParams, error) {
+	now := time.Now()
+	var params eventsearcher.CommonSearchParams
+	var err error
+
+	params.StartTimestamp, err = parseTimeFlag(c.String("since"), now)
+	if err != nil {
+		return params, fmt.Errorf("invalid since: %w", err)
+	}
+	params.EndTimestamp, err = parseTimeFlag(c.String("until"), now)
+	if err != nil {
+		return params, fmt.Errorf("invalid until: %w", err)
+	}
+	params.InstanceIDs = c.StringSlice("instance")
+	if c.Bool("asc") {
+		params.Order = 1
+	}
+	return params, nil
+}
+
+func getMultiValueFilters(c *cli.Context) db.MultiValueFilters {
+	return db.MultiValueFilters{
+		Usernames: c.StringSlice("user"),
+		IPs:       c.StringSlice("ip"),
+		Roles:     c.StringSlice("role"),
+	}
+}
+
+func getEnrichmentOptions(c *cli.Context) db.EnrichmentOptions {
+	return db.EnrichmentOptions{
+		Enabled:  c.Bool("enrich") || c.String("output") == outputTable,
+		TimeZone: c.String("timezone"),
+	}
+}
+
+func getFsEventFilters(c *cli.Context) (*db.FsEventFilters, error) {
+	params, err := getCommonSearchParams(c)
+	if err != nil {
+		return nil, err
+	}
+	filters := &db.FsEventFilters{
+		FsEventSearch: eventsearcher.FsEventSearch{
+			CommonSearchParams: params,
+			Actions:            c.StringSlice("action"),
+			Protocols:          c.StringSlice("protocol"),
+			FsProvider:         -1,
+		},
+		MultiValueFilters: getMultiValueFilters(c),
+		NetworkFilters:    db.NetworkFilters{Networks: c.StringSlice("network")},
+		Query:             c.String("query"),
+		SessionID:         c.String("session"),
+		Enrichment:        getEnrichmentOptions(c),
+	}
+	for _, status := range c.IntSlice("status") {
+		filters.Statuses = append(filters.Statuses, int32(status))
+	}
+	if path := c.String("path"); path != "" {
+		filter := db.PathFilter{Mode: db.PathMatchExact, Value: path}
+		if prefix, ok := strings.CutSuffix(path, "*"); ok {
+			filter.Mode, filter.Value = db.PathMatchPrefix, prefix
+		}
+		filters.Paths = []db.PathFilter{filter}
+	}
+	if value := c.String("min-size"); value != "" {
+		size, err := db.ParseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		filters.FileSizeRange.Min = &size
+	}
+	if value := c.String("max-size"); value != "" {
+		size, err := db.ParseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		filters.FileSizeRange.Max = &size
+	}
+	return filters, nil
+}
+
+func getProviderEventFilters(c *cli.Context) (*db.ProviderEventFilters, error) {
+	params, err := getCommonSearchParams(c)
+	if err != nil {
+		return nil, err
+	}
+	filters := &db.ProviderEventFilters{
+		ProviderEventSearch: eventsearcher.ProviderEventSearch{
+			CommonSearchParams: params,
+			Actions:            c.StringSlice("action"),
+			ObjectTypes:        c.StringSlice("object-type"),
+			OmitObjectData:     c.Bool("omit-data") || c.String("output") == outputTable,
+		},
+		MultiValueFilters: getMultiValueFilters(c),
+		NetworkFilters:    db.NetworkFilters{Networks: c.StringSlice("network")},
+		ObjectNames:       c.StringSlice("object-name"),
+		Query:             c.String("query"),
+		Enrichment:        getEnrichmentOptions(c),
+	}
+	for _, expression := range c.StringSlice("data") {
+		filter, err := db.ParseJSONFilter(expression)
+		if err != nil {
+			return nil, err
+		}
+		filters.ObjectData = append(filters.ObjectData, filter)
+	}
+	return filters, nil
+}
+
+func getLogEventFilters(c *cli.Context) (*db.LogEventFilters, error) {
+	params, err := getCommonSearchParams(c)
+	if err != nil {
+		return nil, err
+	}
+	filters := &db.LogEventFilters{
+		LogEventSearch: eventsearcher.LogEventSearch{
+			CommonSearchParams: params,
+			Protocols:          c.StringSlice("protocol"),
+		},
+		MultiValueFilters: getMultiValueFilters(c),
+		NetworkFilters:    db.NetworkFilters{Networks: c.StringSlice("network")},
+		Message:           c.String("message"),
+		Query:             c.String("query"),
+		Enrichment:        getEnrichmentOptions(c),
+	}
+	for _, event := range c.IntSlice("event") {
+		filters.Events = append(filters.Events, int32(event))
+	}
+	if filters.Message != "" && filters.EndTimestamp == 0 {
+		// the time range of message searches can be bounded starting from the
+		// end timestamp, it must not move while fetching the pages
+		filters.EndTimestamp = time.Now().UnixNano()
+	}
+	return filters, nil
+}
+
+// warnBoundedMessageSearch warns that the message search was limited to a
+// time range, if so. It returns true if the warning was written
+func warnBoundedMessageSearch(out io.Writer, info *db.MessageSearchInfo) bool {
+	if info == nil || info.BoundedStartTimestamp == 0 {
+		return false
+	}
+	fmt.Fprintf(out, "Warning: no full-text index found, only the messages since %s were searched, "+
+		"use --since to set the time range\n", time.Unix(0, info.BoundedStartTimestamp).UTC().Format(time.RFC3339))
+	return true
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/db"
+)
+
+func TestParseTimeFlag(t *testing.T) {
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+
+	ts, err := parseTimeFlag("", now)
+	assert.NoError(t, err)
+	assert.Zero(t, ts)
+	ts, err = parseTimeFlag("7d", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 3, 24, 12, 0, 0, 0, time.UTC).UnixNano(), ts)
+	// days are calendar days, not multiples of 24 hours
+	ts, err = parseTimeFlag("31d", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.AddDate(0, 0, -31).UnixNano(), ts)
+	ts, err = parseTimeFlag("0d", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.UnixNano(), ts)
+	ts, err = parseTimeFlag("90m", now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.Add(-90*time.Minute).UnixNano(), ts)
+	ts, err = parseTimeFlag("2024-01-01T00:00:00Z", now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano(), ts)
+	// integer and decimal seconds since the epoch are the same timestamp
+	for _, value := range []string{"1704067200", "1704067200.0", "1704067200000"} {
+		ts, err = parseTimeFlag(value, now)
+		assert.NoError(t, err, value)
+		assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano(), ts, value)
+	}
+
+	for _, value := range []string{"-1d", "1.5d", "d", "yesterday"} {
+		_, err = parseTimeFlag(value, now)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestEventWriter(t *testing.T) {
+	events := getTestLogEvents(2)
+	events[1].Message = "multi\nline\tmessage"
+
+	var buf bytes.Buffer
+	w := newEventWriter(&buf, outputNDJSON, logEventsTable)
+	for idx := range events {
+		assert.NoError(t, w.write(&events[idx]))
+	}
+	assert.NoError(t, w.close())
+	assert.Equal(t, `{"id":"id0","timestamp":1,"event":1,"protocol":"SSH","username":"user","message":"message, \"0\""}`+
+		"\n"+`{"id":"id1","timestamp":2,"event":1,"protocol":"SSH","username":"user","message":"multi\nline\tmessage"}`+
+		"\n", buf.String())
+
+	buf.Reset()
+	w = newEventWriter(&buf, outputJSON, logEventsTable)
+	assert.NoError(t, w.close())
+	assert.Equal(t, "[]\n", buf.String())
+	buf.Reset()
+	w = newEventWriter(&buf, outputJSON, logEventsTable)
+	assert.NoError(t, w.write(&events[0]))
+	assert.NoError(t, w.close())
+	assert.Equal(t, "[\n"+`{"id":"id0","timestamp":1,"event":1,"protocol":"SSH","username":"user",`+
+		`"message":"message, \"0\""}`+"\n]\n", buf.String())
+
+	buf.Reset()
+	w = newEventWriter(&buf, outputTable, logEventsTable)
+	for idx := range events {
+		assert.NoError(t, w.write(&events[idx]))
+	}
+	assert.NoError(t, w.close())
+	assert.Equal(t, "TIME  EVENT  PROTOCOL  USER  IP  MESSAGE\n"+
+		"      1      SSH       user      message, \"0\"\n"+
+		"      1      SSH       user      multi line message\n", buf.String())
+}
+
+func TestWarnBoundedMessageSearch(t *testing.T) {
+	var buf bytes.Buffer
+	assert.False(t, warnBoundedMessageSearch(&buf, nil))
+	assert.False(t, warnBoundedMessageSearch(&buf, &db.MessageSearchInfo{Strategy: db.MessageSearchLike}))
+	assert.Empty(t, buf.String())
+	assert.True(t, warnBoundedMessageSearch(&buf, &db.MessageSearchInfo{
+		Strategy:              db.MessageSearchLike,
+		BoundedStartTimestamp: time.Date(2024, 3, 24, 12, 0, 0, 0, time.UTC).UnixNano(),
+	}))
+	assert.Contains(t, buf.String(), "2024-03-24T12:00:00Z")
+}
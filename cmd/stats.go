@@ -0,0 +1,145 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/db"
+)
+
+var (
+	statsFlags = []cli.Flag{
+		&cli.BoolFlag{
+			Name: "exact",
+			Usage: "Count the rows and the distinct values exactly instead of using the catalog estimates, it can be " +
+				"slow on large tables",
+		},
+		&cli.StringFlag{
+			Name:    "output",
+			Aliases: []string{"o"},
+			Usage:   "Output format: table or json",
+			Value:   outputTable,
+		},
+		timezoneFlag,
+	}
+
+	statsCmd = &cli.Command{
+		Name:  "stats",
+		Usage: "Show the rows, time range, distinct users, IPs and instances and the disk size of the events tables",
+		Flags: slices.Concat(databaseFlags, statsFlags),
+		Action: printError(func(c *cli.Context) error {
+			output := c.String("output")
+			if output != outputTable && output != outputJSON {
+				return fmt.Errorf("unsupported output format %q", output)
+			}
+			location, err := time.LoadLocation(c.String("timezone"))
+			if err != nil {
+				return fmt.Errorf("invalid time zone %q: %w", c.String("timezone"), err)
+			}
+			if err := initializeDatabase(); err != nil {
+				return err
+			}
+			defer db.Close()
+
+			stats, err := (&db.Searcher{}).GetStats(db.StatsOptions{ExactCount: c.Bool("exact")})
+			if err != nil {
+				return err
+			}
+			if output == outputJSON {
+				encoder := json.NewEncoder(os.Stdout)
+				encoder.SetIndent("", "  ")
+				return encoder.Encode(stats)
+			}
+			return writeStatsTable(os.Stdout, stats, location)
+		}),
+	}
+)
+
+func writeStatsTable(out io.Writer, stats []db.TableStats, location *time.Location) error {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	rows := [][]string{{"TABLE", "ROWS", "OLDEST", "NEWEST", "USERS", "IPS", "INSTANCES", "DATA SIZE", "INDEX SIZE"}}
+	for _, table := range stats {
+		dataSize, indexSize := "-", "-"
+		if table.Size != nil {
+			dataSize, indexSize = formatSize(table.Size.Data), formatSize(table.Size.Indexes)
+		}
+		rows = append(rows, []string{table.Table, formatStatsCount(table.Rows),
+			formatStatsTimestamp(table.OldestTimestamp, location), formatStatsTimestamp(table.NewestTimestamp, location),
+			formatStatsCount(table.DistinctUsers), formatStatsCount(table.DistinctIPs),
+			formatStatsCount(table.DistinctInstances), dataSize, indexSize})
+	}
+	indexHeader := len(rows)
+	for _, table := range stats {
+		if table.Size == nil {
+			continue
+		}
+		for _, index := range table.Size.IndexSizes {
+			rows = append(rows, []string{table.Table, index.Name, formatSize(index.Size)})
+		}
+	}
+	if len(rows) > indexHeader {
+		// an empty line starts a new tabwriter block
+		rows = slices.Insert(rows, indexHeader, nil, []string{"TABLE", "INDEX", "SIZE"})
+	}
+	for _, row := range rows {
+		if _, err := fmt.Fprintln(tw, strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// formatStatsCount adds a "~" prefix to estimates
+func formatStatsCount(count db.Count) string {
+	value := strconv.FormatInt(count.Value, 10)
+	if count.Relation == db.CountRelationEstimate {
+		return "~" + value
+	}
+	return value
+}
+
+// formatStatsTimestamp returns "-" for empty tables
+func formatStatsTimestamp(timestamp int64, location *time.Location) string {
+	if timestamp == 0 {
+		return "-"
+	}
+	return time.Unix(0, timestamp).In(location).Format(time.RFC3339)
+}
+
+// formatSize formats a size in bytes using binary units
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	var idx int
+	for value >= unit && idx < 4 {
+		value /= unit
+		idx++
+	}
+	return fmt.Sprintf("%.1f %s", value, []string{"B", "KiB", "MiB", "GiB", "TiB"}[idx])
+}
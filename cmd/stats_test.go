@@ -0,0 +1,33 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "0 B", formatSize(0))
+	assert.Equal(t, "1023 B", formatSize(1023))
+	assert.Equal(t, "1.0 KiB", formatSize(1024))
+	assert.Equal(t, "1.5 KiB", formatSize(1536))
+	assert.Equal(t, "10.0 MiB", formatSize(10*1024*1024))
+	assert.Equal(t, "2.0 GiB", formatSize(2*1024*1024*1024))
+	assert.Equal(t, "1.0 TiB", formatSize(1024*1024*1024*1024))
+	// TiB is the largest unit
+	assert.Equal(t, "2048.0 TiB", formatSize(2*1024*1024*1024*1024*1024))
+}
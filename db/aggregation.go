@@ -0,0 +1,231 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/logger"
+)
+
+const defaultAggregationLimit = 1000
+
+var errNoGroupBy = errors.New("please specify at least a field to group by")
+
+// AggregationOptions defines the options for an aggregation search
+type AggregationOptions struct {
+	// GroupBy defines the fields used to group the matching events
+	GroupBy []string
+	// Limit is the maximum number of returned buckets, zero means the default
+	// limit
+	Limit int
+}
+
+func (o *AggregationOptions) getLimit() int {
+	if o.Limit > 0 {
+		return o.Limit
+	}
+	return defaultAggregationLimit
+}
+
+// AggregationBucket defines the number of events for a combination of the
+// grouped fields values. NULL values have a nil key
+type AggregationBucket struct {
+	Keys  map[string]any `json:"keys"`
+	Count int64          `json:"count"`
+}
+
+// AggregationResult defines the result of an aggregation search. The buckets
+// are sorted by count, descending
+type AggregationResult struct {
+	GroupBy []string            `json:"group_by"`
+	Buckets []AggregationBucket `json:"buckets"`
+	// MessageSearch describes how a log events message search was executed
+	MessageSearch *MessageSearchInfo `json:"message_search,omitempty"`
+}
+
+// Aggregator is implemented by the backends able to group and count the
+// events matching a search, the pagination parameters are ignored
+type Aggregator interface {
+	AggregateFsEvents(ctx context.Context, filters *FsEventFilters, options AggregationOptions,
+	) ([]AggregationBucket, error)
+	AggregateProviderEvents(ctx context.Context, filters *ProviderEventFilters, options AggregationOptions,
+	) ([]AggregationBucket, error)
+	AggregateLogEvents(ctx context.Context, filters *LogEventFilters, options AggregationOptions,
+	) ([]AggregationBucket, error)
+}
+
+// AggregateFsEvents groups and counts the filesystem events matching the given filters
+func (s *Searcher) AggregateFsEvents(filters *FsEventFilters, options AggregationOptions,
+) (*AggregationResult, error) {
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateAggregationOptions(options, (&FsEvent{}).TableName(), fsEventGroupableFields); err != nil {
+		return nil, err
+	}
+	aggregator, err := getAggregator()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	buckets, err := aggregator.AggregateFsEvents(ctx, filters, options)
+	return newAggregationResult(options, buckets, err, "fs")
+}
+
+// AggregateProviderEvents groups and counts the provider events matching the given filters
+func (s *Searcher) AggregateProviderEvents(filters *ProviderEventFilters, options AggregationOptions,
+) (*AggregationResult, error) {
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateAggregationOptions(options, (&ProviderEvent{}).TableName(), providerEventGroupableFields); err != nil {
+		return nil, err
+	}
+	aggregator, err := getAggregator()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	buckets, err := aggregator.AggregateProviderEvents(ctx, filters, options)
+	return newAggregationResult(options, buckets, err, "provider")
+}
+
+// AggregateLogEvents groups and counts the log events matching the given filters
+func (s *Searcher) AggregateLogEvents(filters *LogEventFilters, options AggregationOptions,
+) (*AggregationResult, error) {
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateAggregationOptions(options, (&LogEvent{}).TableName(), logEventGroupableFields); err != nil {
+		return nil, err
+	}
+	filters, messageSearch, err := getMessageSearchFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	aggregator, err := getAggregator()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	buckets, err := aggregator.AggregateLogEvents(ctx, filters, options)
+	result, err := newAggregationResult(options, buckets, err, "log")
+	if err != nil {
+		return nil, err
+	}
+	result.MessageSearch = messageSearch
+	return result, nil
+}
+
+func validateAggregationOptions(options AggregationOptions, table string, allowed map[string]fieldType) error {
+	if len(options.GroupBy) == 0 {
+		return errNoGroupBy
+	}
+	if err := validateFields(options.GroupBy, allowed); err != nil {
+		return err
+	}
+	return checkColumns(table, options.GroupBy...)
+}
+
+func getAggregator() (Aggregator, error) {
+	b, err := getBackend()
+	if err != nil {
+		return nil, err
+	}
+	aggregator, ok := b.(Aggregator)
+	if !ok {
+		return nil, errNotSupported
+	}
+	return aggregator, nil
+}
+
+func newAggregationResult(options AggregationOptions, buckets []AggregationBucket, err error, eventType string,
+) (*AggregationResult, error) {
+	if err != nil {
+		logger.AppLogger.Warn("unable to aggregate events", "type", eventType, "error", err)
+		return nil, err
+	}
+	if buckets == nil {
+		buckets = []AggregationBucket{}
+	}
+	return &AggregationResult{
+		GroupBy: options.GroupBy,
+		Buckets: buckets,
+	}, nil
+}
+
+func (b *gormBackend) AggregateFsEvents(ctx context.Context, filters *FsEventFilters,
+	options AggregationOptions,
+) ([]AggregationBucket, error) {
+	sess := b.applyFsEventFilters(b.getSession(ctx).Model(&FsEvent{}), filters)
+	return aggregate(sess, options, fsEventGroupableFields)
+}
+
+func (b *gormBackend) AggregateProviderEvents(ctx context.Context, filters *ProviderEventFilters,
+	options AggregationOptions,
+) ([]AggregationBucket, error) {
+	sess := b.applyProviderEventFilters(b.getSession(ctx).Model(&ProviderEvent{}), filters)
+	return aggregate(sess, options, providerEventGroupableFields)
+}
+
+func (b *gormBackend) AggregateLogEvents(ctx context.Context, filters *LogEventFilters,
+	options AggregationOptions,
+) ([]AggregationBucket, error) {
+	sess := b.applyLogEventFilters(b.getSession(ctx).Model(&LogEvent{}), filters)
+	return aggregate(sess, options, logEventGroupableFields)
+}
+
+// aggregate groups the events selected by sess, the group by fields must be
+// validated by the caller
+func aggregate(sess *gorm.DB, options AggregationOptions, fields map[string]fieldType) ([]AggregationBucket, error) {
+	columns := strings.Join(options.GroupBy, ", ")
+	rows, err := sess.Select(columns + ", COUNT(*) AS total").
+		Group(columns).
+		Order("total DESC, " + columns).
+		Limit(options.getLimit()).
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results, err := scanRowsToMaps(rows)
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]AggregationBucket, 0, len(results))
+	for _, result := range results {
+		bucket := AggregationBucket{
+			Keys:  make(map[string]any, len(options.GroupBy)),
+			Count: toInt64(result["total"]),
+		}
+		for _, field := range options.GroupBy {
+			bucket.Keys[field] = convertFieldValue(result[field], fields[field])
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestAggregateEvents(t *testing.T) {
+	fsEvents := []FsEvent{
+		{ID: xid.New().String(), Timestamp: 400, Action: "upload", Username: "user1", Protocol: "SFTP", Status: 1},
+		{ID: xid.New().String(), Timestamp: 401, Action: "upload", Username: "user1", Protocol: "SFTP", Status: 1},
+		{ID: xid.New().String(), Timestamp: 402, Action: "upload", Username: "user2", Protocol: "HTTP", Status: 2},
+		{ID: xid.New().String(), Timestamp: 403, Action: "download", Username: "user1", Protocol: "SFTP", Status: 1},
+		{ID: xid.New().String(), Timestamp: 404, Action: "upload", Username: "user3", Protocol: "FTP", Status: 1},
+	}
+	logEvents := []LogEvent{
+		{ID: xid.New().String(), Timestamp: 400, Event: 1, Protocol: "SSH", Username: "user1"},
+		{ID: xid.New().String(), Timestamp: 401, Event: 1, Protocol: "SSH", Username: "user2"},
+		{ID: xid.New().String(), Timestamp: 402, Event: 1, Protocol: "FTP", Username: "user1"},
+		{ID: xid.New().String(), Timestamp: 403, Event: 2, Protocol: "SSH", Username: "user3"},
+	}
+	providerEvents := []ProviderEvent{
+		{ID: xid.New().String(), Timestamp: 400, Action: "add", Username: "admin", ObjectType: "user", ObjectName: "u1"},
+		{ID: xid.New().String(), Timestamp: 401, Action: "update", Username: "admin", ObjectType: "user", ObjectName: "u1"},
+		{ID: xid.New().String(), Timestamp: 402, Action: "update", Username: "admin", ObjectType: "folder", ObjectName: "f1"},
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&logEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&providerEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	fsFilters := FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: 400,
+			EndTimestamp:   499,
+		},
+		Actions:    []string{"upload"},
+		FsProvider: -1,
+	}}
+	_, err = s.AggregateFsEvents(&fsFilters, AggregationOptions{})
+	assert.ErrorIs(t, err, errNoGroupBy)
+	_, err = s.AggregateFsEvents(&fsFilters, AggregationOptions{GroupBy: []string{"message"}})
+	assert.Error(t, err)
+	_, err = s.AggregateFsEvents(&fsFilters, AggregationOptions{GroupBy: []string{"username", "username"}})
+	assert.Error(t, err)
+	// uploads per user
+	result, err := s.AggregateFsEvents(&fsFilters, AggregationOptions{GroupBy: []string{"username"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"username"}, result.GroupBy)
+	assert.Equal(t, []AggregationBucket{
+		{Keys: map[string]any{"username": "user1"}, Count: 2},
+		{Keys: map[string]any{"username": "user2"}, Count: 1},
+		{Keys: map[string]any{"username": "user3"}, Count: 1},
+	}, result.Buckets)
+
+	result, err = s.AggregateFsEvents(&fsFilters, AggregationOptions{
+		GroupBy: []string{"protocol", "status"},
+		Limit:   1,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []AggregationBucket{
+		{Keys: map[string]any{"protocol": "SFTP", "status": int64(1)}, Count: 2},
+	}, result.Buckets)
+
+	fsFilters.Actions = []string{"rename"}
+	result, err = s.AggregateFsEvents(&fsFilters, AggregationOptions{GroupBy: []string{"username"}})
+	assert.NoError(t, err)
+	assert.NotNil(t, result.Buckets)
+	assert.Len(t, result.Buckets, 0)
+	// failed logins per protocol
+	result, err = s.AggregateLogEvents(&LogEventFilters{LogEventSearch: eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: 400,
+			EndTimestamp:   499,
+		},
+		Events: []int32{1},
+	}}, AggregationOptions{GroupBy: []string{"protocol", "event"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []AggregationBucket{
+		{Keys: map[string]any{"protocol": "SSH", "event": int64(1)}, Count: 2},
+		{Keys: map[string]any{"protocol": "FTP", "event": int64(1)}, Count: 1},
+	}, result.Buckets)
+	_, err = s.AggregateLogEvents(&LogEventFilters{}, AggregationOptions{GroupBy: []string{"action"}})
+	assert.Error(t, err)
+
+	result, err = s.AggregateProviderEvents(&ProviderEventFilters{ProviderEventSearch: eventsearcher.ProviderEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: 400,
+			EndTimestamp:   499,
+		},
+	}}, AggregationOptions{GroupBy: []string{"object_type", "action"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []AggregationBucket{
+		{Keys: map[string]any{"object_type": "folder", "action": "update"}, Count: 1},
+		{Keys: map[string]any{"object_type": "user", "action": "add"}, Count: 1},
+		{Keys: map[string]any{"object_type": "user", "action": "update"}, Count: 1},
+	}, result.Buckets)
+	_, err = s.AggregateProviderEvents(&ProviderEventFilters{},
+		AggregationOptions{GroupBy: []string{"status"}})
+	assert.Error(t, err)
+	// NULL values, for example the role of the events stored before it was
+	// added, are not merged with empty values
+	err = sess.Model(&providerEvents[2]).Update("role", gorm.Expr("NULL")).Error
+	assert.NoError(t, err)
+	result, err = s.AggregateProviderEvents(&ProviderEventFilters{ProviderEventSearch: eventsearcher.ProviderEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: 400,
+			EndTimestamp:   499,
+		},
+	}}, AggregationOptions{GroupBy: []string{"role"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []AggregationBucket{
+		{Keys: map[string]any{"role": ""}, Count: 2},
+		{Keys: map[string]any{"role": nil}, Count: 1},
+	}, result.Buckets)
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&logEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&providerEvents).Error
+	assert.NoError(t, err)
+}
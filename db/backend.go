@@ -0,0 +1,77 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Backend defines the interface for an events storage backend.
+// Searcher validates the search requests and delegates them to the backend
+// configured using Initialize
+type Backend interface {
+	// Ping verifies that the storage is reachable
+	Ping(ctx context.Context) error
+	// Close releases the resources held by the backend
+	Close() error
+	// SearchFsEvents returns the filesystem events matching the given filters
+	SearchFsEvents(ctx context.Context, filters *FsEventFilters) ([]FsEvent, error)
+	// SearchProviderEvents returns the provider events matching the given filters
+	SearchProviderEvents(ctx context.Context, filters *ProviderEventFilters) ([]ProviderEvent, error)
+	// SearchLogEvents returns the log events matching the given filters
+	SearchLogEvents(ctx context.Context, filters *LogEventFilters) ([]LogEvent, error)
+}
+
+// BackendConfig defines the configuration used to create a backend
+type BackendConfig struct {
+	Driver          string
+	DSN             string
+	CustomTLSConfig string
+	PoolSize        int
+}
+
+// BackendFactory creates a backend from the given configuration
+type BackendFactory func(config BackendConfig) (Backend, error)
+
+var (
+	backendsMu       sync.RWMutex
+	backendFactories = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a backend available for the given driver name.
+// Custom backends must be registered before calling Initialize, for example
+// from an init function. It panics if the driver is already registered
+func RegisterBackend(driver string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if factory == nil {
+		panic("db: register backend with nil factory")
+	}
+	if _, ok := backendFactories[driver]; ok {
+		panic(fmt.Sprintf("db: register backend called twice for driver %q", driver))
+	}
+	backendFactories[driver] = factory
+}
+
+func getBackendFactory(driver string) (BackendFactory, bool) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	factory, ok := backendFactories[driver]
+	return factory, ok
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryBackend struct {
+	fsEvents       []FsEvent
+	providerEvents []ProviderEvent
+	logEvents      []LogEvent
+	closed         bool
+}
+
+func (b *memoryBackend) Ping(_ context.Context) error {
+	if b.closed {
+		return errors.New("closed")
+	}
+	return nil
+}
+
+func (b *memoryBackend) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *memoryBackend) SearchFsEvents(_ context.Context, _ *FsEventFilters) ([]FsEvent, error) {
+	return b.fsEvents, nil
+}
+
+func (b *memoryBackend) SearchProviderEvents(_ context.Context, _ *ProviderEventFilters,
+) ([]ProviderEvent, error) {
+	return b.providerEvents, nil
+}
+
+func (b *memoryBackend) SearchLogEvents(_ context.Context, _ *LogEventFilters) ([]LogEvent, error) {
+	return b.logEvents, nil
+}
+
+func TestCustomBackend(t *testing.T) {
+	mem := &memoryBackend{
+		fsEvents:       []FsEvent{{ID: "fs1", Action: "upload"}},
+		providerEvents: []ProviderEvent{{ID: "provider1", Action: "add"}},
+		logEvents:      []LogEvent{{ID: "log1", Event: 1}},
+	}
+	RegisterBackend("memory", func(_ BackendConfig) (Backend, error) {
+		return mem, nil
+	})
+	assert.Panics(t, func() {
+		RegisterBackend("memory", func(_ BackendConfig) (Backend, error) {
+			return mem, nil
+		})
+	})
+	assert.Panics(t, func() {
+		RegisterBackend("nil", nil)
+	})
+
+	err := Initialize("unknown", "", "", 0)
+	assert.Error(t, err)
+
+	// the default backend must not be closed
+	defaultBackend := setTestBackend(nil)
+	defer setTestBackend(defaultBackend)
+
+	err = Initialize("memory", "", "", 0)
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	data, err := s.SearchFsEvents(&eventsearcher.FsEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			Limit: 10,
+		},
+	})
+	assert.NoError(t, err)
+	var fsEvents []FsEvent
+	err = json.Unmarshal(data, &fsEvents)
+	assert.NoError(t, err)
+	assert.Equal(t, mem.fsEvents, fsEvents)
+
+	data, err = s.SearchProviderEvents(&eventsearcher.ProviderEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			Limit: 10,
+		},
+	})
+	assert.NoError(t, err)
+	var providerEvents []ProviderEvent
+	err = json.Unmarshal(data, &providerEvents)
+	assert.NoError(t, err)
+	assert.Equal(t, mem.providerEvents, providerEvents)
+
+	data, err = s.SearchLogEvents(&eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			Limit: 10,
+		},
+	})
+	assert.NoError(t, err)
+	var logEvents []LogEvent
+	err = json.Unmarshal(data, &logEvents)
+	assert.NoError(t, err)
+	assert.Equal(t, mem.logEvents, logEvents)
+
+	err = Close()
+	assert.NoError(t, err)
+	assert.True(t, mem.closed)
+	_, err = s.SearchLogEvents(&eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			Limit: 10,
+		},
+	})
+	assert.ErrorIs(t, err, errNotInitialized)
+	// initialization fails if the backend is not reachable
+	err = Initialize("memory", "", "", 0)
+	assert.Error(t, err)
+}
+
+func TestInitializeReplacesBackend(t *testing.T) {
+	var backends []*memoryBackend
+	RegisterBackend("memory_replace", func(_ BackendConfig) (Backend, error) {
+		b := &memoryBackend{}
+		backends = append(backends, b)
+		return b, nil
+	})
+
+	defaultBackend := setTestBackend(nil)
+	defer setTestBackend(defaultBackend)
+
+	err := Initialize("memory_replace", "", "", 0)
+	assert.NoError(t, err)
+	err = Initialize("memory_replace", "", "", 0)
+	assert.NoError(t, err)
+	if assert.Len(t, backends, 2) {
+		assert.True(t, backends[0].closed)
+		assert.False(t, backends[1].closed)
+		b, err := getBackend()
+		assert.NoError(t, err)
+		assert.Equal(t, backends[1], b)
+	}
+	assert.NoError(t, Close())
+	assert.True(t, backends[1].closed)
+}
+
+func TestInitializeWhileSearching(t *testing.T) {
+	RegisterBackend("memory_concurrent", func(_ BackendConfig) (Backend, error) {
+		return &memoryBackend{
+			logEvents: []LogEvent{{ID: "log1", Event: 1}},
+		}, nil
+	})
+
+	defaultBackend := setTestBackend(nil)
+	defer setTestBackend(defaultBackend)
+
+	err := Initialize("memory_concurrent", "", "", 0)
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			s := Searcher{}
+			for range 50 {
+				if _, err := s.SearchLogEvents(&eventsearcher.LogEventSearch{
+					CommonSearchParams: eventsearcher.CommonSearchParams{
+						Limit: 10,
+					},
+				}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for range 20 {
+		err = Initialize("memory_concurrent", "", "", 0)
+		assert.NoError(t, err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, Close())
+}
@@ -0,0 +1,235 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// CountMode defines how the total number of events matching a search is computed
+type CountMode int
+
+// Supported count modes
+const (
+	// CountAuto counts the events exactly up to the configured limit, beyond
+	// the limit the query planner estimate is used, if available
+	CountAuto CountMode = iota
+	// CountExact always counts the events exactly, it can be slow on large tables
+	CountExact
+	// CountEstimated uses the query planner estimate, if available
+	CountEstimated
+	// CountNone disables the total count
+	CountNone
+)
+
+// Count relations
+const (
+	// CountRelationEqual means that the total is exact
+	CountRelationEqual = "eq"
+	// CountRelationGreaterOrEqual means that the total is a lower bound
+	CountRelationGreaterOrEqual = "gte"
+	// CountRelationEstimate means that the total is a query planner estimate
+	CountRelationEstimate = "estimate"
+)
+
+const defaultCountLimit = 10000
+
+var errEstimateNotSupported = errors.New("count estimate is not supported")
+
+// CountOptions defines the options to compute the total number of events
+// matching a search
+type CountOptions struct {
+	Mode CountMode
+	// Limit is the maximum number of events counted exactly in CountAuto mode
+	// and if an estimate is not available. Zero means the default limit
+	Limit int64
+}
+
+func (o *CountOptions) getLimit() int64 {
+	if o.Limit > 0 {
+		return o.Limit
+	}
+	return defaultCountLimit
+}
+
+// Count defines the total number of events matching a search
+type Count struct {
+	Value    int64  `json:"value"`
+	Relation string `json:"relation"`
+}
+
+// Counter is implemented by the backends able to count the events matching
+// a search, the pagination parameters are ignored
+type Counter interface {
+	CountFsEvents(ctx context.Context, filters *FsEventFilters, options CountOptions) (Count, error)
+	CountProviderEvents(ctx context.Context, filters *ProviderEventFilters, options CountOptions,
+	) (Count, error)
+	CountLogEvents(ctx context.Context, filters *LogEventFilters, options CountOptions) (Count, error)
+}
+
+func (b *gormBackend) CountFsEvents(ctx context.Context, filters *FsEventFilters, options CountOptions,
+) (Count, error) {
+	sess := b.applyFsEventFilters(b.getSession(ctx).Model(&FsEvent{}), filters)
+	return b.count(ctx, sess, options)
+}
+
+func (b *gormBackend) CountProviderEvents(ctx context.Context, filters *ProviderEventFilters,
+	options CountOptions,
+) (Count, error) {
+	sess := b.applyProviderEventFilters(b.getSession(ctx).Model(&ProviderEvent{}), filters)
+	return b.count(ctx, sess, options)
+}
+
+func (b *gormBackend) CountLogEvents(ctx context.Context, filters *LogEventFilters, options CountOptions,
+) (Count, error) {
+	sess := b.applyLogEventFilters(b.getSession(ctx).Model(&LogEvent{}), filters)
+	return b.count(ctx, sess, options)
+}
+
+func (b *gormBackend) count(ctx context.Context, sess *gorm.DB, options CountOptions) (Count, error) {
+	// the session is used for more than one query
+	sess = sess.Session(&gorm.Session{})
+
+	switch options.Mode {
+	case CountExact:
+		var total int64
+		err := sess.Count(&total).Error
+		return Count{Value: total, Relation: CountRelationEqual}, err
+	case CountEstimated:
+		total, err := b.estimate(ctx, sess)
+		if err == nil {
+			return Count{Value: total, Relation: CountRelationEstimate}, nil
+		}
+		if !errors.Is(err, errEstimateNotSupported) {
+			return Count{}, err
+		}
+		return b.countWithLimit(ctx, sess, options.getLimit())
+	default:
+		count, err := b.countWithLimit(ctx, sess, options.getLimit())
+		if err != nil || count.Relation == CountRelationEqual {
+			return count, err
+		}
+		total, err := b.estimate(ctx, sess)
+		if err != nil {
+			if errors.Is(err, errEstimateNotSupported) {
+				return count, nil
+			}
+			return Count{}, err
+		}
+		// the estimate is not reliable if lower than the exact count
+		if total > count.Value {
+			return Count{Value: total, Relation: CountRelationEstimate}, nil
+		}
+		return count, nil
+	}
+}
+
+// countWithLimit counts the events exactly but stops counting after limit
+func (b *gormBackend) countWithLimit(ctx context.Context, sess *gorm.DB, limit int64) (Count, error) {
+	var total int64
+	err := b.getSession(ctx).Table("(?) AS limited", sess.Select("1").Limit(int(limit)+1)).Count(&total).Error
+	if err != nil {
+		return Count{}, err
+	}
+	if total > limit {
+		return Count{Value: limit, Relation: CountRelationGreaterOrEqual}, nil
+	}
+	return Count{Value: total, Relation: CountRelationEqual}, nil
+}
+
+// estimate returns the number of rows estimated by the query planner
+func (b *gormBackend) estimate(ctx context.Context, sess *gorm.DB) (int64, error) {
+	var prefix string
+	switch b.driver {
+	case driverNamePostgreSQL:
+		prefix = "EXPLAIN (FORMAT JSON) "
+	case driverNameMySQL:
+		prefix = "EXPLAIN "
+	default:
+		return 0, errEstimateNotSupported
+	}
+	query, args := getSQL(sess)
+	sqlDB, err := b.db.DB()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := sqlDB.QueryContext(ctx, prefix+query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	if b.driver == driverNamePostgreSQL {
+		var plan string
+		if rows.Next() {
+			if err := rows.Scan(&plan); err != nil {
+				return 0, err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		return parsePostgreSQLEstimate(plan)
+	}
+	results, err := scanRowsToMaps(rows)
+	if err != nil {
+		return 0, err
+	}
+	return parseMySQLEstimate(results)
+}
+
+// getSQL returns the SELECT statement, and its arguments, for the given session
+// without executing it
+func getSQL(sess *gorm.DB) (string, []any) {
+	stmt := sess.Session(&gorm.Session{DryRun: true}).Find(&[]map[string]any{}).Statement
+	return stmt.SQL.String(), stmt.Vars
+}
+
+func parsePostgreSQLEstimate(plan string) (int64, error) {
+	var explain []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	if err := json.Unmarshal([]byte(plan), &explain); err != nil {
+		return 0, fmt.Errorf("unable to parse query plan: %w", err)
+	}
+	if len(explain) == 0 {
+		return 0, errors.New("empty query plan")
+	}
+	return int64(explain[0].Plan.Rows), nil
+}
+
+func parseMySQLEstimate(results []map[string]any) (int64, error) {
+	if len(results) == 0 {
+		return 0, errors.New("empty query plan")
+	}
+	rows, err := strconv.ParseFloat(toString(results[0]["rows"]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse estimated rows: %w", err)
+	}
+	// MariaDB does not include the filtered column by default
+	filtered, err := strconv.ParseFloat(toString(results[0]["filtered"]), 64)
+	if err != nil || filtered <= 0 {
+		filtered = 100
+	}
+	return int64(rows * filtered / 100), nil
+}
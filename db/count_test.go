@@ -0,0 +1,42 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEstimate(t *testing.T) {
+	total, err := parsePostgreSQLEstimate(`[{"Plan": {"Node Type": "Seq Scan", "Plan Rows": 1234}}]`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1234), total)
+	_, err = parsePostgreSQLEstimate(`[]`)
+	assert.Error(t, err)
+	_, err = parsePostgreSQLEstimate(`invalid`)
+	assert.Error(t, err)
+
+	total, err = parseMySQLEstimate([]map[string]any{{"rows": []byte("1000"), "filtered": 10.0}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), total)
+	total, err = parseMySQLEstimate([]map[string]any{{"rows": int64(1000)}})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), total)
+	_, err = parseMySQLEstimate([]map[string]any{{"rows": nil}})
+	assert.Error(t, err)
+	_, err = parseMySQLEstimate(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const cursorPrefix = "c1:"
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// cursor identifies the position of an event within the (timestamp, id)
+// ordering used by all the searches
+type cursor struct {
+	Timestamp int64
+	ID        string
+}
+
+// encodeCursor returns the opaque cursor for the event with the given
+// timestamp and id
+func encodeCursor(timestamp int64, id string) string {
+	value := cursorPrefix + strconv.FormatInt(timestamp, 10) + ":" + id
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// decodeCursor parses a cursor returned by encodeCursor
+func decodeCursor(value string) (cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor{}, errInvalidCursor
+	}
+	decoded, ok := strings.CutPrefix(string(data), cursorPrefix)
+	if !ok {
+		return cursor{}, errInvalidCursor
+	}
+	ts, id, ok := strings.Cut(decoded, ":")
+	if !ok || id == "" {
+		return cursor{}, errInvalidCursor
+	}
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return cursor{}, errInvalidCursor
+	}
+	return cursor{
+		Timestamp: timestamp,
+		ID:        id,
+	}, nil
+}
+
+// Page defines a page of search results. NextCursor is empty if there are
+// no more results, otherwise it can be used as FromID to get the next page.
+// Total is nil if the count is disabled or not supported by the backend
+type Page[T any] struct {
+	Events     []T    `json:"events"`
+	Total      *Count `json:"total,omitempty"`
+	HasMore    bool   `json:"has_more"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	// MessageSearch describes how a log events message search was executed
+	MessageSearch *MessageSearchInfo `json:"message_search,omitempty"`
+}
+
+// newPage builds a page from results fetched using limit+1 as limit, the
+// extra result, if any, is only used to detect if there are more results
+func newPage[T any](results []T, limit int, key func(*T) (int64, string)) *Page[T] {
+	page := &Page[T]{
+		Events: results,
+	}
+	if page.Events == nil {
+		page.Events = []T{}
+	}
+	if len(results) > limit {
+		page.HasMore = true
+		page.Events = results[:limit]
+		page.NextCursor = encodeCursor(key(&page.Events[limit-1]))
+	}
+	return page
+}
+
+// setPageTotal sets the total number of events matching filters using the
+// count method of b. If the first page has all the matching events the total
+// is exact and no count query is executed. The total is not set if the count
+// is disabled or not supported by b
+func setPageTotal[T, F any](b Backend, page *Page[T], filters F, fromID string, options CountOptions,
+	count func(Counter, context.Context, F, CountOptions) (Count, error),
+) error {
+	if fromID == "" && !page.HasMore {
+		page.Total = &Count{Value: int64(len(page.Events)), Relation: CountRelationEqual}
+		return nil
+	}
+	counter, ok := b.(Counter)
+	if !ok || options.Mode == CountNone {
+		return nil
+	}
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	total, err := count(counter, ctx, filters, options)
+	if err != nil {
+		return err
+	}
+	page.Total = &total
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursor(t *testing.T) {
+	id := xid.New().String()
+	c, err := decodeCursor(encodeCursor(1672531200000000000, id))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1672531200000000000), c.Timestamp)
+	assert.Equal(t, id, c.ID)
+	// IDs can contain the separator
+	c, err = decodeCursor(encodeCursor(-1, "a:b"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1), c.Timestamp)
+	assert.Equal(t, "a:b", c.ID)
+
+	for _, value := range []string{
+		"",
+		id,
+		"%%",
+		base64.RawURLEncoding.EncodeToString([]byte("c1:123")),
+		base64.RawURLEncoding.EncodeToString([]byte("c1:123:")),
+		base64.RawURLEncoding.EncodeToString([]byte("c1:abc:id")),
+		base64.RawURLEncoding.EncodeToString([]byte("c2:123:id")),
+	} {
+		_, err = decodeCursor(value)
+		assert.ErrorIs(t, err, errInvalidCursor, value)
+	}
+}
+
+func TestNewPage(t *testing.T) {
+	key := func(ev *LogEvent) (int64, string) {
+		return ev.Timestamp, ev.ID
+	}
+	page := newPage[LogEvent](nil, 2, key)
+	assert.NotNil(t, page.Events)
+	assert.Empty(t, page.NextCursor)
+
+	events := []LogEvent{{ID: "1", Timestamp: 10}, {ID: "2", Timestamp: 20}}
+	page = newPage(events, 2, key)
+	assert.Len(t, page.Events, 2)
+	assert.Empty(t, page.NextCursor)
+
+	events = append(events, LogEvent{ID: "3", Timestamp: 30})
+	page = newPage(events, 2, key)
+	assert.Len(t, page.Events, 2)
+	assert.Equal(t, encodeCursor(20, "2"), page.NextCursor)
+}
+
+func TestSetPageTotal(t *testing.T) {
+	key := func(ev *LogEvent) (int64, string) {
+		return ev.Timestamp, ev.ID
+	}
+	filters := &LogEventFilters{}
+	events := []LogEvent{{ID: "1", Timestamp: 10}, {ID: "2", Timestamp: 20}, {ID: "3", Timestamp: 30}}
+	// the first page has all the events, the backend is not used
+	page := newPage(events, 3, key)
+	err := setPageTotal(nil, page, filters, "", CountOptions{Mode: CountNone}, Counter.CountLogEvents)
+	assert.NoError(t, err)
+	if assert.NotNil(t, page.Total) {
+		assert.Equal(t, Count{Value: 3, Relation: CountRelationEqual}, *page.Total)
+	}
+	// the count is not supported by the backend
+	page = newPage(events, 2, key)
+	err = setPageTotal(&memoryBackend{}, page, filters, "", CountOptions{Mode: CountExact}, Counter.CountLogEvents)
+	assert.NoError(t, err)
+	assert.Nil(t, page.Total)
+	// the count is disabled
+	err = setPageTotal(getTestBackend(), page, filters, "", CountOptions{Mode: CountNone}, Counter.CountLogEvents)
+	assert.NoError(t, err)
+	assert.Nil(t, page.Total)
+	// the count is executed by the given backend
+	err = setPageTotal(getTestBackend(), page, filters, "", CountOptions{Mode: CountExact}, Counter.CountLogEvents)
+	assert.NoError(t, err)
+	assert.NotNil(t, page.Total)
+}
@@ -18,16 +18,14 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
+	"sync"
 	"time"
 
 	mysqldriver "github.com/go-sql-driver/mysql"
-	"gorm.io/driver/mysql"
-	"gorm.io/driver/postgres"
-	"gorm.io/gorm"
-	gormlogger "gorm.io/gorm/logger"
 
 	"github.com/sftpgo/sftpgo-plugin-eventsearch/logger"
 )
@@ -35,78 +33,90 @@ import (
 const (
 	driverNamePostgreSQL = "postgres"
 	driverNameMySQL      = "mysql"
+	driverNameSQLite     = "sqlite"
 )
 
 var (
-	handle              *gorm.DB
 	defaultQueryTimeout = 20 * time.Second
+	errNotInitialized   = errors.New("the database backend is not initialized")
 )
 
-// Initialize initializes the database engine
+// currentBackend is the configured backend, it is replaced by Initialize and
+// Close while searches may be in progress
+var currentBackend = struct {
+	sync.RWMutex
+	backend Backend
+}{}
+
+// Initialize initializes the backend registered for the given driver
 func Initialize(driver, dsn, customTLSConfig string, poolSize int) error {
-	var err error
-
-	switch driver {
-	case driverNamePostgreSQL:
-		handle, err = gorm.Open(postgres.New(postgres.Config{
-			DSN: dsn,
-		}), &gorm.Config{
-			SkipDefaultTransaction: true,
-			Logger:                 gormlogger.Discard,
-		})
-		if err != nil {
-			logger.AppLogger.Error("unable to create db handle", "error", err)
-			return err
-		}
-	case driverNameMySQL:
-		if err := handleCustomTLSConfig(customTLSConfig); err != nil {
-			logger.AppLogger.Error("unable to register custom tls config", "error", err)
-			return err
-		}
-		handle, err = gorm.Open(mysql.New(mysql.Config{
-			DSN: dsn,
-		}), &gorm.Config{
-			SkipDefaultTransaction: true,
-			Logger:                 gormlogger.Discard,
-		})
-		if err != nil {
-			logger.AppLogger.Error("unable to create db handle", "error", err)
-			return err
-		}
-	default:
+	factory, ok := getBackendFactory(driver)
+	if !ok {
 		return fmt.Errorf("unsupported database driver %v", driver)
 	}
 
-	sqlDB, err := handle.DB()
+	b, err := factory(BackendConfig{
+		Driver:          driver,
+		DSN:             dsn,
+		CustomTLSConfig: customTLSConfig,
+		PoolSize:        poolSize,
+	})
 	if err != nil {
-		logger.AppLogger.Error("unable to get sql db handle", "error", err)
 		return err
 	}
 
-	sqlDB.SetMaxOpenConns(poolSize)
-	if poolSize > 0 {
-		sqlDB.SetMaxIdleConns(poolSize)
-	} else {
-		sqlDB.SetMaxIdleConns(2)
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	if err := b.Ping(ctx); err != nil {
+		if errClose := b.Close(); errClose != nil {
+			logger.AppLogger.Warn("unable to close the unreachable backend", "driver", driver, "error", errClose)
+		}
+		return err
+	}
+	currentBackend.Lock()
+	previous := currentBackend.backend
+	currentBackend.backend = b
+	currentBackend.Unlock()
+	// a previous backend is replaced, its connections must be released. The
+	// queries already started are completed, the new ones use b
+	if previous != nil {
+		if err := previous.Close(); err != nil {
+			logger.AppLogger.Warn("unable to close the previous backend", "error", err)
+		}
 	}
-	sqlDB.SetConnMaxIdleTime(4 * time.Minute)
-	sqlDB.SetConnMaxLifetime(2 * time.Minute)
+	return nil
+}
 
-	return sqlDB.Ping()
+// Close releases the resources held by the configured backend
+func Close() error {
+	currentBackend.Lock()
+	b := currentBackend.backend
+	currentBackend.backend = nil
+	currentBackend.Unlock()
+
+	if b == nil {
+		return nil
+	}
+	return b.Close()
 }
 
-// getDefaultSession returns a database session with the default timeout.
-// Don't forget to cancel the returned context
-func getDefaultSession() (*gorm.DB, context.CancelFunc) {
-	return getSessionWithTimeout(defaultQueryTimeout)
+// getBackend returns the configured backend, all the searches must get it
+// from here
+func getBackend() (Backend, error) {
+	currentBackend.RLock()
+	defer currentBackend.RUnlock()
+
+	if currentBackend.backend == nil {
+		return nil, errNotInitialized
+	}
+	return currentBackend.backend, nil
 }
 
-// getSessionWithTimeout returns a database session with the specified timeout.
+// getDefaultContext returns a context with the default query timeout.
 // Don't forget to cancel the returned context
-func getSessionWithTimeout(timeout time.Duration) (*gorm.DB, context.CancelFunc) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-
-	return handle.WithContext(ctx), cancel
+func getDefaultContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), defaultQueryTimeout)
 }
 
 func handleCustomTLSConfig(config string) error {
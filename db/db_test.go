@@ -15,17 +15,30 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
+
+	"gorm.io/gorm"
 )
 
 func TestMain(m *testing.M) {
 	driver := os.Getenv("SFTPGO_PLUGIN_EVENTSEARCH_DRIVER")
 	dsn := os.Getenv("SFTPGO_PLUGIN_EVENTSEARCH_DSN")
+	var tempDir string
 	if driver == "" || dsn == "" {
-		fmt.Println("Driver and/or DSN not set, unable to execute test")
-		os.Exit(1)
+		dir, err := os.MkdirTemp("", "eventsearch")
+		if err != nil {
+			fmt.Printf("unable to create temporary directory: %v\n", err)
+			os.Exit(1)
+		}
+		tempDir = dir
+
+		fmt.Println("Driver and/or DSN not set, using a temporary SQLite database")
+		driver = driverNameSQLite
+		dsn = filepath.Join(dir, "events.db") + "?_pragma=busy_timeout(5000)"
 	}
 	if err := Initialize(driver, dsn, "", 0); err != nil {
 		fmt.Printf("unable to initialize database: %v\n", err)
@@ -42,9 +55,41 @@ func TestMain(m *testing.M) {
 	}
 
 	exitCode := m.Run()
+	if tempDir != "" {
+		Close()
+		os.RemoveAll(tempDir)
+	}
 	os.Exit(exitCode)
 }
 
+// getDefaultSession returns a session for the gorm backend with the default
+// timeout. Don't forget to cancel the returned context
+func getDefaultSession() (*gorm.DB, context.CancelFunc) {
+	ctx, cancel := getDefaultContext()
+
+	return getTestBackend().getSession(ctx), cancel
+}
+
+// getTestBackend returns the configured gorm backend
+func getTestBackend() *gormBackend {
+	b, err := getBackend()
+	if err != nil {
+		panic(err)
+	}
+	return b.(*gormBackend)
+}
+
+// setTestBackend replaces the configured backend without closing it and
+// returns the previous one
+func setTestBackend(b Backend) Backend {
+	currentBackend.Lock()
+	defer currentBackend.Unlock()
+
+	previous := currentBackend.backend
+	currentBackend.backend = b
+	return previous
+}
+
 type fsEventV5 struct {
 	ID                string `gorm:"primaryKey;size:36"`
 	Timestamp         int64  `gorm:"size:64;not null;index:idx_fs_events_timestamp"`
@@ -0,0 +1,203 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// enrichmentTable defines the symbolic names for the numeric fields as
+// defined starting from the given SFTPGo release
+type enrichmentTable struct {
+	version     [3]int
+	logEvents   map[int]string
+	fsStatuses  map[int]string
+	fsProviders map[int]string
+}
+
+var (
+	fsStatusNames = map[int]string{
+		1: "ok",
+		2: "error",
+		3: "quota-exceeded",
+	}
+	fsProviderNames = map[int]string{
+		0: "local",
+		1: "S3",
+		2: "GCS",
+		3: "AzureBlob",
+		4: "local-encrypted",
+		5: "SFTP",
+		6: "HTTP",
+	}
+	logEventNames = map[int]string{
+		1: "login-failed",
+		2: "login-no-user",
+		3: "no-login-tried",
+		4: "not-negotiated",
+	}
+	// enrichmentTables are sorted by version, each table is used up to the
+	// release before the next one
+	enrichmentTables = []enrichmentTable{
+		{
+			version:     [3]int{2, 3, 0},
+			logEvents:   map[int]string{},
+			fsStatuses:  fsStatusNames,
+			fsProviders: fsProviderNames,
+		},
+		{
+			version:     [3]int{2, 4, 0},
+			logEvents:   logEventNames,
+			fsStatuses:  fsStatusNames,
+			fsProviders: fsProviderNames,
+		},
+		{
+			version:     [3]int{2, 6, 0},
+			logEvents:   mergeNames(logEventNames, map[int]string{5: "login-ok"}),
+			fsStatuses:  fsStatusNames,
+			fsProviders: fsProviderNames,
+		},
+	}
+)
+
+// EnrichmentOptions adds human-readable renderings next to the numeric fields
+// of the returned events: symbolic names for log events, fs statuses and fs
+// providers and ISO 8601 timestamps
+type EnrichmentOptions struct {
+	Enabled bool
+	// TimeZone is the IANA time zone used to render the timestamps, for
+	// example Europe/Rome. Default UTC
+	TimeZone string
+	// SFTPGoVersion selects the names matching the given SFTPGo release, for
+	// example 2.5.6. Default the latest release
+	SFTPGoVersion string
+}
+
+// enricher renders the numeric fields
+type enricher struct {
+	location *time.Location
+	table    *enrichmentTable
+}
+
+func (o *EnrichmentOptions) validate() error {
+	_, err := o.getEnricher()
+	return err
+}
+
+// getEnricher returns nil if the enrichment is disabled
+func (o *EnrichmentOptions) getEnricher() (*enricher, error) {
+	if !o.Enabled {
+		return nil, nil
+	}
+	location := time.UTC
+	if o.TimeZone != "" {
+		var err error
+		location, err = time.LoadLocation(o.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone %q: %w", o.TimeZone, err)
+		}
+	}
+	table, err := getEnrichmentTable(o.SFTPGoVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &enricher{
+		location: location,
+		table:    table,
+	}, nil
+}
+
+func (e *enricher) formatTimestamp(timestamp int64) string {
+	return time.Unix(0, timestamp).In(e.location).Format(time.RFC3339Nano)
+}
+
+func (e *enricher) enrichFsEvents(events []FsEvent) {
+	for idx := range events {
+		ev := &events[idx]
+		ev.TimestampISO = e.formatTimestamp(ev.Timestamp)
+		ev.StatusName = e.table.fsStatuses[ev.Status]
+		ev.FsProviderName = e.table.fsProviders[ev.FsProvider]
+	}
+}
+
+func (e *enricher) enrichProviderEvents(events []ProviderEvent) {
+	for idx := range events {
+		events[idx].TimestampISO = e.formatTimestamp(events[idx].Timestamp)
+	}
+}
+
+func (e *enricher) enrichLogEvents(events []LogEvent) {
+	for idx := range events {
+		ev := &events[idx]
+		ev.TimestampISO = e.formatTimestamp(ev.Timestamp)
+		ev.EventName = e.table.logEvents[ev.Event]
+	}
+}
+
+// getEnrichmentTable returns the table for the given SFTPGo release, the
+// latest one if the version is empty
+func getEnrichmentTable(version string) (*enrichmentTable, error) {
+	if version == "" {
+		return &enrichmentTables[len(enrichmentTables)-1], nil
+	}
+	parsed, err := parseSFTPGoVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	for idx := len(enrichmentTables) - 1; idx >= 0; idx-- {
+		if compareVersions(enrichmentTables[idx].version, parsed) <= 0 {
+			return &enrichmentTables[idx], nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported SFTPGo version %q, the minimum supported version is %d.%d.%d", version,
+		enrichmentTables[0].version[0], enrichmentTables[0].version[1], enrichmentTables[0].version[2])
+}
+
+// parseSFTPGoVersion parses versions such as 2.5, v2.6.1 or 2.6.0-dev
+func parseSFTPGoVersion(version string) ([3]int, error) {
+	var result [3]int
+	value, _, _ := strings.Cut(strings.TrimPrefix(version, "v"), "-")
+	parts := strings.Split(value, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return result, fmt.Errorf("invalid SFTPGo version %q", version)
+	}
+	for idx, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return result, fmt.Errorf("invalid SFTPGo version %q", version)
+		}
+		result[idx] = n
+	}
+	return result, nil
+}
+
+func compareVersions(a, b [3]int) int {
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return a[idx] - b[idx]
+		}
+	}
+	return 0
+}
+
+func mergeNames(base, names map[int]string) map[int]string {
+	result := maps.Clone(base)
+	maps.Copy(result, names)
+	return result
+}
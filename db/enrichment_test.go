@@ -0,0 +1,136 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnrichmentTables(t *testing.T) {
+	version, err := parseSFTPGoVersion("v2.6.1-dev")
+	assert.NoError(t, err)
+	assert.Equal(t, [3]int{2, 6, 1}, version)
+	version, err = parseSFTPGoVersion("2.5")
+	assert.NoError(t, err)
+	assert.Equal(t, [3]int{2, 5, 0}, version)
+	for _, v := range []string{"2", "2.x", "2.5.1.1", "2.-1"} {
+		_, err = parseSFTPGoVersion(v)
+		assert.Error(t, err, v)
+	}
+
+	table, err := getEnrichmentTable("")
+	assert.NoError(t, err)
+	assert.Equal(t, "login-ok", table.logEvents[5])
+	table, err = getEnrichmentTable("2.5.6")
+	assert.NoError(t, err)
+	assert.Equal(t, "login-failed", table.logEvents[1])
+	assert.Empty(t, table.logEvents[5])
+	table, err = getEnrichmentTable("2.3.2")
+	assert.NoError(t, err)
+	assert.Empty(t, table.logEvents[1])
+	assert.Equal(t, "HTTP", table.fsProviders[6])
+	_, err = getEnrichmentTable("2.2.0")
+	assert.Error(t, err)
+
+	opts := EnrichmentOptions{Enabled: true, TimeZone: "Mars/Olympus"}
+	assert.Error(t, opts.validate())
+	opts = EnrichmentOptions{TimeZone: "Mars/Olympus"}
+	assert.NoError(t, opts.validate())
+}
+
+func TestSearchEnrichment(t *testing.T) {
+	timestamp := time.Date(2026, 3, 1, 10, 0, 0, 500, time.UTC).UnixNano()
+	fsEvents := []FsEvent{
+		{ID: xid.New().String(), Timestamp: timestamp, Action: "upload", Username: "enrich", Status: 3,
+			FsProvider: 1, Protocol: "SFTP"},
+	}
+	logEvents := []LogEvent{
+		{ID: xid.New().String(), Timestamp: timestamp, Event: 1, Protocol: "SSH", Username: "enrich"},
+		{ID: xid.New().String(), Timestamp: timestamp + 1, Event: 5, Protocol: "SSH", Username: "enrich"},
+	}
+	providerEvents := []ProviderEvent{
+		{ID: xid.New().String(), Timestamp: timestamp, Action: "add", Username: "enrich", ObjectType: "user"},
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&logEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&providerEvents).Error
+	assert.NoError(t, err)
+
+	params := eventsearcher.CommonSearchParams{
+		Username: "enrich",
+		Limit:    10,
+		Order:    1,
+	}
+	s := Searcher{}
+	fsResults, err := s.searchFsEvents(&FsEventFilters{
+		FsEventSearch: eventsearcher.FsEventSearch{CommonSearchParams: params, FsProvider: -1},
+		Enrichment:    EnrichmentOptions{Enabled: true, TimeZone: "Europe/Rome"},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, fsResults, 1) {
+		assert.Equal(t, "2026-03-01T11:00:00.0000005+01:00", fsResults[0].TimestampISO)
+		assert.Equal(t, "quota-exceeded", fsResults[0].StatusName)
+		assert.Equal(t, "S3", fsResults[0].FsProviderName)
+	}
+	logResults, err := s.searchLogEvents(&LogEventFilters{
+		LogEventSearch: eventsearcher.LogEventSearch{CommonSearchParams: params},
+		Enrichment:     EnrichmentOptions{Enabled: true, SFTPGoVersion: "2.5.0"},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, logResults, 2) {
+		assert.Equal(t, "2026-03-01T10:00:00.0000005Z", logResults[0].TimestampISO)
+		assert.Equal(t, "login-failed", logResults[0].EventName)
+		assert.Empty(t, logResults[1].EventName)
+	}
+	providerResults, err := s.searchProviderEvents(&ProviderEventFilters{
+		ProviderEventSearch: eventsearcher.ProviderEventSearch{CommonSearchParams: params},
+		Enrichment:          EnrichmentOptions{Enabled: true},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, providerResults, 1) {
+		assert.Equal(t, "2026-03-01T10:00:00.0000005Z", providerResults[0].TimestampISO)
+	}
+	logResults, err = s.searchLogEvents(&LogEventFilters{
+		LogEventSearch: eventsearcher.LogEventSearch{CommonSearchParams: params},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, logResults, 2) {
+		assert.Empty(t, logResults[0].TimestampISO)
+		assert.Empty(t, logResults[0].EventName)
+	}
+	_, err = s.searchLogEvents(&LogEventFilters{
+		LogEventSearch: eventsearcher.LogEventSearch{CommonSearchParams: params},
+		Enrichment:     EnrichmentOptions{Enabled: true, SFTPGoVersion: "1.0.0"},
+	})
+	assert.Error(t, err)
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&logEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&providerEvents).Error
+	assert.NoError(t, err)
+}
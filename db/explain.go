@@ -0,0 +1,516 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/logger"
+)
+
+// Issues found in the query plans
+const (
+	// ExplainIssueFullScan is a sequential scan of the whole table
+	ExplainIssueFullScan = "full_scan"
+	// ExplainIssueFilesort is a sort of all the matching rows by timestamp
+	// and id before applying the limit
+	ExplainIssueFilesort = "filesort"
+	// ExplainIssueMissingIndex is a missing composite index on a filtered
+	// column followed by timestamp and id
+	ExplainIssueMissingIndex = "missing_index"
+)
+
+// slowSearchExplainInterval defines how often slow searches with the same
+// shape are explained
+const slowSearchExplainInterval = 10 * time.Minute
+
+var (
+	// SlowSearchThreshold enables the explain debug mode: the searches taking
+	// longer, or hitting the query timeout, are explained and the findings are
+	// logged. 0 disables the debug mode
+	SlowSearchThreshold time.Duration
+	explainedSearches   explainedSearchCache
+)
+
+// mysqlPlanColumns are the EXPLAIN columns included in the MySQL plans
+var mysqlPlanColumns = []string{"id", "select_type", "table", "type", "possible_keys", "key", "rows", "filtered",
+	"extra"}
+
+// ExplainFinding describes an issue found in a query plan
+type ExplainFinding struct {
+	Issue  string `json:"issue"`
+	Table  string `json:"table,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// Explanation describes how the database executes a search
+type Explanation struct {
+	Driver string `json:"driver"`
+	Table  string `json:"table"`
+	SQL    string `json:"sql"`
+	Args   []any  `json:"args,omitempty"`
+	// Plan is the query plan as reported by the database, one line for each
+	// step
+	Plan     []string         `json:"plan"`
+	Findings []ExplainFinding `json:"findings,omitempty"`
+	// SuggestedIndexes are the statements to create the missing indexes
+	SuggestedIndexes []string `json:"suggested_indexes,omitempty"`
+}
+
+func (e *Explanation) hasIssue(issue string) bool {
+	return slices.ContainsFunc(e.Findings, func(finding ExplainFinding) bool {
+		return finding.Issue == issue
+	})
+}
+
+func (e *Explanation) addFinding(issue, table, format string, args ...any) {
+	e.Findings = append(e.Findings, ExplainFinding{
+		Issue:  issue,
+		Table:  table,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+// Explainer is implemented by the backends able to explain the searches
+type Explainer interface {
+	// ExplainFsEvents explains the search for the given fs events filters
+	ExplainFsEvents(ctx context.Context, filters *FsEventFilters) (*Explanation, error)
+	// ExplainProviderEvents explains the search for the given provider events
+	// filters
+	ExplainProviderEvents(ctx context.Context, filters *ProviderEventFilters) (*Explanation, error)
+	// ExplainLogEvents explains the search for the given log events filters
+	ExplainLogEvents(ctx context.Context, filters *LogEventFilters) (*Explanation, error)
+}
+
+// ExplainFsEvents returns the query plan for the given fs events search, the
+// searched events are not read
+func (s *Searcher) ExplainFsEvents(filters *FsEventFilters) (*Explanation, error) {
+	if filters.Limit <= 0 {
+		return nil, errNoLimit
+	}
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	explainer, err := getExplainer()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	return explainer.ExplainFsEvents(ctx, filters)
+}
+
+// ExplainProviderEvents returns the query plan for the given provider events
+// search, the searched events are not read
+func (s *Searcher) ExplainProviderEvents(filters *ProviderEventFilters) (*Explanation, error) {
+	if filters.Limit <= 0 {
+		return nil, errNoLimit
+	}
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	explainer, err := getExplainer()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	return explainer.ExplainProviderEvents(ctx, filters)
+}
+
+// ExplainLogEvents returns the query plan for the given log events search,
+// the searched events are not read. Message searches are explained using the
+// time range actually searched
+func (s *Searcher) ExplainLogEvents(filters *LogEventFilters) (*Explanation, error) {
+	if filters.Limit <= 0 {
+		return nil, errNoLimit
+	}
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	explainer, err := getExplainer()
+	if err != nil {
+		return nil, err
+	}
+	filters, _, err = getMessageSearchFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	return explainer.ExplainLogEvents(ctx, filters)
+}
+
+func getExplainer() (Explainer, error) {
+	b, err := getBackend()
+	if err != nil {
+		return nil, err
+	}
+	explainer, ok := b.(Explainer)
+	if !ok {
+		return nil, errNotSupported
+	}
+	return explainer, nil
+}
+
+// explainSlowSearch explains, in the background, a search that took longer
+// than SlowSearchThreshold or hit the query timeout and logs the findings.
+// Each search shape is explained at most once per slowSearchExplainInterval
+func explainSlowSearch[T any, F interface {
+	*T
+	getSearchShape() string
+}](b Backend, filters F, elapsed time.Duration, timedOut bool,
+	explain func(Explainer, context.Context, F) (*Explanation, error),
+) {
+	if SlowSearchThreshold <= 0 || (elapsed < SlowSearchThreshold && !timedOut) {
+		return
+	}
+	explainer, ok := b.(Explainer)
+	if !ok || !explainedSearches.add(filters.getSearchShape(), time.Now()) {
+		return
+	}
+	// the caller can modify the filters after the search, for example to get
+	// the next page
+	explainFilters := F(new(T))
+	*explainFilters = *filters
+
+	go logSlowSearch(elapsed, timedOut, func(ctx context.Context) (*Explanation, error) {
+		return explain(explainer, ctx, explainFilters)
+	})
+}
+
+func logSlowSearch(elapsed time.Duration, timedOut bool, explain func(context.Context) (*Explanation, error)) {
+	// the search context may be expired
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	explanation, err := explain(ctx)
+	if err != nil {
+		logger.AppLogger.Warn("unable to explain slow search", "elapsed", elapsed, "error", err)
+		return
+	}
+	findings := make([]string, 0, len(explanation.Findings))
+	for _, finding := range explanation.Findings {
+		findings = append(findings, finding.Detail)
+	}
+	logger.AppLogger.Warn("slow search", "table", explanation.Table, "elapsed", elapsed, "timed out", timedOut,
+		"sql", explanation.SQL, "plan", strings.Join(explanation.Plan, "\n"),
+		"findings", strings.Join(findings, "; "), "suggested indexes", strings.Join(explanation.SuggestedIndexes, " "))
+}
+
+// explainedSearchCache records when each search shape was last explained
+type explainedSearchCache struct {
+	sync.Mutex
+	shapes map[string]time.Time
+}
+
+// add returns false if the given shape was explained within
+// slowSearchExplainInterval, otherwise it records the shape as explained
+func (c *explainedSearchCache) add(shape string, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if explainedAt, ok := c.shapes[shape]; ok && now.Sub(explainedAt) < slowSearchExplainInterval {
+		return false
+	}
+	if c.shapes == nil {
+		c.shapes = make(map[string]time.Time)
+	}
+	for key, explainedAt := range c.shapes {
+		if now.Sub(explainedAt) >= slowSearchExplainInterval {
+			delete(c.shapes, key)
+		}
+	}
+	c.shapes[shape] = now
+	return true
+}
+
+// getSearchShape returns a key identifying the searches on the given table
+// with the same sort order and equality filters
+func getSearchShape(table string, order int, columns []string) string {
+	return fmt.Sprintf("%s:%d:%s", table, order, strings.Join(columns, ","))
+}
+
+func (b *gormBackend) ExplainFsEvents(ctx context.Context, filters *FsEventFilters) (*Explanation, error) {
+	sess, err := b.getFsEventsQuery(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	return b.explain(ctx, sess, (&FsEvent{}).TableName(), filters.getEqualityColumns())
+}
+
+func (b *gormBackend) ExplainProviderEvents(ctx context.Context, filters *ProviderEventFilters,
+) (*Explanation, error) {
+	sess, err := b.getProviderEventsQuery(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	return b.explain(ctx, sess, (&ProviderEvent{}).TableName(), filters.getEqualityColumns())
+}
+
+func (b *gormBackend) ExplainLogEvents(ctx context.Context, filters *LogEventFilters) (*Explanation, error) {
+	sess, err := b.getLogEventsQuery(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	return b.explain(ctx, sess, (&LogEvent{}).TableName(), filters.getEqualityColumns())
+}
+
+// explain runs the query for the given session through EXPLAIN and analyzes
+// the plan, columns are the columns filtered by equality, from the most to the
+// least selective
+func (b *gormBackend) explain(ctx context.Context, sess *gorm.DB, table string, columns []string,
+) (*Explanation, error) {
+	query, args := getSQL(sess)
+	explanation := &Explanation{
+		Driver: b.driver,
+		Table:  table,
+		SQL:    query,
+		Args:   args,
+	}
+	switch b.driver {
+	case driverNamePostgreSQL:
+		results, err := b.queryExplain(ctx, "EXPLAIN ", query, args)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			explanation.Plan = append(explanation.Plan, toString(result["query plan"]))
+		}
+		results, err = b.queryExplain(ctx, "EXPLAIN (FORMAT JSON) ", query, args)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) > 0 {
+			if err := analyzePostgreSQLPlan(explanation, toString(results[0]["query plan"])); err != nil {
+				return nil, err
+			}
+		}
+	case driverNameMySQL:
+		results, err := b.queryExplain(ctx, "EXPLAIN ", query, args)
+		if err != nil {
+			return nil, err
+		}
+		analyzeMySQLPlan(explanation, results)
+	case driverNameSQLite:
+		results, err := b.queryExplain(ctx, "EXPLAIN QUERY PLAN ", query, args)
+		if err != nil {
+			return nil, err
+		}
+		analyzeSQLitePlan(explanation, results)
+	default:
+		return nil, errNotSupported
+	}
+
+	definition, err := b.GetTableDefinition(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	if definition != nil {
+		suggestIndexes(explanation, definition, columns)
+	}
+	return explanation, nil
+}
+
+func (b *gormBackend) queryExplain(ctx context.Context, prefix, query string, args []any,
+) ([]map[string]any, error) {
+	sqlDB, err := b.db.DB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := sqlDB.QueryContext(ctx, prefix+query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to explain the query: %w", err)
+	}
+	defer rows.Close()
+
+	return scanRowsToMaps(rows)
+}
+
+// postgreSQLPlanNode is a node of a PostgreSQL JSON query plan
+type postgreSQLPlanNode struct {
+	NodeType     string               `json:"Node Type"`
+	RelationName string               `json:"Relation Name"`
+	SortKey      []string             `json:"Sort Key"`
+	Rows         float64              `json:"Plan Rows"`
+	Plans        []postgreSQLPlanNode `json:"Plans"`
+}
+
+func analyzePostgreSQLPlan(e *Explanation, plan string) error {
+	var explain []struct {
+		Plan postgreSQLPlanNode `json:"Plan"`
+	}
+	if err := json.Unmarshal([]byte(plan), &explain); err != nil {
+		return fmt.Errorf("unable to parse query plan: %w", err)
+	}
+	var walk func(node *postgreSQLPlanNode)
+	walk = func(node *postgreSQLPlanNode) {
+		switch node.NodeType {
+		case "Seq Scan":
+			e.addFinding(ExplainIssueFullScan, node.RelationName, "sequential scan on %s, estimated rows: %d",
+				node.RelationName, int64(node.Rows))
+		case "Sort":
+			// an incremental sort only sorts the events with the same
+			// timestamp, so it is not reported
+			if slices.ContainsFunc(node.SortKey, isTimestampSortKey) {
+				e.addFinding(ExplainIssueFilesort, e.Table, "the matching rows are sorted by %s before applying "+
+					"the limit, estimated rows: %d", strings.Join(node.SortKey, ", "), int64(node.Rows))
+			}
+		}
+		for idx := range node.Plans {
+			walk(&node.Plans[idx])
+		}
+	}
+	for idx := range explain {
+		walk(&explain[idx].Plan)
+	}
+	return nil
+}
+
+func isTimestampSortKey(key string) bool {
+	return strings.Contains(strings.ToLower(key), "timestamp")
+}
+
+func analyzeMySQLPlan(e *Explanation, results []map[string]any) {
+	for _, result := range results {
+		var sb strings.Builder
+		for _, column := range mysqlPlanColumns {
+			if value, ok := result[column]; ok && value != nil {
+				if sb.Len() > 0 {
+					sb.WriteString(" ")
+				}
+				fmt.Fprintf(&sb, "%s=%s", column, toString(value))
+			}
+		}
+		e.Plan = append(e.Plan, sb.String())
+
+		table := toString(result["table"])
+		if strings.EqualFold(toString(result["type"]), "ALL") {
+			e.addFinding(ExplainIssueFullScan, table, "full table scan on %s, estimated rows: %s", table,
+				toString(result["rows"]))
+		}
+		if strings.Contains(strings.ToLower(toString(result["extra"])), "using filesort") {
+			e.addFinding(ExplainIssueFilesort, table, "the matching rows are sorted using a filesort on %s "+
+				"before applying the limit, estimated rows: %s", table, toString(result["rows"]))
+		}
+	}
+}
+
+func analyzeSQLitePlan(e *Explanation, results []map[string]any) {
+	depths := make(map[int64]int, len(results))
+	for _, result := range results {
+		depth := 0
+		if parent, ok := depths[toInt64(result["parent"])]; ok {
+			depth = parent + 1
+		}
+		depths[toInt64(result["id"])] = depth
+		detail := toString(result["detail"])
+		e.Plan = append(e.Plan, strings.Repeat("  ", depth)+detail)
+
+		fields := strings.Fields(detail)
+		switch {
+		case len(fields) > 1 && fields[0] == "SCAN" && !strings.Contains(detail, " USING "):
+			// older SQLite versions report "SCAN TABLE <name>"
+			table := fields[1]
+			if table == "TABLE" && len(fields) > 2 {
+				table = fields[2]
+			}
+			e.addFinding(ExplainIssueFullScan, table, "full table scan on %s", table)
+		case strings.HasPrefix(detail, "USE TEMP B-TREE FOR ") && strings.Contains(detail, "ORDER BY"):
+			e.addFinding(ExplainIssueFilesort, e.Table, "the matching rows are sorted using a temporary b-tree "+
+				"before applying the limit")
+		}
+	}
+}
+
+// suggestIndexes suggests an index only if the plan scans or sorts the
+// table. It reports a missing composite index on the most selective column
+// filtered by equality followed by timestamp and id, so the matching events
+// are read already sorted and the search stops at the limit. Without equality
+// filters an index on timestamp and id is suggested if no index can avoid the
+// scan or the sort
+func suggestIndexes(e *Explanation, definition *TableDefinition, columns []string) {
+	if !e.hasIssue(ExplainIssueFullScan) && !e.hasIssue(ExplainIssueFilesort) {
+		return
+	}
+	var index []string
+	if len(columns) > 0 {
+		if hasIndexPrefix(definition, columns[0], "timestamp") {
+			return
+		}
+		index = []string{columns[0], "timestamp", "id"}
+		e.addFinding(ExplainIssueMissingIndex, e.Table, "no index on %s, the events matching %s are read and "+
+			"sorted by timestamp before applying the limit", strings.Join(index, ", "), columns[0])
+	} else {
+		// a sort on timestamp, id is needed if id is not included in the
+		// timestamp index, for example on SQLite
+		index = []string{"timestamp"}
+		if e.hasIssue(ExplainIssueFilesort) {
+			index = []string{"timestamp", "id"}
+		}
+		if hasIndexPrefix(definition, index...) {
+			return
+		}
+		index = []string{"timestamp", "id"}
+		e.addFinding(ExplainIssueMissingIndex, e.Table, "no index on timestamp, id, the events are sorted by "+
+			"timestamp before applying the limit")
+	}
+	e.SuggestedIndexes = append(e.SuggestedIndexes, getCreateIndexStatement(e.Driver, e.Table, index))
+}
+
+// hasIndexPrefix returns true if an index starts with the given columns
+func hasIndexPrefix(definition *TableDefinition, columns ...string) bool {
+	return slices.ContainsFunc(definition.Indexes, func(index []string) bool {
+		if len(index) < len(columns) {
+			return false
+		}
+		for idx, column := range columns {
+			if !strings.EqualFold(index[idx], column) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// getCreateIndexStatement returns the DDL to create an index on the given
+// columns, named like the eventstore indexes
+func getCreateIndexStatement(driver, table string, columns []string) string {
+	name := "idx_" + strings.TrimPrefix(table, "eventstore_") + "_" + strings.Join(columns, "_")
+	definition := fmt.Sprintf("%s ON %s (%s);", name, table, strings.Join(columns, ", "))
+	switch driver {
+	case driverNamePostgreSQL:
+		// CONCURRENTLY does not block the writes while the index is built
+		return "CREATE INDEX CONCURRENTLY IF NOT EXISTS " + definition
+	case driverNameSQLite:
+		return "CREATE INDEX IF NOT EXISTS " + definition
+	default:
+		return "CREATE INDEX " + definition
+	}
+}
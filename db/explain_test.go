@@ -0,0 +1,242 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplain(t *testing.T) {
+	s := Searcher{}
+	fsFilters := &FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{Username: "explain_user"},
+		FsProvider:         -1,
+	}}
+	_, err := s.ExplainFsEvents(fsFilters)
+	assert.ErrorIs(t, err, errNoLimit)
+
+	fsFilters.Limit = 10
+	explanation, err := s.ExplainFsEvents(fsFilters)
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := getTestBackend()
+	table := (&FsEvent{}).TableName()
+	assert.Equal(t, b.driver, explanation.Driver)
+	assert.Equal(t, table, explanation.Table)
+	assert.Contains(t, explanation.SQL, "ORDER BY timestamp DESC, id DESC")
+	assert.Contains(t, explanation.Args, "explain_user")
+	assert.NotEmpty(t, explanation.Plan)
+	assert.True(t, explanation.hasIssue(ExplainIssueMissingIndex))
+	suggestion := getCreateIndexStatement(b.driver, table, []string{"username", "timestamp", "id"})
+	assert.Equal(t, []string{suggestion}, explanation.SuggestedIndexes)
+
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	err = b.getSession(ctx).Exec(suggestion).Error
+	if !assert.NoError(t, err) {
+		return
+	}
+	explanation, err = s.ExplainFsEvents(fsFilters)
+	assert.NoError(t, err)
+	assert.False(t, explanation.hasIssue(ExplainIssueMissingIndex))
+	assert.Empty(t, explanation.SuggestedIndexes)
+	if b.driver == driverNameSQLite {
+		assert.Empty(t, explanation.Findings)
+	}
+	err = b.getSession(ctx).Migrator().DropIndex(table, "idx_fs_events_username_timestamp_id")
+	assert.NoError(t, err)
+
+	explanation, err = s.ExplainProviderEvents(&ProviderEventFilters{
+		ProviderEventSearch: eventsearcher.ProviderEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{Limit: 10, Order: 1},
+			OmitObjectData:     true,
+		},
+	})
+	if assert.NoError(t, err) {
+		assert.Contains(t, explanation.SQL, "ORDER BY timestamp ASC, id ASC")
+		assert.NotContains(t, explanation.SQL, "object_data")
+		if b.driver == driverNameSQLite {
+			// the timestamp index does not include id
+			assert.True(t, explanation.hasIssue(ExplainIssueFilesort))
+			assert.Equal(t, []string{"CREATE INDEX IF NOT EXISTS idx_provider_events_timestamp_id ON " +
+				"eventstore_provider_events (timestamp, id);"}, explanation.SuggestedIndexes)
+		}
+	}
+	explanation, err = s.ExplainLogEvents(&LogEventFilters{LogEventSearch: eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{Limit: 10},
+		Events:             []int32{1},
+	}})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{
+			getCreateIndexStatement(b.driver, (&LogEvent{}).TableName(), []string{"event", "timestamp", "id"}),
+		}, explanation.SuggestedIndexes)
+	}
+	_, err = s.ExplainLogEvents(&LogEventFilters{LogEventSearch: eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{Limit: 10},
+	}, Query: "invalid:"})
+	assert.Error(t, err)
+}
+
+func TestExplainSlowSearches(t *testing.T) {
+	SlowSearchThreshold = time.Nanosecond
+	explainedSearches = explainedSearchCache{}
+	defer func() {
+		SlowSearchThreshold = 0
+		explainedSearches = explainedSearchCache{}
+	}()
+
+	s := Searcher{}
+	fsFilters := &FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{Limit: 1, IP: "127.0.0.1"},
+		FsProvider:         -1,
+	}}
+	_, err := s.searchFsEvents(fsFilters)
+	assert.NoError(t, err)
+	_, err = s.searchProviderEvents(&ProviderEventFilters{ProviderEventSearch: eventsearcher.ProviderEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{Limit: 1},
+	}})
+	assert.NoError(t, err)
+	_, err = s.searchLogEvents(&LogEventFilters{LogEventSearch: eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{Limit: 1},
+	}})
+	assert.NoError(t, err)
+
+	explainedSearches.Lock()
+	assert.Len(t, explainedSearches.shapes, 3)
+	explainedAt, ok := explainedSearches.shapes[fsFilters.getSearchShape()]
+	explainedSearches.Unlock()
+	assert.True(t, ok)
+	assert.Equal(t, "eventstore_fs_events:0:ip", fsFilters.getSearchShape())
+	// the same shape is not explained again, even with other values
+	fsFilters.IP = "127.0.0.2"
+	_, err = s.searchFsEvents(fsFilters)
+	assert.NoError(t, err)
+	explainedSearches.Lock()
+	assert.Equal(t, explainedAt, explainedSearches.shapes[fsFilters.getSearchShape()])
+	explainedSearches.Unlock()
+
+	now := time.Now()
+	cache := explainedSearchCache{}
+	assert.True(t, cache.add("shape1", now))
+	assert.False(t, cache.add("shape1", now.Add(slowSearchExplainInterval-time.Second)))
+	assert.True(t, cache.add("shape2", now.Add(time.Second)))
+	// the expired shapes are removed
+	assert.True(t, cache.add("shape1", now.Add(slowSearchExplainInterval)))
+	assert.Len(t, cache.shapes, 2)
+	assert.True(t, cache.add("shape3", now.Add(2*slowSearchExplainInterval)))
+	assert.Len(t, cache.shapes, 1)
+
+	var explained bool
+	logSlowSearch(time.Second, true, func(ctx context.Context) (*Explanation, error) {
+		explained = true
+		return s.ExplainFsEvents(fsFilters)
+	})
+	assert.True(t, explained)
+}
+
+func TestAnalyzePlans(t *testing.T) {
+	table := (&FsEvent{}).TableName()
+	explanation := &Explanation{Driver: driverNamePostgreSQL, Table: table}
+	err := analyzePostgreSQLPlan(explanation, `[{"Plan": {"Node Type": "Limit", "Plan Rows": 10, "Plans": [
+		{"Node Type": "Sort", "Sort Key": ["eventstore_fs_events.\"timestamp\" DESC", "eventstore_fs_events.id DESC"],
+		"Plan Rows": 5000, "Plans": [{"Node Type": "Seq Scan", "Relation Name": "eventstore_fs_events",
+		"Plan Rows": 5000}]}]}}]`)
+	assert.NoError(t, err)
+	if assert.Len(t, explanation.Findings, 2) {
+		assert.Equal(t, ExplainIssueFilesort, explanation.Findings[0].Issue)
+		assert.Equal(t, ExplainIssueFullScan, explanation.Findings[1].Issue)
+		assert.Equal(t, table, explanation.Findings[1].Table)
+		assert.Contains(t, explanation.Findings[1].Detail, "5000")
+	}
+	explanation = &Explanation{Driver: driverNamePostgreSQL, Table: table}
+	err = analyzePostgreSQLPlan(explanation, `[{"Plan": {"Node Type": "Index Scan Backward",
+		"Relation Name": "eventstore_fs_events", "Index Name": "idx_fs_events_timestamp"}}]`)
+	assert.NoError(t, err)
+	assert.Empty(t, explanation.Findings)
+	assert.Error(t, analyzePostgreSQLPlan(explanation, "invalid"))
+
+	explanation = &Explanation{Driver: driverNameMySQL, Table: table}
+	analyzeMySQLPlan(explanation, []map[string]any{{"id": int64(1), "select_type": []byte("SIMPLE"),
+		"table": []byte(table), "type": []byte("ALL"), "key": nil, "rows": []byte("5000"),
+		"extra": []byte("Using where; Using filesort")}})
+	assert.Equal(t, []string{"id=1 select_type=SIMPLE table=eventstore_fs_events type=ALL rows=5000 " +
+		"extra=Using where; Using filesort"}, explanation.Plan)
+	if assert.Len(t, explanation.Findings, 2) {
+		assert.Equal(t, ExplainIssueFullScan, explanation.Findings[0].Issue)
+		assert.Equal(t, ExplainIssueFilesort, explanation.Findings[1].Issue)
+	}
+
+	explanation = &Explanation{Driver: driverNameSQLite, Table: table}
+	analyzeSQLitePlan(explanation, []map[string]any{
+		{"id": int64(2), "parent": int64(0), "detail": "SCAN eventstore_fs_events"},
+		{"id": int64(3), "parent": int64(2), "detail": "USE TEMP B-TREE FOR ORDER BY"},
+	})
+	assert.Equal(t, []string{"SCAN eventstore_fs_events", "  USE TEMP B-TREE FOR ORDER BY"}, explanation.Plan)
+	if assert.Len(t, explanation.Findings, 2) {
+		assert.Equal(t, ExplainIssueFullScan, explanation.Findings[0].Issue)
+		assert.Equal(t, table, explanation.Findings[0].Table)
+		assert.Equal(t, ExplainIssueFilesort, explanation.Findings[1].Issue)
+	}
+	explanation = &Explanation{Driver: driverNameSQLite, Table: table}
+	analyzeSQLitePlan(explanation, []map[string]any{
+		{"id": int64(2), "parent": int64(0), "detail": "SCAN eventstore_fs_events USING INDEX idx_fs_events_timestamp"},
+	})
+	assert.Empty(t, explanation.Findings)
+}
+
+func TestSuggestIndexes(t *testing.T) {
+	table := (&FsEvent{}).TableName()
+	definition := &TableDefinition{
+		Columns: slices.Concat(eventstoreSchemas[0].versions...),
+		Indexes: [][]string{{"username"}, {"IP", "Timestamp", "id"}},
+	}
+	// a plan without scans or sorts uses a suitable index
+	explanation := &Explanation{Driver: driverNamePostgreSQL, Table: table}
+	suggestIndexes(explanation, definition, []string{"username", "ip"})
+	assert.Empty(t, explanation.Findings)
+	assert.Empty(t, explanation.SuggestedIndexes)
+	explanation.addFinding(ExplainIssueFullScan, table, "scan")
+	suggestIndexes(explanation, definition, []string{"ip", "username"})
+	assert.False(t, explanation.hasIssue(ExplainIssueMissingIndex))
+	suggestIndexes(explanation, definition, []string{"username", "ip"})
+	assert.True(t, explanation.hasIssue(ExplainIssueMissingIndex))
+	assert.Equal(t, []string{"CREATE INDEX CONCURRENTLY IF NOT EXISTS idx_fs_events_username_timestamp_id ON " +
+		"eventstore_fs_events (username, timestamp, id);"}, explanation.SuggestedIndexes)
+	// without equality filters an index is suggested only if the plan has issues
+	explanation = &Explanation{Driver: driverNameMySQL, Table: table}
+	suggestIndexes(explanation, definition, nil)
+	assert.Empty(t, explanation.Findings)
+	explanation.addFinding(ExplainIssueFilesort, table, "sort")
+	suggestIndexes(explanation, definition, nil)
+	assert.Equal(t, []string{"CREATE INDEX idx_fs_events_timestamp_id ON eventstore_fs_events (timestamp, id);"},
+		explanation.SuggestedIndexes)
+	definition.Indexes = append(definition.Indexes, []string{"timestamp"})
+	explanation = &Explanation{Driver: driverNameSQLite, Table: table}
+	explanation.addFinding(ExplainIssueFullScan, table, "scan")
+	suggestIndexes(explanation, definition, nil)
+	assert.Empty(t, explanation.SuggestedIndexes)
+	explanation.addFinding(ExplainIssueFilesort, table, "sort")
+	suggestIndexes(explanation, definition, nil)
+	assert.Equal(t, []string{"CREATE INDEX IF NOT EXISTS idx_fs_events_timestamp_id ON eventstore_fs_events " +
+		"(timestamp, id);"}, explanation.SuggestedIndexes)
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type fieldType int
+
+const (
+	fieldTypeString fieldType = iota
+	fieldTypeInt
+)
+
+// groupableFields defines, for each event type, the fields that can be used
+// to group events. The field names match the column names so they are safe
+// to use as SQL identifiers
+var (
+	fsEventGroupableFields = map[string]fieldType{
+		"action":      fieldTypeString,
+		"username":    fieldTypeString,
+		"protocol":    fieldTypeString,
+		"status":      fieldTypeInt,
+		"ip":          fieldTypeString,
+		"ssh_cmd":     fieldTypeString,
+		"fs_provider": fieldTypeInt,
+		"bucket":      fieldTypeString,
+		"endpoint":    fieldTypeString,
+		"role":        fieldTypeString,
+		"instance_id": fieldTypeString,
+	}
+	providerEventGroupableFields = map[string]fieldType{
+		"action":      fieldTypeString,
+		"username":    fieldTypeString,
+		"ip":          fieldTypeString,
+		"object_type": fieldTypeString,
+		"object_name": fieldTypeString,
+		"role":        fieldTypeString,
+		"instance_id": fieldTypeString,
+	}
+	logEventGroupableFields = map[string]fieldType{
+		"event":       fieldTypeInt,
+		"protocol":    fieldTypeString,
+		"username":    fieldTypeString,
+		"ip":          fieldTypeString,
+		"role":        fieldTypeString,
+		"instance_id": fieldTypeString,
+	}
+)
+
+// validateFields returns an error if any of the given fields is not allowed
+// or if a field is repeated
+func validateFields(fields []string, allowed map[string]fieldType) error {
+	seen := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if _, ok := allowed[field]; !ok {
+			return fmt.Errorf("unsupported field %q, allowed fields: %s", field, getFieldNames(allowed))
+		}
+		if seen[field] {
+			return fmt.Errorf("field %q is repeated", field)
+		}
+		seen[field] = true
+	}
+	return nil
+}
+
+func getFieldNames(fields map[string]fieldType) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// convertFieldValue converts a value read from the database to the Go type
+// matching the field type, drivers return different types for the same column.
+// NULL is returned as nil, so it is not merged with empty strings or zero
+func convertFieldValue(value any, fieldType fieldType) any {
+	if value == nil {
+		return nil
+	}
+	if fieldType == fieldTypeInt {
+		return toInt64(value)
+	}
+	return toString(value)
+}
@@ -0,0 +1,353 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+)
+
+// NetworkFilters defines filters on the IP address of the events. Events
+// without a valid IP address never match Networks and are never excluded by
+// ExcludeNetworks
+type NetworkFilters struct {
+	// Networks restricts the results to the events whose IP address is within
+	// at least one of the given networks. A network can be a CIDR, for example
+	// 10.20.0.0/16 or 2001:db8::/32, a range, for example 10.0.0.1-10.0.0.20,
+	// or a single IP address
+	Networks []string
+	// ExcludeNetworks excludes the events whose IP address is within any of
+	// the given networks
+	ExcludeNetworks []string
+}
+
+func (f *NetworkFilters) validate() error {
+	if _, err := parseNetworks(f.Networks); err != nil {
+		return err
+	}
+	_, err := parseNetworks(f.ExcludeNetworks)
+	return err
+}
+
+// Int64Range defines an inclusive range of values, nil limits are ignored
+type Int64Range struct {
+	Min *int64
+	Max *int64
+}
+
+func (r *Int64Range) validate(name string) error {
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return fmt.Errorf("invalid %s range: the minimum %d is greater than the maximum %d", name, *r.Min, *r.Max)
+	}
+	return nil
+}
+
+// MultiValueFilters extends the single value filters defined in the SDK for
+// the fields common to all the event types. The values are merged with the
+// single value ones, an event matches if its field is equal to any of them
+type MultiValueFilters struct {
+	Usernames []string
+	IPs       []string
+	Roles     []string
+}
+
+// ExclusionFilters defines the values to exclude for the fields common to all
+// the event types. An event is returned if it matches all the include filters
+// and none of the exclusion lists, events with a NULL value in an excluded
+// field are returned
+type ExclusionFilters struct {
+	ExcludeUsernames   []string
+	ExcludeIPs         []string
+	ExcludeRoles       []string
+	ExcludeInstanceIDs []string
+}
+
+// FsEventFilters defines the filters for a filesystem events search. It
+// extends the filters defined in the SDK, and used by SFTPGo, with the ones
+// only available using this package
+type FsEventFilters struct {
+	eventsearcher.FsEventSearch
+	MultiValueFilters
+	Buckets   []string
+	Endpoints []string
+	// FileSizeRange filters on the file size in bytes
+	FileSizeRange Int64Range
+	// ElapsedRange filters on the elapsed time in milliseconds
+	ElapsedRange Int64Range
+	// StatusRange filters on the status, for example a minimum of 2 matches
+	// both errors and quota exceeded errors
+	StatusRange Int64Range
+	// OpenFlags is a bitmask filter on the open flags
+	OpenFlags OpenFlagsFilter
+	NetworkFilters
+	ExclusionFilters
+	ExcludeActions   []string
+	ExcludeProtocols []string
+	ExcludeStatuses  []int32
+	// Query is an optional textual query, for example "username:alice AND
+	// size>10MB", combined with the other filters using AND
+	Query string
+	// SessionID restricts the results to the events of the given connection
+	SessionID string
+	// Paths defines path filters, all of them must match
+	Paths []PathFilter
+	// DecodeOpenFlags adds the symbolic names of the open flags to the results
+	DecodeOpenFlags bool
+	Enrichment      EnrichmentOptions
+}
+
+func (f *FsEventFilters) validate() error {
+	if err := validateQuery(f.Query, fsEventQueryFields); err != nil {
+		return err
+	}
+	if err := f.NetworkFilters.validate(); err != nil {
+		return err
+	}
+	if err := f.FileSizeRange.validate("file size"); err != nil {
+		return err
+	}
+	if err := f.ElapsedRange.validate("elapsed"); err != nil {
+		return err
+	}
+	if err := f.StatusRange.validate("status"); err != nil {
+		return err
+	}
+	if err := f.OpenFlags.validate(); err != nil {
+		return err
+	}
+	for idx := range f.Paths {
+		if err := f.Paths[idx].validate(); err != nil {
+			return err
+		}
+	}
+	if err := f.Enrichment.validate(); err != nil {
+		return err
+	}
+	return checkColumns((&FsEvent{}).TableName(), f.getColumns()...)
+}
+
+// getColumns returns the columns used by the filters, the ones available in
+// all the schema versions may be omitted
+func (f *FsEventFilters) getColumns() []string {
+	columns := getCommonColumns(&f.CommonSearchParams, &f.MultiValueFilters, &f.ExclusionFilters)
+	if f.FsProvider >= 0 {
+		columns = append(columns, "fs_provider")
+	}
+	if f.Bucket != "" || len(f.Buckets) > 0 {
+		columns = append(columns, "bucket")
+	}
+	if f.Endpoint != "" || len(f.Endpoints) > 0 {
+		columns = append(columns, "endpoint")
+	}
+	if f.ElapsedRange.Min != nil || f.ElapsedRange.Max != nil {
+		columns = append(columns, "elapsed")
+	}
+	if f.OpenFlags.Set != 0 || f.OpenFlags.NotSet != 0 {
+		columns = append(columns, "open_flags")
+	}
+	return append(columns, getQueryColumns(f.Query, fsEventQueryFields)...)
+}
+
+// getEqualityColumns returns the columns filtered by equality, from the most
+// to the least selective
+func (f *FsEventFilters) getEqualityColumns() []string {
+	return getUsedColumns(
+		usedColumn{"session_id", f.SessionID != ""},
+		usedColumn{"username", f.Username != "" || len(f.Usernames) > 0},
+		usedColumn{"ip", f.IP != "" || len(f.IPs) > 0},
+		usedColumn{"bucket", f.Bucket != "" || len(f.Buckets) > 0},
+		usedColumn{"endpoint", f.Endpoint != "" || len(f.Endpoints) > 0},
+		usedColumn{"instance_id", len(f.InstanceIDs) > 0},
+		usedColumn{"role", f.Role != "" || len(f.Roles) > 0},
+		usedColumn{"ssh_cmd", f.SSHCmd != ""},
+		usedColumn{"status", len(f.Statuses) > 0},
+		usedColumn{"action", len(f.Actions) > 0},
+		usedColumn{"protocol", len(f.Protocols) > 0},
+		usedColumn{"fs_provider", f.FsProvider >= 0},
+	)
+}
+
+// getSearchShape identifies the searches with the same sort order and
+// equality filters, they have similar query plans
+func (f *FsEventFilters) getSearchShape() string {
+	return getSearchShape((&FsEvent{}).TableName(), f.Order, f.getEqualityColumns())
+}
+
+// ProviderEventFilters defines the filters for a provider events search
+type ProviderEventFilters struct {
+	eventsearcher.ProviderEventSearch
+	MultiValueFilters
+	ObjectNames []string
+	NetworkFilters
+	ExclusionFilters
+	ExcludeActions     []string
+	ExcludeObjectTypes []string
+	// Query is an optional textual query, for example "object_type:user AND
+	// NOT action:delete"
+	Query string
+	// ObjectData defines predicates on the JSON object data, all of them must
+	// match, see ParseJSONFilter
+	ObjectData []JSONFilter
+	Enrichment EnrichmentOptions
+}
+
+func (f *ProviderEventFilters) validate() error {
+	if err := validateQuery(f.Query, providerEventQueryFields); err != nil {
+		return err
+	}
+	for idx := range f.ObjectData {
+		if err := f.ObjectData[idx].validate(); err != nil {
+			return err
+		}
+	}
+	if err := f.Enrichment.validate(); err != nil {
+		return err
+	}
+	if err := f.NetworkFilters.validate(); err != nil {
+		return err
+	}
+	return checkColumns((&ProviderEvent{}).TableName(), f.getColumns()...)
+}
+
+// getColumns returns the columns used by the filters, the ones available in
+// all the schema versions may be omitted
+func (f *ProviderEventFilters) getColumns() []string {
+	columns := getCommonColumns(&f.CommonSearchParams, &f.MultiValueFilters, &f.ExclusionFilters)
+	if len(f.ObjectData) > 0 {
+		columns = append(columns, "object_data")
+	}
+	return append(columns, getQueryColumns(f.Query, providerEventQueryFields)...)
+}
+
+// getEqualityColumns returns the columns filtered by equality, from the most
+// to the least selective
+func (f *ProviderEventFilters) getEqualityColumns() []string {
+	return getUsedColumns(
+		usedColumn{"object_name", f.ObjectName != "" || len(f.ObjectNames) > 0},
+		usedColumn{"username", f.Username != "" || len(f.Usernames) > 0},
+		usedColumn{"ip", f.IP != "" || len(f.IPs) > 0},
+		usedColumn{"instance_id", len(f.InstanceIDs) > 0},
+		usedColumn{"role", f.Role != "" || len(f.Roles) > 0},
+		usedColumn{"object_type", len(f.ObjectTypes) > 0},
+		usedColumn{"action", len(f.Actions) > 0},
+	)
+}
+
+// getSearchShape identifies the searches with the same sort order and
+// equality filters, they have similar query plans
+func (f *ProviderEventFilters) getSearchShape() string {
+	return getSearchShape((&ProviderEvent{}).TableName(), f.Order, f.getEqualityColumns())
+}
+
+// LogEventFilters defines the filters for a log events search
+type LogEventFilters struct {
+	eventsearcher.LogEventSearch
+	MultiValueFilters
+	NetworkFilters
+	ExclusionFilters
+	ExcludeEvents    []int32
+	ExcludeProtocols []string
+	// Message is a full-text search on the message: words, quoted phrases
+	// and prefixes ending with "*", for example: "permission denied" key*.
+	// All the terms must match
+	Message string
+	// Query is an optional textual query, for example "event:1 AND
+	// protocol:(SSH OR FTP)"
+	Query      string
+	Enrichment EnrichmentOptions
+}
+
+func (f *LogEventFilters) validate() error {
+	if err := validateQuery(f.Query, logEventQueryFields); err != nil {
+		return err
+	}
+	if f.Message != "" {
+		if _, err := parseMessageQuery(f.Message); err != nil {
+			return err
+		}
+	}
+	if err := f.Enrichment.validate(); err != nil {
+		return err
+	}
+	if err := f.NetworkFilters.validate(); err != nil {
+		return err
+	}
+	return checkColumns((&LogEvent{}).TableName(), f.getColumns()...)
+}
+
+// getColumns returns the columns used by the filters, the ones available in
+// all the schema versions may be omitted
+func (f *LogEventFilters) getColumns() []string {
+	columns := getCommonColumns(&f.CommonSearchParams, &f.MultiValueFilters, &f.ExclusionFilters)
+	return append(columns, getQueryColumns(f.Query, logEventQueryFields)...)
+}
+
+// getEqualityColumns returns the columns filtered by equality, from the most
+// to the least selective
+func (f *LogEventFilters) getEqualityColumns() []string {
+	return getUsedColumns(
+		usedColumn{"username", f.Username != "" || len(f.Usernames) > 0},
+		usedColumn{"ip", f.IP != "" || len(f.IPs) > 0},
+		usedColumn{"instance_id", len(f.InstanceIDs) > 0},
+		usedColumn{"role", f.Role != "" || len(f.Roles) > 0},
+		usedColumn{"event", len(f.Events) > 0},
+		usedColumn{"protocol", len(f.Protocols) > 0},
+	)
+}
+
+// getSearchShape identifies the searches with the same sort order and
+// equality filters, they have similar query plans
+func (f *LogEventFilters) getSearchShape() string {
+	return getSearchShape((&LogEvent{}).TableName(), f.Order, f.getEqualityColumns())
+}
+
+// getCommonColumns returns the columns used by the filters shared by all the
+// event types, the ones available in all the schema versions are omitted
+func getCommonColumns(params *eventsearcher.CommonSearchParams, multiValue *MultiValueFilters,
+	exclusion *ExclusionFilters,
+) []string {
+	var columns []string
+	if params.Role != "" || len(multiValue.Roles) > 0 || len(exclusion.ExcludeRoles) > 0 {
+		columns = append(columns, "role")
+	}
+	if len(params.InstanceIDs) > 0 || len(exclusion.ExcludeInstanceIDs) > 0 {
+		columns = append(columns, "instance_id")
+	}
+	return columns
+}
+
+type usedColumn struct {
+	name string
+	used bool
+}
+
+func getUsedColumns(columns ...usedColumn) []string {
+	var result []string
+	for _, column := range columns {
+		if column.used {
+			result = append(result, column.name)
+		}
+	}
+	return result
+}
+
+func validateQuery(query string, fields map[string]queryField) error {
+	if query == "" {
+		return nil
+	}
+	_, err := parseQuery(query, fields)
+	return err
+}
@@ -0,0 +1,325 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestExclusionFilters(t *testing.T) {
+	newFsEvent := func(username, action, protocol, role string, status int) FsEvent {
+		return FsEvent{
+			ID:        xid.New().String(),
+			Timestamp: 800,
+			Action:    action,
+			Username:  username,
+			Protocol:  protocol,
+			Status:    status,
+			Role:      role,
+		}
+	}
+	fsEvents := []FsEvent{
+		newFsEvent("alice", "upload", "SFTP", "role1", 1),
+		newFsEvent("svc-backup", "upload", "SFTP", "role1", 1),
+		newFsEvent("bob", "upload", "HTTP", "role2", 2),
+		newFsEvent("bob", "download", "FTP", "", 3),
+	}
+	providerEvents := []ProviderEvent{
+		{ID: xid.New().String(), Timestamp: 800, Action: "add", Username: "admin", ObjectType: "user"},
+		{ID: xid.New().String(), Timestamp: 800, Action: "update", Username: "admin", ObjectType: "folder"},
+		{ID: xid.New().String(), Timestamp: 800, Action: "delete", Username: "system", ObjectType: "user"},
+	}
+	logEvents := []LogEvent{
+		{ID: xid.New().String(), Timestamp: 800, Event: 1, Protocol: "SSH", Username: "alice", InstanceID: "i1"},
+		{ID: xid.New().String(), Timestamp: 800, Event: 2, Protocol: "FTP", Username: "bob", InstanceID: "i2"},
+		{ID: xid.New().String(), Timestamp: 800, Event: 5, Protocol: "SSH", Username: "bob", InstanceID: "i1"},
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&providerEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&logEvents).Error
+	assert.NoError(t, err)
+	// events stored before the role was added have a NULL role
+	err = sess.Model(&FsEvent{}).Where("id = ?", fsEvents[3].ID).Update("role", gorm.Expr("NULL")).Error
+	assert.NoError(t, err)
+
+	params := eventsearcher.CommonSearchParams{
+		StartTimestamp: 800,
+		EndTimestamp:   800,
+		Limit:          100,
+	}
+	s := Searcher{}
+	searchFs := func(filters FsEventFilters) []string {
+		filters.CommonSearchParams = params
+		filters.FsProvider = -1
+		page, err := s.SearchFsEventsPage(&filters, CountOptions{Mode: CountNone})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		var results []string
+		for _, ev := range page.Events {
+			results = append(results, ev.ID)
+		}
+		return results
+	}
+
+	assert.ElementsMatch(t, []string{fsEvents[0].ID}, searchFs(FsEventFilters{
+		FsEventSearch:    eventsearcher.FsEventSearch{Actions: []string{"upload"}},
+		ExclusionFilters: ExclusionFilters{ExcludeUsernames: []string{"svc-backup"}},
+		ExcludeProtocols: []string{"HTTP"},
+	}))
+	assert.ElementsMatch(t, []string{fsEvents[2].ID, fsEvents[3].ID}, searchFs(FsEventFilters{
+		ExclusionFilters: ExclusionFilters{ExcludeRoles: []string{"role1"}},
+	}))
+	assert.ElementsMatch(t, []string{fsEvents[3].ID}, searchFs(FsEventFilters{
+		ExcludeActions:  []string{"upload"},
+		ExcludeStatuses: []int32{1, 2},
+	}))
+	// an exclusion wins over an include filter for the same value
+	assert.Len(t, searchFs(FsEventFilters{
+		FsEventSearch:  eventsearcher.FsEventSearch{Actions: []string{"download"}},
+		ExcludeActions: []string{"download"},
+	}), 0)
+
+	providerPage, err := s.SearchProviderEventsPage(&ProviderEventFilters{
+		ProviderEventSearch: eventsearcher.ProviderEventSearch{CommonSearchParams: params},
+		ExclusionFilters:    ExclusionFilters{ExcludeUsernames: []string{"system"}},
+		ExcludeObjectTypes:  []string{"folder"},
+	}, CountOptions{Mode: CountNone})
+	if assert.NoError(t, err) && assert.Len(t, providerPage.Events, 1) {
+		assert.Equal(t, providerEvents[0].ID, providerPage.Events[0].ID)
+	}
+	providerPage, err = s.SearchProviderEventsPage(&ProviderEventFilters{
+		ProviderEventSearch: eventsearcher.ProviderEventSearch{CommonSearchParams: params},
+		ExcludeActions:      []string{"add", "update"},
+	}, CountOptions{Mode: CountNone})
+	if assert.NoError(t, err) && assert.Len(t, providerPage.Events, 1) {
+		assert.Equal(t, providerEvents[2].ID, providerPage.Events[0].ID)
+	}
+
+	logPage, err := s.SearchLogEventsPage(&LogEventFilters{
+		LogEventSearch:   eventsearcher.LogEventSearch{CommonSearchParams: params},
+		ExclusionFilters: ExclusionFilters{ExcludeInstanceIDs: []string{"i2"}},
+		ExcludeEvents:    []int32{5},
+	}, CountOptions{Mode: CountNone})
+	if assert.NoError(t, err) && assert.Len(t, logPage.Events, 1) {
+		assert.Equal(t, logEvents[0].ID, logPage.Events[0].ID)
+	}
+	logPage, err = s.SearchLogEventsPage(&LogEventFilters{
+		LogEventSearch:   eventsearcher.LogEventSearch{CommonSearchParams: params},
+		ExcludeProtocols: []string{"SSH"},
+	}, CountOptions{Mode: CountNone})
+	if assert.NoError(t, err) && assert.Len(t, logPage.Events, 1) {
+		assert.Equal(t, logEvents[1].ID, logPage.Events[0].ID)
+	}
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&providerEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&logEvents).Error
+	assert.NoError(t, err)
+}
+
+func TestMultiValueFilters(t *testing.T) {
+	newFsEvent := func(username, ip, role, bucket string) FsEvent {
+		return FsEvent{
+			ID:        xid.New().String(),
+			Timestamp: 1000,
+			Action:    "upload",
+			Username:  username,
+			Protocol:  "SFTP",
+			IP:        ip,
+			Role:      role,
+			Bucket:    bucket,
+			Endpoint:  "https://" + bucket + ".example.com",
+		}
+	}
+	fsEvents := []FsEvent{
+		newFsEvent("contractor1", "10.0.0.1", "role1", "b1"),
+		newFsEvent("contractor2", "10.0.0.2", "role1", "b2"),
+		newFsEvent("contractor3", "10.0.0.3", "role2", "b3"),
+		newFsEvent("employee", "10.0.0.4", "role2", "b1"),
+	}
+	providerEvents := []ProviderEvent{
+		{ID: xid.New().String(), Timestamp: 1000, Action: "update", Username: "admin", ObjectName: "user1"},
+		{ID: xid.New().String(), Timestamp: 1000, Action: "update", Username: "admin", ObjectName: "user2"},
+		{ID: xid.New().String(), Timestamp: 1000, Action: "update", Username: "admin", ObjectName: "user3"},
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&providerEvents).Error
+	assert.NoError(t, err)
+
+	params := eventsearcher.CommonSearchParams{
+		StartTimestamp: 1000,
+		EndTimestamp:   1000,
+		Limit:          100,
+	}
+	s := Searcher{}
+	searchFs := func(filters FsEventFilters) []string {
+		filters.StartTimestamp = params.StartTimestamp
+		filters.EndTimestamp = params.EndTimestamp
+		filters.Limit = params.Limit
+		filters.FsProvider = -1
+		page, err := s.SearchFsEventsPage(&filters, CountOptions{Mode: CountNone})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		var results []string
+		for _, ev := range page.Events {
+			results = append(results, ev.Username)
+		}
+		return results
+	}
+
+	assert.ElementsMatch(t, []string{"contractor1", "contractor2", "contractor3"}, searchFs(FsEventFilters{
+		MultiValueFilters: MultiValueFilters{Usernames: []string{"contractor1", "contractor2", "contractor3"}},
+	}))
+	// the single value filter is merged with the list
+	assert.ElementsMatch(t, []string{"contractor1", "employee"}, searchFs(FsEventFilters{
+		FsEventSearch: eventsearcher.FsEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{Username: "employee"},
+		},
+		MultiValueFilters: MultiValueFilters{Usernames: []string{"contractor1"}},
+	}))
+	assert.ElementsMatch(t, []string{"contractor2", "contractor3"}, searchFs(FsEventFilters{
+		MultiValueFilters: MultiValueFilters{IPs: []string{"10.0.0.2", "10.0.0.3"}},
+	}))
+	assert.ElementsMatch(t, []string{"contractor3"}, searchFs(FsEventFilters{
+		MultiValueFilters: MultiValueFilters{Roles: []string{"role2", "role3"}},
+		Buckets:           []string{"b2", "b3"},
+	}))
+	assert.ElementsMatch(t, []string{"contractor1", "contractor2", "employee"}, searchFs(FsEventFilters{
+		Endpoints: []string{"https://b1.example.com", "https://b2.example.com"},
+	}))
+	assert.ElementsMatch(t, []string{"contractor1", "employee"}, searchFs(FsEventFilters{
+		FsEventSearch: eventsearcher.FsEventSearch{Bucket: "b1"},
+	}))
+
+	page, err := s.SearchProviderEventsPage(&ProviderEventFilters{
+		ProviderEventSearch: eventsearcher.ProviderEventSearch{
+			CommonSearchParams: params,
+			ObjectName:         "user3",
+		},
+		ObjectNames: []string{"user1"},
+	}, CountOptions{Mode: CountNone})
+	if assert.NoError(t, err) {
+		assert.Len(t, page.Events, 2)
+		for _, ev := range page.Events {
+			assert.NotEqual(t, "user2", ev.ObjectName)
+		}
+	}
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&providerEvents).Error
+	assert.NoError(t, err)
+}
+
+func TestRangeFilters(t *testing.T) {
+	newFsEvent := func(size, elapsed int64, status int) FsEvent {
+		return FsEvent{
+			ID:        xid.New().String(),
+			Timestamp: 1100,
+			Action:    "upload",
+			Username:  "user",
+			Protocol:  "SFTP",
+			FileSize:  size,
+			Elapsed:   elapsed,
+			Status:    status,
+		}
+	}
+	fsEvents := []FsEvent{
+		newFsEvent(3000000000, 1200000, 1),
+		newFsEvent(2000000000, 30000, 1),
+		newFsEvent(100, 10, 2),
+		newFsEvent(500000000, 700000, 3),
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	searchFs := func(filters FsEventFilters) []string {
+		filters.StartTimestamp = 1100
+		filters.EndTimestamp = 1100
+		filters.Limit = 100
+		filters.FsProvider = -1
+		page, err := s.SearchFsEventsPage(&filters, CountOptions{Mode: CountNone})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		var results []string
+		for _, ev := range page.Events {
+			results = append(results, ev.ID)
+		}
+		return results
+	}
+
+	size, err := ParseSize("2GB")
+	assert.NoError(t, err)
+	// uploads of 2 GB or more
+	assert.ElementsMatch(t, []string{fsEvents[0].ID, fsEvents[1].ID}, searchFs(FsEventFilters{
+		FileSizeRange: Int64Range{Min: &size},
+	}))
+	elapsed, err := ParseElapsed("10m")
+	assert.NoError(t, err)
+	// transfers slower than 10 minutes
+	assert.ElementsMatch(t, []string{fsEvents[0].ID, fsEvents[3].ID}, searchFs(FsEventFilters{
+		ElapsedRange: Int64Range{Min: &elapsed},
+	}))
+	assert.ElementsMatch(t, []string{fsEvents[3].ID}, searchFs(FsEventFilters{
+		FileSizeRange: Int64Range{Min: toPointer(int64(101)), Max: toPointer(int64(2000000000 - 1))},
+	}))
+	assert.ElementsMatch(t, []string{fsEvents[2].ID, fsEvents[3].ID}, searchFs(FsEventFilters{
+		StatusRange: Int64Range{Min: toPointer(int64(2))},
+	}))
+	assert.ElementsMatch(t, []string{fsEvents[1].ID, fsEvents[2].ID}, searchFs(FsEventFilters{
+		ElapsedRange: Int64Range{Max: toPointer(int64(30000))},
+	}))
+
+	_, err = s.SearchFsEventsPage(&FsEventFilters{
+		FsEventSearch: eventsearcher.FsEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{Limit: 10},
+		},
+		ElapsedRange: Int64Range{Min: toPointer(int64(10)), Max: toPointer(int64(1))},
+	}, CountOptions{})
+	assert.ErrorContains(t, err, "elapsed")
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+}
+
+func toPointer[T any](v T) *T {
+	return &v
+}
@@ -37,6 +37,13 @@ type FsEvent struct {
 	OpenFlags         int    `json:"open_flags,omitempty"`
 	Role              string `json:"role,omitempty"`
 	InstanceID        string `json:"instance_id,omitempty"`
+	// OpenFlagNames are the decoded open flags, only set if requested
+	OpenFlagNames []string `json:"open_flag_names,omitempty" gorm:"-"`
+	// TimestampISO, StatusName and FsProviderName are only set if the
+	// enrichment is enabled
+	TimestampISO   string `json:"timestamp_iso,omitempty" gorm:"-"`
+	StatusName     string `json:"status_name,omitempty" gorm:"-"`
+	FsProviderName string `json:"fs_provider_name,omitempty" gorm:"-"`
 }
 
 // TableName defines the database table name
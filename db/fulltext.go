@@ -0,0 +1,299 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/logger"
+)
+
+// Supported strategies for message searches
+const (
+	// MessageSearchTSVector uses a PostgreSQL GIN index on to_tsvector(message)
+	MessageSearchTSVector = "tsvector"
+	// MessageSearchFullText uses a MySQL/MariaDB FULLTEXT index on message
+	MessageSearchFullText = "fulltext"
+	// MessageSearchLike scans the messages using LIKE within a bounded time range
+	MessageSearchLike = "like"
+)
+
+// messageSearchCheckInterval defines how often the full-text indexes are
+// checked, so indexes created while the plugin is running are detected
+const messageSearchCheckInterval = 10 * time.Minute
+
+var (
+	// MaxMessageScanRange is the maximum time range scanned by message
+	// searches using the LIKE strategy, 0 means unbounded
+	MaxMessageScanRange = 7 * 24 * time.Hour
+	errMessageScanRange = errors.New("the time range of the message search is too long")
+	pgTSVectorRegexp    = regexp.MustCompile(
+		`(?i)using gin \(to_tsvector\('([a-z0-9_.]+)'(?:::regconfig)?, \(?message\)?(?:::text)?\)\)`)
+)
+
+// FullTextSearcher is implemented by the backends that report how message
+// searches are executed
+type FullTextSearcher interface {
+	// GetMessageSearchStrategy returns the strategy used for message searches
+	GetMessageSearchStrategy(ctx context.Context) (string, error)
+}
+
+// MessageSearchInfo describes how a message search was executed
+type MessageSearchInfo struct {
+	Strategy string `json:"strategy"`
+	// BoundedStartTimestamp is set if the time range was bounded, only the
+	// events after this timestamp were searched
+	BoundedStartTimestamp int64 `json:"bounded_start_timestamp,omitempty"`
+}
+
+// messageTerm is a word or a phrase, for prefix terms the last word is a prefix
+type messageTerm struct {
+	words  []string
+	prefix bool
+}
+
+// parseMessageQuery parses a message search query: words, quoted phrases and
+// words ending with "*" as prefixes. All the terms must match
+func parseMessageQuery(query string) ([]messageTerm, error) {
+	var terms []messageTerm
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		var token string
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated phrase in message search")
+			}
+			token, query = query[1:end+1], query[end+2:]
+		} else {
+			end := strings.IndexFunc(query, unicode.IsSpace)
+			if end < 0 {
+				end = len(query)
+			}
+			token, query = query[:end], query[end:]
+		}
+		words := strings.FieldsFunc(strings.ToLower(token), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		if len(words) > 0 {
+			terms = append(terms, messageTerm{
+				words:  words,
+				prefix: strings.HasSuffix(token, "*"),
+			})
+		}
+	}
+	if len(terms) == 0 {
+		return nil, errors.New("the message search has no words")
+	}
+	return terms, nil
+}
+
+// getMessageSearchFilters returns the filters to use for a message search and
+// how it will be executed. If the LIKE strategy is used the time range cannot
+// be longer than MaxMessageScanRange: an error is returned for longer ranges
+// and, without a start timestamp, the range is bounded and the bounded start
+// timestamp is reported
+func getMessageSearchFilters(filters *LogEventFilters) (*LogEventFilters, *MessageSearchInfo, error) {
+	if filters.Message == "" {
+		return filters, nil, nil
+	}
+	b, err := getBackend()
+	if err != nil {
+		return nil, nil, err
+	}
+	searcher, ok := b.(FullTextSearcher)
+	if !ok {
+		return filters, nil, nil
+	}
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	strategy, err := searcher.GetMessageSearchStrategy(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := &MessageSearchInfo{
+		Strategy: strategy,
+	}
+	if strategy != MessageSearchLike || MaxMessageScanRange <= 0 {
+		return filters, info, nil
+	}
+	end := filters.EndTimestamp
+	if end <= 0 {
+		end = time.Now().UnixNano()
+	}
+	minStart := end - MaxMessageScanRange.Nanoseconds()
+	if filters.StartTimestamp >= minStart {
+		return filters, info, nil
+	}
+	if filters.StartTimestamp > 0 {
+		return nil, nil, fmt.Errorf("%w, without a full-text index it cannot be longer than %s: "+
+			"narrow the time range or create a full-text index", errMessageScanRange,
+			formatMessageScanRange(MaxMessageScanRange))
+	}
+	bounded := *filters
+	bounded.StartTimestamp = minStart
+	info.BoundedStartTimestamp = minStart
+	return &bounded, info, nil
+}
+
+// formatMessageScanRange formats the scan range using days, if possible
+func formatMessageScanRange(d time.Duration) string {
+	const day = 24 * time.Hour
+	if d%day == 0 {
+		if d == day {
+			return "1 day"
+		}
+		return fmt.Sprintf("%d days", d/day)
+	}
+	return d.String()
+}
+
+// messageSearchCache caches the detected message search strategy
+type messageSearchCache struct {
+	sync.Mutex
+	checkedAt time.Time
+	strategy  string
+	// tsConfig is the text search configuration used by the tsvector index
+	tsConfig string
+}
+
+func (b *gormBackend) GetMessageSearchStrategy(ctx context.Context) (string, error) {
+	strategy, _ := b.getMessageSearch(ctx)
+	return strategy, nil
+}
+
+func (b *gormBackend) getMessageSearch(ctx context.Context) (string, string) {
+	b.messageSearch.Lock()
+	defer b.messageSearch.Unlock()
+
+	if time.Since(b.messageSearch.checkedAt) < messageSearchCheckInterval {
+		return b.messageSearch.strategy, b.messageSearch.tsConfig
+	}
+	strategy, tsConfig, err := b.detectMessageSearch(ctx)
+	if err != nil {
+		logger.AppLogger.Warn("unable to detect full-text indexes, using LIKE for message searches", "error", err)
+		strategy, tsConfig = MessageSearchLike, ""
+	}
+	b.messageSearch.checkedAt = time.Now()
+	b.messageSearch.strategy = strategy
+	b.messageSearch.tsConfig = tsConfig
+	return strategy, tsConfig
+}
+
+func (b *gormBackend) detectMessageSearch(ctx context.Context) (string, string, error) {
+	tableName := (&LogEvent{}).TableName()
+
+	switch b.driver {
+	case driverNamePostgreSQL:
+		var defs []string
+		err := b.getSession(ctx).Raw(`SELECT indexdef FROM pg_indexes WHERE schemaname = current_schema() `+
+			`AND tablename = ?`, tableName).Scan(&defs).Error
+		if err != nil {
+			return "", "", err
+		}
+		for _, def := range defs {
+			if matches := pgTSVectorRegexp.FindStringSubmatch(def); matches != nil {
+				return MessageSearchTSVector, matches[1], nil
+			}
+		}
+	case driverNameMySQL:
+		var indexes []string
+		err := b.getSession(ctx).Raw(`SELECT index_name FROM information_schema.statistics `+
+			`WHERE table_schema = DATABASE() AND table_name = ? AND index_type = 'FULLTEXT' `+
+			`GROUP BY index_name HAVING COUNT(*) = 1 AND MAX(LOWER(column_name)) = 'message'`, tableName).
+			Scan(&indexes).Error
+		if err != nil {
+			return "", "", err
+		}
+		if len(indexes) > 0 {
+			return MessageSearchFullText, "", nil
+		}
+	}
+	return MessageSearchLike, "", nil
+}
+
+// getMessageCondition returns the condition for an already validated message search
+func (b *gormBackend) getMessageCondition(ctx context.Context, query string) (string, []any) {
+	terms, err := parseMessageQuery(query)
+	if err != nil {
+		return "1 = 0", nil
+	}
+	strategy, tsConfig := b.getMessageSearch(ctx)
+
+	switch strategy {
+	case MessageSearchTSVector:
+		// the expression must match the indexed one, words only contain
+		// letters and digits so they are safe within a tsquery
+		var parts []string
+		for _, term := range terms {
+			part := strings.Join(term.words, " <-> ")
+			if term.prefix {
+				part += ":*"
+			}
+			parts = append(parts, part)
+		}
+		return fmt.Sprintf("to_tsvector('%s', message) @@ to_tsquery('%s', ?)", tsConfig, tsConfig),
+			[]any{strings.Join(parts, " & ")}
+	case MessageSearchFullText:
+		var parts []string
+		for _, term := range terms {
+			words := term.words
+			var prefix string
+			if term.prefix {
+				// prefixes are not supported within phrases
+				prefix = "+" + words[len(words)-1] + "*"
+				words = words[:len(words)-1]
+			}
+			if len(words) > 0 {
+				parts = append(parts, fmt.Sprintf(`+"%s"`, strings.Join(words, " ")))
+			}
+			if prefix != "" {
+				parts = append(parts, prefix)
+			}
+		}
+		return "MATCH (message) AGAINST (? IN BOOLEAN MODE)", []any{strings.Join(parts, " ")}
+	default:
+		var conditions []string
+		var args []any
+		for _, term := range terms {
+			var pattern pathPattern
+			for _, word := range term.words {
+				pattern = append(pattern, patternToken{wildcard: '*'}, patternToken{literal: word})
+			}
+			pattern = append(pattern, patternToken{wildcard: '*'})
+			condition, conditionArgs := b.getPatternCondition("message", pattern, true)
+			conditions = append(conditions, condition)
+			args = append(args, conditionArgs...)
+		}
+		return "(" + strings.Join(conditions, " AND ") + ")", args
+	}
+}
+
+func (b *gormBackend) applyMessageSearch(sess *gorm.DB, query string) *gorm.DB {
+	if query == "" {
+		return sess
+	}
+	condition, args := b.getMessageCondition(sess.Statement.Context, query)
+	return sess.Where(condition, args...)
+}
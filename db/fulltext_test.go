@@ -0,0 +1,179 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageQuery(t *testing.T) {
+	terms, err := parseMessageQuery(`  Login "permission: DENIED" pub* user@example.com "key ex*"`)
+	assert.NoError(t, err)
+	assert.Equal(t, []messageTerm{
+		{words: []string{"login"}},
+		{words: []string{"permission", "denied"}},
+		{words: []string{"pub"}, prefix: true},
+		{words: []string{"user", "example", "com"}},
+		{words: []string{"key", "ex"}, prefix: true},
+	}, terms)
+	_, err = parseMessageQuery(`"unterminated`)
+	assert.Error(t, err)
+	_, err = parseMessageQuery(` ** "" `)
+	assert.Error(t, err)
+
+	matches := pgTSVectorRegexp.FindStringSubmatch("CREATE INDEX idx_log_events_message ON public.eventstore_log_events " +
+		"USING gin (to_tsvector('english'::regconfig, (message)::text))")
+	if assert.Len(t, matches, 2) {
+		assert.Equal(t, "english", matches[1])
+	}
+	assert.False(t, pgTSVectorRegexp.MatchString("CREATE INDEX idx ON public.eventstore_log_events "+
+		"USING gin (to_tsvector('english'::regconfig, COALESCE(message, ''::character varying)::text))"))
+
+	query := `"permission denied" pub*`
+	b := &gormBackend{driver: driverNamePostgreSQL}
+	b.messageSearch.checkedAt = time.Now()
+	b.messageSearch.strategy = MessageSearchTSVector
+	b.messageSearch.tsConfig = "english"
+	condition, args := b.getMessageCondition(context.Background(), query)
+	assert.Equal(t, "to_tsvector('english', message) @@ to_tsquery('english', ?)", condition)
+	assert.Equal(t, []any{"permission <-> denied & pub:*"}, args)
+
+	b = &gormBackend{driver: driverNameMySQL}
+	b.messageSearch.checkedAt = time.Now()
+	b.messageSearch.strategy = MessageSearchFullText
+	condition, args = b.getMessageCondition(context.Background(), query+` "key ex*"`)
+	assert.Equal(t, "MATCH (message) AGAINST (? IN BOOLEAN MODE)", condition)
+	assert.Equal(t, []any{`+"permission denied" +pub* +"key" +ex*`}, args)
+
+	b.messageSearch.strategy = MessageSearchLike
+	condition, args = b.getMessageCondition(context.Background(), query)
+	assert.Equal(t, "(LOWER(message) LIKE LOWER(?) ESCAPE '!' AND LOWER(message) LIKE LOWER(?) ESCAPE '!')", condition)
+	assert.Equal(t, []any{"%permission%denied%", "%pub%"}, args)
+}
+
+func TestSearchMessage(t *testing.T) {
+	now := time.Now().UnixNano()
+	newLogEvent := func(timestamp int64, message string) LogEvent {
+		return LogEvent{
+			ID:         xid.New().String(),
+			Timestamp:  timestamp,
+			Event:      1,
+			Protocol:   "SSH",
+			Message:    message,
+			InstanceID: "fulltext",
+		}
+	}
+	logEvents := []LogEvent{
+		newLogEvent(now-time.Hour.Nanoseconds(), "Login failed: permission denied for user \"alice\""),
+		newLogEvent(now-2*time.Hour.Nanoseconds(), "Login failed: no public key found"),
+		newLogEvent(now-3*time.Hour.Nanoseconds(), "Login failed: Permission Denied (publickey)"),
+		newLogEvent(now-30*24*time.Hour.Nanoseconds(), "Login failed: permission denied"),
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&logEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	search := func(message string, start int64) *Page[LogEvent] {
+		page, err := s.SearchLogEventsPage(&LogEventFilters{
+			LogEventSearch: eventsearcher.LogEventSearch{
+				CommonSearchParams: eventsearcher.CommonSearchParams{
+					StartTimestamp: start,
+					InstanceIDs:    []string{"fulltext"},
+					Limit:          10,
+				},
+			},
+			Message: message,
+		}, CountOptions{})
+		if !assert.NoError(t, err) {
+			return &Page[LogEvent]{}
+		}
+		return page
+	}
+
+	page := search(`"permission denied"`, 0)
+	if assert.NotNil(t, page.MessageSearch) {
+		assert.Equal(t, MessageSearchLike, page.MessageSearch.Strategy)
+		assert.Greater(t, page.MessageSearch.BoundedStartTimestamp, logEvents[3].Timestamp)
+	}
+	if assert.Len(t, page.Events, 2) {
+		assert.Equal(t, logEvents[0].ID, page.Events[0].ID)
+		assert.Equal(t, logEvents[2].ID, page.Events[1].ID)
+	}
+	page = search(`publ* failed`, now-24*time.Hour.Nanoseconds())
+	if assert.NotNil(t, page.MessageSearch) {
+		assert.Zero(t, page.MessageSearch.BoundedStartTimestamp)
+	}
+	assert.Len(t, page.Events, 2)
+	assert.Len(t, search(`"denied permission"`, 0).Events, 0)
+	// an explicit time range longer than the scan range is refused
+	_, err = s.SearchLogEventsPage(&LogEventFilters{
+		LogEventSearch: eventsearcher.LogEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				StartTimestamp: now - 31*24*time.Hour.Nanoseconds(),
+				Limit:          10,
+			},
+		},
+		Message: "permission",
+	}, CountOptions{})
+	if assert.ErrorIs(t, err, errMessageScanRange) {
+		assert.Contains(t, err.Error(), "7 days")
+	}
+	aggregation, err := s.AggregateLogEvents(&LogEventFilters{
+		LogEventSearch: eventsearcher.LogEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				InstanceIDs: []string{"fulltext"},
+			},
+		},
+		Message: `"permission denied"`,
+	}, AggregationOptions{GroupBy: []string{"instance_id"}})
+	if assert.NoError(t, err) && assert.NotNil(t, aggregation.MessageSearch) {
+		assert.NotZero(t, aggregation.MessageSearch.BoundedStartTimestamp)
+		if assert.Len(t, aggregation.Buckets, 1) {
+			assert.Equal(t, int64(2), aggregation.Buckets[0].Count)
+		}
+	}
+
+	maxRange := MaxMessageScanRange
+	MaxMessageScanRange = 0
+	assert.Len(t, search(`"permission denied"`, 0).Events, 3)
+	MaxMessageScanRange = maxRange
+
+	page = search("", 0)
+	assert.Nil(t, page.MessageSearch)
+	assert.Len(t, page.Events, 4)
+
+	_, err = s.SearchLogEventsPage(&LogEventFilters{
+		LogEventSearch: eventsearcher.LogEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				Limit: 10,
+			},
+		},
+		Message: `"`,
+	}, CountOptions{})
+	assert.Error(t, err)
+
+	err = sess.Delete(&logEvents).Error
+	assert.NoError(t, err)
+}
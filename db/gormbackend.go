@@ -0,0 +1,394 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/logger"
+)
+
+func init() {
+	RegisterBackend(driverNamePostgreSQL, newGormBackend)
+	RegisterBackend(driverNameMySQL, newGormBackend)
+	RegisterBackend(driverNameSQLite, newGormBackend)
+}
+
+// gormBackend is the backend for the SQL databases supported by gorm
+type gormBackend struct {
+	driver         string
+	db             *gorm.DB
+	messageSearch  messageSearchCache
+	jsonValidation jsonValidationCache
+}
+
+func newGormBackend(config BackendConfig) (Backend, error) {
+	var dialector gorm.Dialector
+
+	switch config.Driver {
+	case driverNamePostgreSQL:
+		dialector = postgres.New(postgres.Config{
+			DSN: config.DSN,
+		})
+	case driverNameMySQL:
+		if err := handleCustomTLSConfig(config.CustomTLSConfig); err != nil {
+			logger.AppLogger.Error("unable to register custom tls config", "error", err)
+			return nil, err
+		}
+		dialector = mysql.New(mysql.Config{
+			DSN: config.DSN,
+		})
+	case driverNameSQLite:
+		// pure Go dialector, it uses the "sqlite" driver registered by
+		// github.com/glebarez/go-sqlite
+		dialector = sqlite.Open(config.DSN)
+	default:
+		return nil, fmt.Errorf("unsupported database driver %v", config.Driver)
+	}
+
+	handle, err := gorm.Open(dialector, &gorm.Config{
+		SkipDefaultTransaction: true,
+		Logger:                 gormlogger.Discard,
+	})
+	if err != nil {
+		logger.AppLogger.Error("unable to create db handle", "error", err)
+		return nil, err
+	}
+
+	sqlDB, err := handle.DB()
+	if err != nil {
+		logger.AppLogger.Error("unable to get sql db handle", "error", err)
+		return nil, err
+	}
+
+	sqlDB.SetMaxOpenConns(config.PoolSize)
+	if config.PoolSize > 0 {
+		sqlDB.SetMaxIdleConns(config.PoolSize)
+	} else {
+		sqlDB.SetMaxIdleConns(2)
+	}
+	sqlDB.SetConnMaxIdleTime(4 * time.Minute)
+	sqlDB.SetConnMaxLifetime(2 * time.Minute)
+
+	return &gormBackend{
+		driver: config.Driver,
+		db:     handle,
+	}, nil
+}
+
+func (b *gormBackend) getSession(ctx context.Context) *gorm.DB {
+	return b.db.WithContext(ctx)
+}
+
+func (b *gormBackend) Ping(ctx context.Context) error {
+	sqlDB, err := b.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
+func (b *gormBackend) Close() error {
+	sqlDB, err := b.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+func (b *gormBackend) SearchFsEvents(ctx context.Context, filters *FsEventFilters) ([]FsEvent, error) {
+	var results []FsEvent
+
+	sess, err := b.getFsEventsQuery(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	err = sess.Find(&results).Error
+
+	return results, err
+}
+
+// getFsEventsQuery returns the session used to search the fs events, it is
+// also used to explain the search
+func (b *gormBackend) getFsEventsQuery(ctx context.Context, filters *FsEventFilters) (*gorm.DB, error) {
+	sess := b.applyFsEventFilters(b.getSession(ctx).Model(&FsEvent{}), filters)
+	sess, err := b.applyKeyset(ctx, sess, (&FsEvent{}).TableName(), filters.FromID, filters.Order)
+	if err != nil {
+		return nil, err
+	}
+	return sess.Limit(filters.Limit).Order(getOrderBy(filters.Order)), nil
+}
+
+func (b *gormBackend) applyFsEventFilters(sess *gorm.DB, filters *FsEventFilters) *gorm.DB {
+	if filters.StartTimestamp > 0 {
+		sess = sess.Where("timestamp >= ?", filters.StartTimestamp)
+	}
+	if filters.EndTimestamp > 0 {
+		sess = sess.Where("timestamp <= ?", filters.EndTimestamp)
+	}
+	if len(filters.Actions) > 0 {
+		sess = sess.Where("action IN ?", filters.Actions)
+	}
+	sess = applyInclusion(sess, "username", filters.Username, filters.Usernames)
+	sess = applyInclusion(sess, "ip", filters.IP, filters.IPs)
+	if filters.SSHCmd != "" {
+		sess = sess.Where("ssh_cmd = ?", filters.SSHCmd)
+	}
+	if len(filters.Protocols) > 0 {
+		sess = sess.Where("protocol IN ?", filters.Protocols)
+	}
+	if len(filters.InstanceIDs) > 0 {
+		sess = sess.Where("instance_id IN ?", filters.InstanceIDs)
+	}
+	if len(filters.Statuses) > 0 {
+		sess = sess.Where("status IN ?", filters.Statuses)
+	}
+	if filters.FsProvider >= 0 {
+		sess = sess.Where("fs_provider = ?", filters.FsProvider)
+	}
+	sess = applyInclusion(sess, "bucket", filters.Bucket, filters.Buckets)
+	sess = applyInclusion(sess, "endpoint", filters.Endpoint, filters.Endpoints)
+	sess = applyRange(sess, "file_size", filters.FileSizeRange)
+	sess = applyRange(sess, "elapsed", filters.ElapsedRange)
+	sess = applyRange(sess, "status", filters.StatusRange)
+	sess = applyOpenFlagsFilter(sess, filters.OpenFlags)
+	sess = applyInclusion(sess, "role", filters.Role, filters.Roles)
+	if filters.SessionID != "" {
+		sess = sess.Where("session_id = ?", filters.SessionID)
+	}
+	sess = b.applyNetworkFilters(sess, &filters.NetworkFilters)
+	sess = applyExclusionFilters(sess, &filters.ExclusionFilters)
+	sess = applyExclusion(sess, "action", filters.ExcludeActions)
+	sess = applyExclusion(sess, "protocol", filters.ExcludeProtocols)
+	sess = applyExclusion(sess, "status", filters.ExcludeStatuses)
+	if filters.Query != "" {
+		condition, args := b.getQueryCondition(filters.Query, fsEventQueryFields)
+		sess = sess.Where(condition, args...)
+	}
+	for idx := range filters.Paths {
+		condition, args := b.getPathCondition(&filters.Paths[idx])
+		sess = sess.Where(condition, args...)
+	}
+
+	return sess
+}
+
+func (b *gormBackend) SearchProviderEvents(ctx context.Context, filters *ProviderEventFilters,
+) ([]ProviderEvent, error) {
+	var results []ProviderEvent
+
+	sess, err := b.getProviderEventsQuery(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	err = sess.Find(&results).Error
+
+	return results, err
+}
+
+// getProviderEventsQuery returns the session used to search the provider
+// events, it is also used to explain the search
+func (b *gormBackend) getProviderEventsQuery(ctx context.Context, filters *ProviderEventFilters,
+) (*gorm.DB, error) {
+	sess := b.applyProviderEventFilters(b.getSession(ctx).Model(&ProviderEvent{}), filters)
+	if filters.OmitObjectData {
+		sess = sess.Omit("object_data")
+	}
+	sess, err := b.applyKeyset(ctx, sess, (&ProviderEvent{}).TableName(), filters.FromID, filters.Order)
+	if err != nil {
+		return nil, err
+	}
+	return sess.Limit(filters.Limit).Order(getOrderBy(filters.Order)), nil
+}
+
+func (b *gormBackend) applyProviderEventFilters(sess *gorm.DB, filters *ProviderEventFilters) *gorm.DB {
+	if filters.StartTimestamp > 0 {
+		sess = sess.Where("timestamp >= ?", filters.StartTimestamp)
+	}
+	if filters.EndTimestamp > 0 {
+		sess = sess.Where("timestamp <= ?", filters.EndTimestamp)
+	}
+	if len(filters.Actions) > 0 {
+		sess = sess.Where("action IN ?", filters.Actions)
+	}
+	sess = applyInclusion(sess, "username", filters.Username, filters.Usernames)
+	sess = applyInclusion(sess, "ip", filters.IP, filters.IPs)
+	if len(filters.ObjectTypes) > 0 {
+		sess = sess.Where("object_type IN ?", filters.ObjectTypes)
+	}
+	sess = applyInclusion(sess, "object_name", filters.ObjectName, filters.ObjectNames)
+	if len(filters.InstanceIDs) > 0 {
+		sess = sess.Where("instance_id IN ?", filters.InstanceIDs)
+	}
+	sess = applyInclusion(sess, "role", filters.Role, filters.Roles)
+	sess = b.applyNetworkFilters(sess, &filters.NetworkFilters)
+	sess = applyExclusionFilters(sess, &filters.ExclusionFilters)
+	sess = applyExclusion(sess, "action", filters.ExcludeActions)
+	sess = applyExclusion(sess, "object_type", filters.ExcludeObjectTypes)
+	if filters.Query != "" {
+		condition, args := b.getQueryCondition(filters.Query, providerEventQueryFields)
+		sess = sess.Where(condition, args...)
+	}
+	for idx := range filters.ObjectData {
+		condition, args := b.getJSONCondition(sess.Statement.Context, &filters.ObjectData[idx])
+		sess = sess.Where(condition, args...)
+	}
+
+	return sess
+}
+
+func (b *gormBackend) SearchLogEvents(ctx context.Context, filters *LogEventFilters) ([]LogEvent, error) {
+	var results []LogEvent
+
+	sess, err := b.getLogEventsQuery(ctx, filters)
+	if err != nil {
+		return nil, err
+	}
+	err = sess.Find(&results).Error
+
+	return results, err
+}
+
+// getLogEventsQuery returns the session used to search the log events, it is
+// also used to explain the search
+func (b *gormBackend) getLogEventsQuery(ctx context.Context, filters *LogEventFilters) (*gorm.DB, error) {
+	sess := b.applyLogEventFilters(b.getSession(ctx).Model(&LogEvent{}), filters)
+	sess, err := b.applyKeyset(ctx, sess, (&LogEvent{}).TableName(), filters.FromID, filters.Order)
+	if err != nil {
+		return nil, err
+	}
+	return sess.Limit(filters.Limit).Order(getOrderBy(filters.Order)), nil
+}
+
+func (b *gormBackend) applyLogEventFilters(sess *gorm.DB, filters *LogEventFilters) *gorm.DB {
+	if filters.StartTimestamp > 0 {
+		sess = sess.Where("timestamp >= ?", filters.StartTimestamp)
+	}
+	if filters.EndTimestamp > 0 {
+		sess = sess.Where("timestamp <= ?", filters.EndTimestamp)
+	}
+	if len(filters.Events) > 0 {
+		sess = sess.Where("event IN ?", filters.Events)
+	}
+	if len(filters.Protocols) > 0 {
+		sess = sess.Where("protocol IN ?", filters.Protocols)
+	}
+	sess = applyInclusion(sess, "username", filters.Username, filters.Usernames)
+	sess = applyInclusion(sess, "ip", filters.IP, filters.IPs)
+	if len(filters.InstanceIDs) > 0 {
+		sess = sess.Where("instance_id IN ?", filters.InstanceIDs)
+	}
+	sess = applyInclusion(sess, "role", filters.Role, filters.Roles)
+	sess = b.applyNetworkFilters(sess, &filters.NetworkFilters)
+	sess = applyExclusionFilters(sess, &filters.ExclusionFilters)
+	sess = applyExclusion(sess, "event", filters.ExcludeEvents)
+	sess = applyExclusion(sess, "protocol", filters.ExcludeProtocols)
+	sess = b.applyMessageSearch(sess, filters.Message)
+	if filters.Query != "" {
+		condition, args := b.getQueryCondition(filters.Query, logEventQueryFields)
+		sess = sess.Where(condition, args...)
+	}
+
+	return sess
+}
+
+// applyInclusion restricts the results to the events whose column is equal to
+// value or to any of values, empty values are ignored
+func applyInclusion(sess *gorm.DB, column, value string, values []string) *gorm.DB {
+	if value != "" {
+		values = append([]string{value}, values...)
+	}
+	switch len(values) {
+	case 0:
+		return sess
+	case 1:
+		return sess.Where(column+" = ?", values[0])
+	default:
+		return sess.Where(column+" IN ?", values)
+	}
+}
+
+func applyRange(sess *gorm.DB, column string, r Int64Range) *gorm.DB {
+	if r.Min != nil {
+		sess = sess.Where(column+" >= ?", *r.Min)
+	}
+	if r.Max != nil {
+		sess = sess.Where(column+" <= ?", *r.Max)
+	}
+	return sess
+}
+
+func applyExclusionFilters(sess *gorm.DB, filters *ExclusionFilters) *gorm.DB {
+	sess = applyExclusion(sess, "username", filters.ExcludeUsernames)
+	sess = applyExclusion(sess, "ip", filters.ExcludeIPs)
+	sess = applyExclusion(sess, "role", filters.ExcludeRoles)
+	return applyExclusion(sess, "instance_id", filters.ExcludeInstanceIDs)
+}
+
+// applyExclusion excludes the given values, NULL values are not excluded
+func applyExclusion[T any](sess *gorm.DB, column string, values []T) *gorm.DB {
+	if len(values) == 0 {
+		return sess
+	}
+	return sess.Where(fmt.Sprintf("(%s IS NULL OR %s NOT IN ?)", column, column), values)
+}
+
+// applyKeyset restricts the results to the events following the one identified
+// by fromID in the (timestamp, id) ordering. fromID is usually a cursor, for
+// backward compatibility an event ID is accepted too
+func (b *gormBackend) applyKeyset(ctx context.Context, sess *gorm.DB, tableName, fromID string, order int,
+) (*gorm.DB, error) {
+	if fromID == "" {
+		return sess, nil
+	}
+	c, err := decodeCursor(fromID)
+	if err != nil {
+		var timestamps []int64
+		err = b.getSession(ctx).Table(tableName).Where("id = ?", fromID).Limit(1).Pluck("timestamp", &timestamps).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(timestamps) == 0 {
+			// the referenced event no longer exists, we can only compare IDs
+			if order == 0 {
+				return sess.Where("id < ?", fromID), nil
+			}
+			return sess.Where("id > ?", fromID), nil
+		}
+		c = cursor{
+			Timestamp: timestamps[0],
+			ID:        fromID,
+		}
+	}
+	if order == 0 {
+		return sess.Where("(timestamp < ? OR (timestamp = ? AND id < ?))", c.Timestamp, c.Timestamp, c.ID), nil
+	}
+	return sess.Where("(timestamp > ? OR (timestamp = ? AND id > ?))", c.Timestamp, c.Timestamp, c.ID), nil
+}
+
+func getOrderBy(order int) string {
+	if order == 0 {
+		return "timestamp DESC, id DESC"
+	}
+	return "timestamp ASC, id ASC"
+}
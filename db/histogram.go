@@ -0,0 +1,343 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/logger"
+)
+
+// Supported histogram intervals
+const (
+	HistogramIntervalMinute = "minute"
+	HistogramIntervalHour   = "hour"
+	HistogramIntervalDay    = "day"
+	HistogramIntervalWeek   = "week"
+)
+
+const maxHistogramBuckets = 10000
+
+var (
+	errHistogramRange = errors.New("please specify both start and end timestamp")
+	// weeks start on Monday, 1970-01-01 was a Thursday
+	weekOffset = int64(3 * 24 * time.Hour)
+)
+
+// HistogramOptions defines the options for a date histogram search
+type HistogramOptions struct {
+	// Interval defines the bucket width: minute, hour, day or week. Buckets are
+	// aligned in UTC, weeks start on Monday
+	Interval string
+	// SplitBy is an optional field used to split the count of each bucket
+	SplitBy string
+}
+
+// getBucketing returns the width and offset, in nanoseconds, for the interval
+func (o *HistogramOptions) getBucketing() (int64, int64, error) {
+	switch o.Interval {
+	case HistogramIntervalMinute:
+		return int64(time.Minute), 0, nil
+	case HistogramIntervalHour:
+		return int64(time.Hour), 0, nil
+	case HistogramIntervalDay:
+		return int64(24 * time.Hour), 0, nil
+	case HistogramIntervalWeek:
+		return int64(7 * 24 * time.Hour), weekOffset, nil
+	default:
+		return 0, 0, fmt.Errorf("unsupported histogram interval %q", o.Interval)
+	}
+}
+
+// HistogramSplit defines the number of events for a value of the split field,
+// Key is nil for NULL values
+type HistogramSplit struct {
+	Key   any   `json:"key"`
+	Count int64 `json:"count"`
+}
+
+// HistogramBucket defines the number of events within a time interval,
+// Timestamp is the interval start as unix timestamp in nanoseconds
+type HistogramBucket struct {
+	Timestamp int64            `json:"timestamp"`
+	Count     int64            `json:"count"`
+	Splits    []HistogramSplit `json:"splits,omitempty"`
+}
+
+// HistogramResult defines the result of a date histogram search. There is
+// a bucket, possibly empty, for each interval between the start and end
+// timestamps
+type HistogramResult struct {
+	Interval string            `json:"interval"`
+	SplitBy  string            `json:"split_by,omitempty"`
+	Buckets  []HistogramBucket `json:"buckets"`
+	// MessageSearch describes how a log events message search was executed
+	MessageSearch *MessageSearchInfo `json:"message_search,omitempty"`
+}
+
+// HistogramRow is a row returned by a backend, Key is the bucket number and
+// Split the split field value, if any
+type HistogramRow struct {
+	Key   int64
+	Split any
+	Count int64
+}
+
+// Histogrammer is implemented by the backends able to count the events
+// matching a search within fixed time intervals. Bucket keys are computed
+// as (timestamp + offset) / width, rows must be ordered by key
+type Histogrammer interface {
+	HistogramFsEvents(ctx context.Context, filters *FsEventFilters, width, offset int64, splitBy string,
+	) ([]HistogramRow, error)
+	HistogramProviderEvents(ctx context.Context, filters *ProviderEventFilters, width, offset int64,
+		splitBy string,
+	) ([]HistogramRow, error)
+	HistogramLogEvents(ctx context.Context, filters *LogEventFilters, width, offset int64, splitBy string,
+	) ([]HistogramRow, error)
+}
+
+// HistogramFsEvents counts the filesystem events matching the given filters
+// within the intervals between the start and end timestamps
+func (s *Searcher) HistogramFsEvents(filters *FsEventFilters, options HistogramOptions,
+) (*HistogramResult, error) {
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	width, offset, err := validateHistogram(&filters.CommonSearchParams, options,
+		(&FsEvent{}).TableName(), fsEventGroupableFields)
+	if err != nil {
+		return nil, err
+	}
+	histogrammer, err := getHistogrammer()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	rows, err := histogrammer.HistogramFsEvents(ctx, filters, width, offset, options.SplitBy)
+	if err != nil {
+		logger.AppLogger.Warn("unable to compute fs events histogram", "error", err)
+		return nil, err
+	}
+	return newHistogramResult(&filters.CommonSearchParams, options, width, offset, rows), nil
+}
+
+// HistogramProviderEvents counts the provider events matching the given filters
+// within the intervals between the start and end timestamps
+func (s *Searcher) HistogramProviderEvents(filters *ProviderEventFilters, options HistogramOptions,
+) (*HistogramResult, error) {
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	width, offset, err := validateHistogram(&filters.CommonSearchParams, options,
+		(&ProviderEvent{}).TableName(), providerEventGroupableFields)
+	if err != nil {
+		return nil, err
+	}
+	histogrammer, err := getHistogrammer()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	rows, err := histogrammer.HistogramProviderEvents(ctx, filters, width, offset, options.SplitBy)
+	if err != nil {
+		logger.AppLogger.Warn("unable to compute provider events histogram", "error", err)
+		return nil, err
+	}
+	return newHistogramResult(&filters.CommonSearchParams, options, width, offset, rows), nil
+}
+
+// HistogramLogEvents counts the log events matching the given filters within
+// the intervals between the start and end timestamps
+func (s *Searcher) HistogramLogEvents(filters *LogEventFilters, options HistogramOptions,
+) (*HistogramResult, error) {
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	width, offset, err := validateHistogram(&filters.CommonSearchParams, options,
+		(&LogEvent{}).TableName(), logEventGroupableFields)
+	if err != nil {
+		return nil, err
+	}
+	// the time range is required, so it is never bounded
+	filters, messageSearch, err := getMessageSearchFilters(filters)
+	if err != nil {
+		return nil, err
+	}
+	histogrammer, err := getHistogrammer()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	rows, err := histogrammer.HistogramLogEvents(ctx, filters, width, offset, options.SplitBy)
+	if err != nil {
+		logger.AppLogger.Warn("unable to compute log events histogram", "error", err)
+		return nil, err
+	}
+	result := newHistogramResult(&filters.CommonSearchParams, options, width, offset, rows)
+	result.MessageSearch = messageSearch
+	return result, nil
+}
+
+func validateHistogram(params *eventsearcher.CommonSearchParams, options HistogramOptions, table string,
+	allowed map[string]fieldType,
+) (int64, int64, error) {
+	width, offset, err := options.getBucketing()
+	if err != nil {
+		return 0, 0, err
+	}
+	if params.StartTimestamp <= 0 || params.EndTimestamp <= 0 {
+		return 0, 0, errHistogramRange
+	}
+	if params.EndTimestamp < params.StartTimestamp {
+		return 0, 0, errors.New("the end timestamp must be after the start timestamp")
+	}
+	numBuckets := getHistogramKey(params.EndTimestamp, width, offset) -
+		getHistogramKey(params.StartTimestamp, width, offset) + 1
+	if numBuckets > maxHistogramBuckets {
+		return 0, 0, fmt.Errorf("too many buckets: %d, the maximum allowed is %d, please use a wider interval",
+			numBuckets, maxHistogramBuckets)
+	}
+	if options.SplitBy != "" {
+		if err := validateFields([]string{options.SplitBy}, allowed); err != nil {
+			return 0, 0, err
+		}
+		if err := checkColumns(table, options.SplitBy); err != nil {
+			return 0, 0, err
+		}
+	}
+	return width, offset, nil
+}
+
+func getHistogrammer() (Histogrammer, error) {
+	b, err := getBackend()
+	if err != nil {
+		return nil, err
+	}
+	histogrammer, ok := b.(Histogrammer)
+	if !ok {
+		return nil, errNotSupported
+	}
+	return histogrammer, nil
+}
+
+func getHistogramKey(timestamp, width, offset int64) int64 {
+	return (timestamp + offset) / width
+}
+
+// newHistogramResult builds the result adding the empty buckets
+func newHistogramResult(params *eventsearcher.CommonSearchParams, options HistogramOptions, width, offset int64,
+	rows []HistogramRow,
+) *HistogramResult {
+	firstKey := getHistogramKey(params.StartTimestamp, width, offset)
+	lastKey := getHistogramKey(params.EndTimestamp, width, offset)
+	result := &HistogramResult{
+		Interval: options.Interval,
+		SplitBy:  options.SplitBy,
+		Buckets:  make([]HistogramBucket, 0, lastKey-firstKey+1),
+	}
+	for key := firstKey; key <= lastKey; key++ {
+		result.Buckets = append(result.Buckets, HistogramBucket{
+			Timestamp: key*width - offset,
+		})
+	}
+	for _, row := range rows {
+		if row.Key < firstKey || row.Key > lastKey {
+			continue
+		}
+		bucket := &result.Buckets[row.Key-firstKey]
+		bucket.Count += row.Count
+		if options.SplitBy != "" {
+			bucket.Splits = append(bucket.Splits, HistogramSplit{
+				Key:   row.Split,
+				Count: row.Count,
+			})
+		}
+	}
+	return result
+}
+
+func (b *gormBackend) HistogramFsEvents(ctx context.Context, filters *FsEventFilters,
+	width, offset int64, splitBy string,
+) ([]HistogramRow, error) {
+	sess := b.applyFsEventFilters(b.getSession(ctx).Model(&FsEvent{}), filters)
+	return b.histogram(sess, width, offset, splitBy, fsEventGroupableFields)
+}
+
+func (b *gormBackend) HistogramProviderEvents(ctx context.Context, filters *ProviderEventFilters,
+	width, offset int64, splitBy string,
+) ([]HistogramRow, error) {
+	sess := b.applyProviderEventFilters(b.getSession(ctx).Model(&ProviderEvent{}), filters)
+	return b.histogram(sess, width, offset, splitBy, providerEventGroupableFields)
+}
+
+func (b *gormBackend) HistogramLogEvents(ctx context.Context, filters *LogEventFilters,
+	width, offset int64, splitBy string,
+) ([]HistogramRow, error) {
+	sess := b.applyLogEventFilters(b.getSession(ctx).Model(&LogEvent{}), filters)
+	return b.histogram(sess, width, offset, splitBy, logEventGroupableFields)
+}
+
+// histogram groups the events by time bucket and, optionally, by the split
+// field. The split field must be validated by the caller
+func (b *gormBackend) histogram(sess *gorm.DB, width, offset int64, splitBy string, fields map[string]fieldType,
+) ([]HistogramRow, error) {
+	// width and offset are integers computed by us and not user input so
+	// they can be safely formatted inside the query
+	divide := "/"
+	if b.driver == driverNameMySQL {
+		divide = "DIV"
+	}
+	bucketExpr := fmt.Sprintf("(timestamp + %d) %s %d", offset, divide, width)
+	columns := bucketExpr + " AS time_bucket"
+	groupBy := "time_bucket"
+	if splitBy != "" {
+		columns += ", " + splitBy
+		groupBy += ", " + splitBy
+	}
+	rows, err := sess.Select(columns + ", COUNT(*) AS total").Group(groupBy).Order(groupBy).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results, err := scanRowsToMaps(rows)
+	if err != nil {
+		return nil, err
+	}
+	histogramRows := make([]HistogramRow, 0, len(results))
+	for _, result := range results {
+		row := HistogramRow{
+			Key:   toInt64(result["time_bucket"]),
+			Count: toInt64(result["total"]),
+		}
+		if splitBy != "" {
+			row.Split = convertFieldValue(result[splitBy], fields[splitBy])
+		}
+		histogramRows = append(histogramRows, row)
+	}
+	return histogramRows, nil
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestHistogram(t *testing.T) {
+	// Monday 2024-01-01 00:00:00 UTC
+	monday := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts := func(d time.Duration) int64 {
+		return monday.Add(d).UnixNano()
+	}
+	fsEvents := []FsEvent{
+		{ID: xid.New().String(), Timestamp: ts(10 * time.Second), Action: "upload", Username: "u", Protocol: "SFTP"},
+		{ID: xid.New().String(), Timestamp: ts(50 * time.Second), Action: "download", Username: "u", Protocol: "SFTP"},
+		{ID: xid.New().String(), Timestamp: ts(59 * time.Second), Action: "upload", Username: "u", Protocol: "SFTP"},
+		{ID: xid.New().String(), Timestamp: ts(3 * time.Minute), Action: "upload", Username: "u", Protocol: "SFTP"},
+		{ID: xid.New().String(), Timestamp: ts(25 * time.Hour), Action: "upload", Username: "u", Protocol: "FTP"},
+		{ID: xid.New().String(), Timestamp: ts(8 * 24 * time.Hour), Action: "upload", Username: "u", Protocol: "FTP"},
+	}
+	logEvents := []LogEvent{
+		{ID: xid.New().String(), Timestamp: ts(time.Hour), Event: 1, Protocol: "SSH"},
+		{ID: xid.New().String(), Timestamp: ts(time.Hour + time.Minute), Event: 1, Protocol: "SSH"},
+	}
+	providerEvents := []ProviderEvent{
+		{ID: xid.New().String(), Timestamp: ts(time.Hour), Action: "add", Username: "admin", ObjectType: "user"},
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&logEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&providerEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	filters := FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: ts(0),
+			EndTimestamp:   ts(5*time.Minute - 1),
+		},
+		FsProvider: -1,
+	}}
+	_, err = s.HistogramFsEvents(&filters, HistogramOptions{Interval: "month"})
+	assert.Error(t, err)
+	_, err = s.HistogramFsEvents(&filters, HistogramOptions{Interval: HistogramIntervalMinute, SplitBy: "message"})
+	assert.Error(t, err)
+	_, err = s.HistogramFsEvents(&FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{}}, HistogramOptions{Interval: HistogramIntervalMinute})
+	assert.ErrorIs(t, err, errHistogramRange)
+	_, err = s.HistogramFsEvents(&FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: ts(0),
+			EndTimestamp:   ts(365 * 24 * time.Hour),
+		},
+	}}, HistogramOptions{Interval: HistogramIntervalMinute})
+	assert.Error(t, err)
+
+	result, err := s.HistogramFsEvents(&filters, HistogramOptions{Interval: HistogramIntervalMinute})
+	assert.NoError(t, err)
+	assert.Equal(t, []HistogramBucket{
+		{Timestamp: ts(0), Count: 3},
+		{Timestamp: ts(time.Minute), Count: 0},
+		{Timestamp: ts(2 * time.Minute), Count: 0},
+		{Timestamp: ts(3 * time.Minute), Count: 1},
+		{Timestamp: ts(4 * time.Minute), Count: 0},
+	}, result.Buckets)
+
+	result, err = s.HistogramFsEvents(&filters, HistogramOptions{
+		Interval: HistogramIntervalMinute,
+		SplitBy:  "action",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "action", result.SplitBy)
+	if assert.Len(t, result.Buckets, 5) {
+		assert.Equal(t, HistogramBucket{
+			Timestamp: ts(0),
+			Count:     3,
+			Splits: []HistogramSplit{
+				{Key: "download", Count: 1},
+				{Key: "upload", Count: 2},
+			},
+		}, result.Buckets[0])
+		assert.Empty(t, result.Buckets[1].Splits)
+	}
+	// the range is not aligned to the interval
+	filters.StartTimestamp = ts(-2 * time.Hour)
+	filters.EndTimestamp = ts(14 * 24 * time.Hour)
+	result, err = s.HistogramFsEvents(&filters, HistogramOptions{Interval: HistogramIntervalDay})
+	assert.NoError(t, err)
+	if assert.Len(t, result.Buckets, 16) {
+		assert.Equal(t, HistogramBucket{Timestamp: ts(-24 * time.Hour)}, result.Buckets[0])
+		assert.Equal(t, HistogramBucket{Timestamp: ts(0), Count: 4}, result.Buckets[1])
+		assert.Equal(t, HistogramBucket{Timestamp: ts(24 * time.Hour), Count: 1}, result.Buckets[2])
+		assert.Equal(t, HistogramBucket{Timestamp: ts(8 * 24 * time.Hour), Count: 1}, result.Buckets[9])
+	}
+	result, err = s.HistogramFsEvents(&filters, HistogramOptions{
+		Interval: HistogramIntervalWeek,
+		SplitBy:  "protocol",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []HistogramBucket{
+		{Timestamp: ts(-7 * 24 * time.Hour), Count: 0},
+		{Timestamp: ts(0), Count: 5, Splits: []HistogramSplit{{Key: "FTP", Count: 1}, {Key: "SFTP", Count: 4}}},
+		{Timestamp: ts(7 * 24 * time.Hour), Count: 1, Splits: []HistogramSplit{{Key: "FTP", Count: 1}}},
+		{Timestamp: ts(14 * 24 * time.Hour), Count: 0},
+	}, result.Buckets)
+
+	logResult, err := s.HistogramLogEvents(&LogEventFilters{LogEventSearch: eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: ts(0),
+			EndTimestamp:   ts(3*time.Hour - 1),
+		},
+	}}, HistogramOptions{Interval: HistogramIntervalHour, SplitBy: "event"})
+	assert.NoError(t, err)
+	assert.Equal(t, []HistogramBucket{
+		{Timestamp: ts(0), Count: 0},
+		{Timestamp: ts(time.Hour), Count: 2, Splits: []HistogramSplit{{Key: int64(1), Count: 2}}},
+		{Timestamp: ts(2 * time.Hour), Count: 0},
+	}, logResult.Buckets)
+	assert.Nil(t, logResult.MessageSearch)
+	// NULL values are a distinct split
+	err = sess.Model(&logEvents[1]).Update("instance_id", gorm.Expr("NULL")).Error
+	assert.NoError(t, err)
+	logResult, err = s.HistogramLogEvents(&LogEventFilters{LogEventSearch: eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: ts(time.Hour),
+			EndTimestamp:   ts(2*time.Hour - 1),
+		},
+	}}, HistogramOptions{Interval: HistogramIntervalHour, SplitBy: "instance_id"})
+	if assert.NoError(t, err) && assert.Len(t, logResult.Buckets, 1) {
+		assert.Equal(t, int64(2), logResult.Buckets[0].Count)
+		assert.ElementsMatch(t, []HistogramSplit{{Key: "", Count: 1}, {Key: nil, Count: 1}},
+			logResult.Buckets[0].Splits)
+	}
+	logResult, err = s.HistogramLogEvents(&LogEventFilters{LogEventSearch: eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: ts(0),
+			EndTimestamp:   ts(3*time.Hour - 1),
+		},
+	}, Message: "message"}, HistogramOptions{Interval: HistogramIntervalHour})
+	if assert.NoError(t, err) && assert.NotNil(t, logResult.MessageSearch) {
+		assert.Equal(t, MessageSearchLike, logResult.MessageSearch.Strategy)
+		assert.Zero(t, logResult.MessageSearch.BoundedStartTimestamp)
+	}
+	_, err = s.HistogramLogEvents(&LogEventFilters{LogEventSearch: eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: ts(-30 * 24 * time.Hour),
+			EndTimestamp:   ts(3*time.Hour - 1),
+		},
+	}, Message: "message"}, HistogramOptions{Interval: HistogramIntervalDay})
+	assert.ErrorIs(t, err, errMessageScanRange)
+
+	providerResult, err := s.HistogramProviderEvents(&ProviderEventFilters{ProviderEventSearch: eventsearcher.ProviderEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: ts(0),
+			EndTimestamp:   ts(2*time.Hour - 1),
+		},
+	}}, HistogramOptions{Interval: HistogramIntervalHour})
+	assert.NoError(t, err)
+	assert.Equal(t, []HistogramBucket{
+		{Timestamp: ts(0), Count: 0},
+		{Timestamp: ts(time.Hour), Count: 1},
+	}, providerResult.Buckets)
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&logEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&providerEvents).Error
+	assert.NoError(t, err)
+}
@@ -0,0 +1,272 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+)
+
+// Supported field change types
+const (
+	FieldAdded   = "added"
+	FieldRemoved = "removed"
+	FieldChanged = "changed"
+)
+
+const providerActionDelete = "delete"
+
+// ObjectHistoryQuery identifies the object to return the history for
+type ObjectHistoryQuery struct {
+	ObjectType     string
+	ObjectName     string
+	StartTimestamp int64
+	EndTimestamp   int64
+	// Fields restricts the changes to the given JSON paths, see JSONFilter,
+	// and to the nested ones. Revisions without matching changes are omitted
+	Fields []string
+	// FromID is the cursor returned in the previous page
+	FromID string
+	Limit  int
+	// IncludeObjectData returns the object data for each revision too
+	IncludeObjectData bool
+	Enrichment        EnrichmentOptions
+}
+
+// FieldChange defines a changed field. Path uses the JSONFilter syntax.
+// Nested objects are compared field by field, arrays as a whole
+type FieldChange struct {
+	Path     string `json:"path"`
+	Change   string `json:"change"`
+	OldValue any    `json:"old_value,omitempty"`
+	NewValue any    `json:"new_value,omitempty"`
+}
+
+// ObjectRevision is a provider event and the changes from the previous
+// snapshot of the same object. Delete events remove all the fields
+type ObjectRevision struct {
+	ProviderEvent
+	Changes []FieldChange `json:"changes"`
+}
+
+// GetObjectHistory returns the provider events for an object, in ascending
+// order, with the changes from the previous snapshot
+func (s *Searcher) GetObjectHistory(query ObjectHistoryQuery) (*Page[ObjectRevision], error) {
+	if query.ObjectType == "" || query.ObjectName == "" {
+		return nil, errors.New("the object type and name are required")
+	}
+	fields := make([][]string, 0, len(query.Fields))
+	for _, field := range query.Fields {
+		segments, err := parseJSONPath(field)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, segments)
+	}
+	filters := &ProviderEventFilters{
+		ProviderEventSearch: eventsearcher.ProviderEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				StartTimestamp: query.StartTimestamp,
+				EndTimestamp:   query.EndTimestamp,
+				FromID:         query.FromID,
+				Limit:          query.Limit,
+				Order:          1,
+			},
+			ObjectName:  query.ObjectName,
+			ObjectTypes: []string{query.ObjectType},
+		},
+		Enrichment: query.Enrichment,
+	}
+	if filters.Limit > 0 {
+		filters.Limit++
+	}
+	events, err := s.searchProviderEvents(filters)
+	if err != nil {
+		return nil, err
+	}
+	page := newPage(events, query.Limit, func(ev *ProviderEvent) (int64, string) {
+		return ev.Timestamp, ev.ID
+	})
+	result := &Page[ObjectRevision]{
+		Events:     []ObjectRevision{},
+		HasMore:    page.HasMore,
+		NextCursor: page.NextCursor,
+	}
+	if len(page.Events) == 0 {
+		return result, nil
+	}
+	previous, err := s.getPreviousSnapshot(&page.Events[0])
+	if err != nil {
+		return nil, err
+	}
+	for idx := range page.Events {
+		ev := page.Events[idx]
+		current := decodeObjectData(ev.ObjectData)
+		if ev.Action == providerActionDelete {
+			current = nil
+		}
+		changes := filterFieldChanges(diffObjectData(nil, previous, current), fields)
+		previous = current
+		if len(fields) > 0 && len(changes) == 0 {
+			continue
+		}
+		if query.IncludeObjectData {
+			ev.ObjectData = redactObjectData(ev.ObjectData)
+		} else {
+			ev.ObjectData = nil
+		}
+		redactFieldChanges(changes)
+		result.Events = append(result.Events, ObjectRevision{
+			ProviderEvent: ev,
+			Changes:       formatFieldChanges(changes),
+		})
+	}
+	return result, nil
+}
+
+// getPreviousSnapshot returns the object data before the given event, nil if
+// the object did not exist
+func (s *Searcher) getPreviousSnapshot(ev *ProviderEvent) (map[string]any, error) {
+	events, err := s.searchProviderEvents(&ProviderEventFilters{
+		ProviderEventSearch: eventsearcher.ProviderEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				FromID: encodeCursor(ev.Timestamp, ev.ID),
+				Limit:  1,
+			},
+			ObjectName:  ev.ObjectName,
+			ObjectTypes: []string{ev.ObjectType},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 || events[0].Action == providerActionDelete {
+		return nil, nil
+	}
+	return decodeObjectData(events[0].ObjectData), nil
+}
+
+// decodeObjectData returns the JSON object data, data that is not a JSON
+// object is handled as an empty object
+func decodeObjectData(data []byte) map[string]any {
+	var result map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil
+	}
+	return result
+}
+
+// fieldChange is a FieldChange with the path as segments
+type fieldChange struct {
+	path     []string
+	change   string
+	oldValue any
+	newValue any
+}
+
+// diffObjectData returns the changes between two objects sorted by path
+func diffObjectData(path []string, oldData, newData map[string]any) []fieldChange {
+	keys := make([]string, 0, len(oldData)+len(newData))
+	for key := range oldData {
+		keys = append(keys, key)
+	}
+	for key := range newData {
+		if _, ok := oldData[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	var changes []fieldChange
+	for _, key := range keys {
+		keyPath := append(slices.Clone(path), key)
+		oldValue, inOld := oldData[key]
+		newValue, inNew := newData[key]
+		switch {
+		case !inOld:
+			changes = append(changes, fieldChange{path: keyPath, change: FieldAdded, newValue: newValue})
+		case !inNew:
+			changes = append(changes, fieldChange{path: keyPath, change: FieldRemoved, oldValue: oldValue})
+		default:
+			oldObject, oldIsObject := oldValue.(map[string]any)
+			newObject, newIsObject := newValue.(map[string]any)
+			if oldIsObject && newIsObject {
+				changes = append(changes, diffObjectData(keyPath, oldObject, newObject)...)
+			} else if !reflect.DeepEqual(oldValue, newValue) {
+				changes = append(changes, fieldChange{
+					path:     keyPath,
+					change:   FieldChanged,
+					oldValue: oldValue,
+					newValue: newValue,
+				})
+			}
+		}
+	}
+	return changes
+}
+
+// filterFieldChanges returns the changes to the given fields, to their nested
+// fields or to their parents, for example a new filesystem object matches the
+// filesystem.provider field
+func filterFieldChanges(changes []fieldChange, fields [][]string) []fieldChange {
+	if len(fields) == 0 {
+		return changes
+	}
+	var result []fieldChange
+	for _, change := range changes {
+		for _, field := range fields {
+			n := min(len(field), len(change.path))
+			if slices.Equal(field[:n], change.path[:n]) {
+				result = append(result, change)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func formatFieldChanges(changes []fieldChange) []FieldChange {
+	result := make([]FieldChange, 0, len(changes))
+	for _, change := range changes {
+		result = append(result, FieldChange{
+			Path:     formatJSONPath(change.path),
+			Change:   change.change,
+			OldValue: change.oldValue,
+			NewValue: change.newValue,
+		})
+	}
+	return result
+}
+
+// formatJSONPath is the inverse of parseJSONPath, segments are quoted if
+// required
+func formatJSONPath(segments []string) string {
+	quoted := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		if segment == "" || strings.ContainsAny(segment, ". \t\n=!<>") {
+			segment = `"` + segment + `"`
+		}
+		quoted = append(quoted, segment)
+	}
+	return strings.Join(quoted, ".")
+}
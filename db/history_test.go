@@ -0,0 +1,145 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffObjectData(t *testing.T) {
+	oldData := decodeObjectData([]byte(`{"status":1,"home_dir":"/srv/a","permissions":{"/":["*"]},` +
+		`"filesystem":{"provider":0},"description":"d"}`))
+	newData := decodeObjectData([]byte(`{"status":1,"home_dir":"/srv/b","permissions":{"/":["list"],"/sub":["*"]},` +
+		`"filesystem":{"provider":1,"s3config":{"bucket":"b"}}}`))
+	changes := formatFieldChanges(diffObjectData(nil, oldData, newData))
+	assert.Equal(t, []FieldChange{
+		{Path: "description", Change: FieldRemoved, OldValue: "d"},
+		{Path: "filesystem.provider", Change: FieldChanged, OldValue: json.Number("0"), NewValue: json.Number("1")},
+		{Path: "filesystem.s3config", Change: FieldAdded, NewValue: map[string]any{"bucket": "b"}},
+		{Path: "home_dir", Change: FieldChanged, OldValue: "/srv/a", NewValue: "/srv/b"},
+		{Path: `permissions./`, Change: FieldChanged, OldValue: []any{"*"}, NewValue: []any{"list"}},
+		{Path: `permissions./sub`, Change: FieldAdded, NewValue: []any{"*"}},
+	}, changes)
+	filtered := filterFieldChanges(diffObjectData(nil, oldData, newData), [][]string{
+		{"home_dir"}, {"filesystem", "s3config", "bucket"},
+	})
+	assert.Equal(t, []string{"filesystem.s3config", "home_dir"}, []string{
+		formatJSONPath(filtered[0].path), formatJSONPath(filtered[1].path),
+	})
+	assert.Len(t, diffObjectData(nil, oldData, oldData), 0)
+	assert.Len(t, diffObjectData(nil, nil, decodeObjectData([]byte(`[1]`))), 0)
+	assert.Equal(t, `a."b.c"."d e"`, formatJSONPath([]string{"a", "b.c", "d e"}))
+	segments, err := parseJSONPath(formatJSONPath([]string{"a", "b.c", "d e"}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b.c", "d e"}, segments)
+}
+
+func TestObjectHistory(t *testing.T) {
+	newProviderEvent := func(timestamp int64, action, name, data string) ProviderEvent {
+		return ProviderEvent{
+			ID:         xid.New().String(),
+			Timestamp:  timestamp,
+			Action:     action,
+			Username:   "admin",
+			ObjectType: "user",
+			ObjectName: name,
+			ObjectData: []byte(data),
+		}
+	}
+	providerEvents := []ProviderEvent{
+		newProviderEvent(1400, "add", "history", `{"home_dir":"/srv/a","status":1}`),
+		newProviderEvent(1401, "update", "history", `{"home_dir":"/srv/a","status":0}`),
+		newProviderEvent(1402, "update", "other", `{"home_dir":"/srv/c","status":0}`),
+		newProviderEvent(1403, "update", "history", `{"home_dir":"/srv/b","status":0}`),
+		newProviderEvent(1404, "delete", "history", `{"home_dir":"/srv/b","status":0}`),
+		newProviderEvent(1405, "add", "history", `{"home_dir":"/srv/b"}`),
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&providerEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	page, err := s.GetObjectHistory(ObjectHistoryQuery{
+		ObjectType: "user",
+		ObjectName: "history",
+		Limit:      10,
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Events, 5) {
+		assert.Equal(t, []FieldChange{
+			{Path: "home_dir", Change: FieldAdded, NewValue: "/srv/a"},
+			{Path: "status", Change: FieldAdded, NewValue: json.Number("1")},
+		}, page.Events[0].Changes)
+		assert.Nil(t, page.Events[0].ObjectData)
+		assert.Equal(t, []FieldChange{
+			{Path: "status", Change: FieldChanged, OldValue: json.Number("1"), NewValue: json.Number("0")},
+		}, page.Events[1].Changes)
+		assert.Equal(t, providerEvents[3].ID, page.Events[2].ID)
+		assert.Len(t, page.Events[3].Changes, 2)
+		assert.Equal(t, FieldRemoved, page.Events[3].Changes[0].Change)
+		assert.Equal(t, []FieldChange{
+			{Path: "home_dir", Change: FieldAdded, NewValue: "/srv/b"},
+		}, page.Events[4].Changes)
+	}
+	assert.False(t, page.HasMore)
+
+	page, err = s.GetObjectHistory(ObjectHistoryQuery{
+		ObjectType:        "user",
+		ObjectName:        "history",
+		Fields:            []string{"home_dir"},
+		StartTimestamp:    1401,
+		Limit:             2,
+		IncludeObjectData: true,
+	})
+	assert.NoError(t, err)
+	assert.True(t, page.HasMore)
+	if assert.Len(t, page.Events, 1) {
+		assert.Equal(t, providerEvents[3].ID, page.Events[0].ID)
+		assert.NotEmpty(t, page.Events[0].ObjectData)
+		assert.Equal(t, []FieldChange{
+			{Path: "home_dir", Change: FieldChanged, OldValue: "/srv/a", NewValue: "/srv/b"},
+		}, page.Events[0].Changes)
+	}
+	page, err = s.GetObjectHistory(ObjectHistoryQuery{
+		ObjectType: "user",
+		ObjectName: "history",
+		FromID:     page.NextCursor,
+		Limit:      2,
+	})
+	assert.NoError(t, err)
+	assert.False(t, page.HasMore)
+	if assert.Len(t, page.Events, 2) {
+		assert.Equal(t, providerEvents[4].ID, page.Events[0].ID)
+		assert.Equal(t, providerEvents[5].ID, page.Events[1].ID)
+	}
+
+	_, err = s.GetObjectHistory(ObjectHistoryQuery{ObjectType: "user", Limit: 10})
+	assert.Error(t, err)
+	_, err = s.GetObjectHistory(ObjectHistoryQuery{ObjectType: "user", ObjectName: "history", Limit: 10,
+		Fields: []string{"a..b"}})
+	assert.Error(t, err)
+	_, err = s.GetObjectHistory(ObjectHistoryQuery{ObjectType: "user", ObjectName: "history"})
+	assert.Error(t, err)
+
+	err = sess.Delete(&providerEvents).Error
+	assert.NoError(t, err)
+}
@@ -0,0 +1,392 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/logger"
+)
+
+// Supported JSON filter operators
+const (
+	JSONOperatorEqual          = "="
+	JSONOperatorNotEqual       = "!="
+	JSONOperatorLess           = "<"
+	JSONOperatorLessOrEqual    = "<="
+	JSONOperatorGreater        = ">"
+	JSONOperatorGreaterOrEqual = ">="
+	// JSONOperatorContains matches arrays containing the value
+	JSONOperatorContains = "contains"
+	// JSONOperatorExists matches if the path exists, no value is required
+	JSONOperatorExists = "exists"
+)
+
+const (
+	jsonKindString = "string"
+	jsonKindNumber = "number"
+	jsonKindBool   = "bool"
+	jsonKindNull   = "null"
+)
+
+// jsonOperators are sorted so that the longest operators are matched first
+var jsonOperators = []string{
+	JSONOperatorNotEqual, JSONOperatorLessOrEqual, JSONOperatorGreaterOrEqual, JSONOperatorEqual,
+	JSONOperatorLess, JSONOperatorGreater, JSONOperatorContains, JSONOperatorExists,
+}
+
+// JSONFilter defines a predicate on the object data of provider events. A
+// predicate only matches if the value at the given path exists and has the
+// same JSON type as the filter value
+type JSONFilter struct {
+	// Path is a dot separated path, for example filesystem.provider. Segments
+	// can be double quoted, for example permissions."/", and numeric segments
+	// are array indexes
+	Path string
+	// Operator is one of =, !=, <, <=, >, >=, contains and exists. Ordering
+	// operators are only supported for numbers
+	Operator string
+	// Value is a string, a number, a boolean or nil for JSON null
+	Value any
+}
+
+// ParseJSONFilter parses a predicate such as `status = 0`,
+// `permissions./ contains "*"` or `filesystem.provider = 1`. The value must
+// be a JSON string, number, boolean or null
+func ParseJSONFilter(expression string) (JSONFilter, error) {
+	expression = strings.TrimSpace(expression)
+	end := 0
+	inQuotes := false
+	for ; end < len(expression); end++ {
+		c := expression[end]
+		if c == '"' {
+			inQuotes = !inQuotes
+		}
+		if !inQuotes && (unicode.IsSpace(rune(c)) || strings.IndexByte("=!<>", c) >= 0) {
+			break
+		}
+	}
+	filter := JSONFilter{
+		Path: expression[:end],
+	}
+	rest := strings.TrimSpace(expression[end:])
+	for _, operator := range jsonOperators {
+		if len(rest) < len(operator) || !strings.EqualFold(rest[:len(operator)], operator) {
+			continue
+		}
+		if unicode.IsLetter(rune(operator[0])) && len(rest) > len(operator) &&
+			!unicode.IsSpace(rune(rest[len(operator)])) {
+			continue
+		}
+		filter.Operator = operator
+		rest = strings.TrimSpace(rest[len(operator):])
+		break
+	}
+	if filter.Operator == "" {
+		return filter, fmt.Errorf("invalid JSON filter %q: missing or unsupported operator", expression)
+	}
+	if filter.Operator != JSONOperatorExists {
+		decoder := json.NewDecoder(strings.NewReader(rest))
+		decoder.UseNumber()
+		if err := decoder.Decode(&filter.Value); err != nil {
+			return filter, fmt.Errorf("invalid JSON filter %q: the value must be a JSON scalar", expression)
+		}
+		if decoder.More() {
+			return filter, fmt.Errorf("invalid JSON filter %q: unexpected data after the value", expression)
+		}
+	} else if rest != "" {
+		return filter, fmt.Errorf("invalid JSON filter %q: %s does not require a value", expression, filter.Operator)
+	}
+	if err := filter.validate(); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+func (f *JSONFilter) validate() error {
+	segments, err := parseJSONPath(f.Path)
+	if err != nil {
+		return err
+	}
+	// filtering on masked values would allow to guess them
+	if isWithinRedactedPath(getRedactedPaths(), segments) {
+		return fmt.Errorf("invalid JSON filter on %q: the path is redacted", f.Path)
+	}
+	switch f.Operator {
+	case JSONOperatorExists:
+		return nil
+	case JSONOperatorEqual, JSONOperatorNotEqual, JSONOperatorContains:
+	case JSONOperatorLess, JSONOperatorLessOrEqual, JSONOperatorGreater, JSONOperatorGreaterOrEqual:
+		if _, kind, err := getJSONFilterValue(f.Value); err == nil && kind != jsonKindNumber {
+			return fmt.Errorf("invalid JSON filter on %q: operator %q requires a number", f.Path, f.Operator)
+		}
+	default:
+		return fmt.Errorf("invalid JSON filter on %q: unsupported operator %q", f.Path, f.Operator)
+	}
+	_, kind, err := getJSONFilterValue(f.Value)
+	if err != nil {
+		return fmt.Errorf("invalid JSON filter on %q: %w", f.Path, err)
+	}
+	if kind == jsonKindNull && f.Operator == JSONOperatorContains {
+		return fmt.Errorf("invalid JSON filter on %q: contains requires a non null value", f.Path)
+	}
+	return nil
+}
+
+// parseJSONPath splits a path in its segments
+func parseJSONPath(path string) ([]string, error) {
+	if path == "" {
+		return nil, errors.New("the JSON filter path is required")
+	}
+	var segments []string
+	for path != "" {
+		var segment string
+		if path[0] == '"' {
+			end := strings.IndexByte(path[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: unterminated quoted segment", path)
+			}
+			segment, path = path[1:end+1], path[end+2:]
+			if path != "" && path[0] != '.' {
+				return nil, fmt.Errorf("invalid JSON path %q: a dot is required after a quoted segment", path)
+			}
+		} else {
+			end := strings.IndexByte(path, '.')
+			if end < 0 {
+				end = len(path)
+			}
+			segment, path = path[:end], path[end:]
+		}
+		if segment == "" || strings.ContainsAny(segment, `"\`) {
+			return nil, fmt.Errorf("invalid JSON path segment %q", segment)
+		}
+		segments = append(segments, segment)
+		path = strings.TrimPrefix(path, ".")
+	}
+	return segments, nil
+}
+
+// getJSONFilterValue returns the normalized value and its JSON kind
+func getJSONFilterValue(value any) (any, string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, jsonKindNull, nil
+	case string:
+		return v, jsonKindString, nil
+	case bool:
+		return v, jsonKindBool, nil
+	case json.Number:
+		f, err := v.Float64()
+		return f, jsonKindNumber, err
+	case float64:
+		return v, jsonKindNumber, nil
+	case float32:
+		return float64(v), jsonKindNumber, nil
+	case int:
+		return float64(v), jsonKindNumber, nil
+	case int32:
+		return float64(v), jsonKindNumber, nil
+	case int64:
+		return float64(v), jsonKindNumber, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported value type %T", value)
+	}
+}
+
+// getJSONPathExpression returns the MySQL/SQLite path for the given segments
+func getJSONPathExpression(segments []string) string {
+	var sb bytes.Buffer
+	sb.WriteString("$")
+	for _, segment := range segments {
+		if _, err := strconv.ParseUint(segment, 10, 32); err == nil {
+			sb.WriteString("[" + segment + "]")
+			continue
+		}
+		sb.WriteString(`."` + segment + `"`)
+	}
+	return sb.String()
+}
+
+// jsonValidationCache caches whether PostgreSQL can check if the object data
+// is valid JSON before casting it
+type jsonValidationCache struct {
+	sync.Mutex
+	checked   bool
+	supported bool
+}
+
+// canValidateJSON returns true if pg_input_is_valid, added in PostgreSQL 16,
+// is available
+func (b *gormBackend) canValidateJSON(ctx context.Context) bool {
+	b.jsonValidation.Lock()
+	defer b.jsonValidation.Unlock()
+
+	if b.jsonValidation.checked {
+		return b.jsonValidation.supported
+	}
+	var version int
+	err := b.getSession(ctx).Raw(`SELECT current_setting('server_version_num')::int`).Scan(&version).Error
+	if err != nil {
+		logger.AppLogger.Warn("unable to get the PostgreSQL version", "error", err)
+		return false
+	}
+	b.jsonValidation.checked = true
+	b.jsonValidation.supported = version >= 160000
+	if !b.jsonValidation.supported {
+		logger.AppLogger.Warn("PostgreSQL 16 or later is required to skip invalid JSON object data, object data "+
+			"filters fail if a provider event has invalid object data", "version", version)
+	}
+	return b.jsonValidation.supported
+}
+
+// getJSONCondition returns the condition for an already validated JSON filter,
+// it is false, never NULL, if the filter does not match or the object data is
+// not valid JSON
+func (b *gormBackend) getJSONCondition(ctx context.Context, filter *JSONFilter) (string, []any) {
+	segments, _ := parseJSONPath(filter.Path)
+	value, kind, _ := getJSONFilterValue(filter.Value)
+
+	switch b.driver {
+	case driverNamePostgreSQL:
+		condition, args := getPostgreSQLJSONCondition(filter.Operator, segments, value, kind)
+		if b.canValidateJSON(ctx) {
+			// CASE evaluates the condition, and so the cast, only for valid
+			// documents
+			condition = fmt.Sprintf("CASE WHEN pg_input_is_valid(convert_from(object_data, 'UTF8'), 'jsonb') "+
+				"THEN %s ELSE FALSE END", condition)
+		}
+		return condition, args
+	case driverNameSQLite:
+		return getSQLiteJSONCondition(filter.Operator, segments, value, kind)
+	default:
+		return getMySQLJSONCondition(filter.Operator, segments, value, kind)
+	}
+}
+
+func getPostgreSQLJSONCondition(operator string, segments []string, value any, kind string) (string, []any) {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(segments)), ", ")
+	target := fmt.Sprintf("(NULLIF(convert_from(object_data, 'UTF8'), '')::jsonb #> ARRAY[%s]::text[])", placeholders)
+	var pathArgs []any
+	for _, segment := range segments {
+		pathArgs = append(pathArgs, segment)
+	}
+	// every reference to target requires the path arguments
+	withPath := func(args ...any) []any {
+		return append(append([]any{}, pathArgs...), args...)
+	}
+	text := target + " #>> '{}'"
+
+	switch {
+	case operator == JSONOperatorExists:
+		return target + " IS NOT NULL", withPath()
+	case operator == JSONOperatorContains:
+		data, _ := json.Marshal([]any{value})
+		return fmt.Sprintf("CASE WHEN jsonb_typeof(%s) = 'array' THEN %s @> ?::jsonb ELSE FALSE END", target, target),
+			append(withPath(), withPath(string(data))...)
+	case kind == jsonKindNull:
+		return fmt.Sprintf("COALESCE(jsonb_typeof(%s) %s 'null', FALSE)", target, getSQLOperator(operator)), withPath()
+	}
+	var typeName, cast string
+	switch kind {
+	case jsonKindString:
+		typeName = "string"
+	case jsonKindBool:
+		typeName, cast = "boolean", "::boolean"
+	default:
+		typeName, cast = "number", "::numeric"
+	}
+	return fmt.Sprintf("CASE WHEN jsonb_typeof(%s) = '%s' THEN (%s)%s %s ? ELSE FALSE END", target, typeName, text,
+		cast, getSQLOperator(operator)), append(withPath(), withPath(value)...)
+}
+
+func getMySQLJSONCondition(operator string, segments []string, value any, kind string) (string, []any) {
+	path := getJSONPathExpression(segments)
+	doc := "CONVERT(object_data USING utf8mb4)"
+	target := fmt.Sprintf("JSON_EXTRACT(%s, ?)", doc)
+	typeExpr := fmt.Sprintf("JSON_TYPE(%s)", target)
+	invalid := fmt.Sprintf("WHEN COALESCE(JSON_VALID(%s), 0) = 0 THEN FALSE", doc)
+
+	switch {
+	case operator == JSONOperatorExists:
+		return fmt.Sprintf("CASE %s WHEN %s IS NOT NULL THEN TRUE ELSE FALSE END", invalid, target), []any{path}
+	case operator == JSONOperatorContains:
+		data, _ := json.Marshal([]any{value})
+		return fmt.Sprintf("CASE %s WHEN %s = 'ARRAY' THEN JSON_CONTAINS(%s, ?) ELSE FALSE END", invalid, typeExpr,
+			target), []any{path, path, string(data)}
+	case kind == jsonKindNull:
+		return fmt.Sprintf("CASE %s WHEN %s IS NULL THEN FALSE ELSE %s %s 'NULL' END", invalid, target, typeExpr,
+			getSQLOperator(operator)), []any{path, path}
+	}
+	var typeCondition, valueExpr string
+	switch kind {
+	case jsonKindString:
+		typeCondition, valueExpr = "= 'STRING'", fmt.Sprintf("JSON_UNQUOTE(%s)", target)
+	case jsonKindBool:
+		typeCondition, valueExpr = "= 'BOOLEAN'", fmt.Sprintf("JSON_UNQUOTE(%s)", target)
+		value = strconv.FormatBool(value.(bool))
+	default:
+		typeCondition = "IN ('INTEGER', 'UNSIGNED INTEGER', 'DOUBLE', 'DECIMAL')"
+		valueExpr = fmt.Sprintf("JSON_UNQUOTE(%s) + 0", target)
+	}
+	return fmt.Sprintf("CASE %s WHEN %s %s THEN %s %s ? ELSE FALSE END", invalid, typeExpr, typeCondition, valueExpr,
+		getSQLOperator(operator)), []any{path, path, value}
+}
+
+func getSQLiteJSONCondition(operator string, segments []string, value any, kind string) (string, []any) {
+	path := getJSONPathExpression(segments)
+	doc := "CAST(object_data AS TEXT)"
+	typeExpr := fmt.Sprintf("json_type(%s, ?)", doc)
+	invalid := fmt.Sprintf("WHEN NOT COALESCE(json_valid(%s), 0) THEN FALSE", doc)
+
+	switch {
+	case operator == JSONOperatorExists:
+		return fmt.Sprintf("CASE %s WHEN %s IS NOT NULL THEN TRUE ELSE FALSE END", invalid, typeExpr), []any{path}
+	case operator == JSONOperatorContains:
+		return fmt.Sprintf("CASE %s WHEN %s = 'array' THEN EXISTS (SELECT 1 FROM json_each(%s, ?) WHERE value = ?) "+
+			"ELSE FALSE END", invalid, typeExpr, doc), []any{path, path, value}
+	case kind == jsonKindNull:
+		return fmt.Sprintf("CASE %s WHEN %s IS NULL THEN FALSE ELSE %s %s 'null' END", invalid, typeExpr, typeExpr,
+			getSQLOperator(operator)), []any{path, path}
+	case kind == jsonKindBool:
+		if !value.(bool) {
+			value = "false"
+		} else {
+			value = "true"
+		}
+		return fmt.Sprintf("CASE %s WHEN %s IN ('true', 'false') THEN %s %s ? ELSE FALSE END", invalid, typeExpr,
+			typeExpr, getSQLOperator(operator)), []any{path, path, value}
+	}
+	typeCondition := "= 'text'"
+	if kind == jsonKindNumber {
+		typeCondition = "IN ('integer', 'real')"
+	}
+	return fmt.Sprintf("CASE %s WHEN %s %s THEN json_extract(%s, ?) %s ? ELSE FALSE END", invalid, typeExpr,
+		typeCondition, doc, getSQLOperator(operator)), []any{path, path, value}
+}
+
+func getSQLOperator(operator string) string {
+	if operator == JSONOperatorNotEqual {
+		return "<>"
+	}
+	return operator
+}
@@ -0,0 +1,172 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJSONFilter(t *testing.T) {
+	filter, err := ParseJSONFilter(`permissions./ contains "*"`)
+	assert.NoError(t, err)
+	assert.Equal(t, JSONFilter{Path: "permissions./", Operator: JSONOperatorContains, Value: "*"}, filter)
+	filter, err = ParseJSONFilter(`filesystem.provider>=1`)
+	assert.NoError(t, err)
+	assert.Equal(t, JSONFilter{Path: "filesystem.provider", Operator: JSONOperatorGreaterOrEqual,
+		Value: json.Number("1")}, filter)
+	filter, err = ParseJSONFilter(`"a b"."c.d" EXISTS`)
+	assert.NoError(t, err)
+	assert.Equal(t, JSONOperatorExists, filter.Operator)
+	segments, err := parseJSONPath(filter.Path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a b", "c.d"}, segments)
+	filter, err = ParseJSONFilter(`description != null`)
+	assert.NoError(t, err)
+	assert.Nil(t, filter.Value)
+
+	for _, expression := range []string{
+		``, `status`, `status ~ 1`, `status = `, `status = abc`, `status = 1 2`, `status exists 1`,
+		`username > "a"`, `tags contains null`, `status = [1]`, `a..b = 1`, `"a = 1`, `"a"b = 1`, `status contains1`,
+		// redacted paths and their children
+		`password = "$2a$10$hash"`, `public_keys contains "ssh-ed25519 AAAA"`, `filters.totp_config.secret exists`,
+		`filters.totp_config.secret.payload > 1`, `virtual_folders.0.filesystem.gcsconfig.credentials.payload = "c"`,
+	} {
+		_, err = ParseJSONFilter(expression)
+		assert.Error(t, err, expression)
+	}
+	assert.Equal(t, `$."permissions"."/"`, getJSONPathExpression([]string{"permissions", "/"}))
+	assert.Equal(t, `$."public_keys"[0]`, getJSONPathExpression([]string{"public_keys", "0"}))
+
+	filter = JSONFilter{Path: "filesystem.provider", Operator: JSONOperatorEqual, Value: 1}
+	b := &gormBackend{driver: driverNamePostgreSQL}
+	b.jsonValidation.checked = true
+	condition, args := b.getJSONCondition(context.Background(), &filter)
+	target := "(NULLIF(convert_from(object_data, 'UTF8'), '')::jsonb #> ARRAY[?, ?]::text[])"
+	expected := "CASE WHEN jsonb_typeof(" + target + ") = 'number' THEN (" + target +
+		" #>> '{}')::numeric = ? ELSE FALSE END"
+	assert.Equal(t, expected, condition)
+	assert.Equal(t, []any{"filesystem", "provider", "filesystem", "provider", float64(1)}, args)
+	b.jsonValidation.supported = true
+	condition, args = b.getJSONCondition(context.Background(), &filter)
+	assert.Equal(t, "CASE WHEN pg_input_is_valid(convert_from(object_data, 'UTF8'), 'jsonb') THEN "+expected+
+		" ELSE FALSE END", condition)
+	assert.Equal(t, []any{"filesystem", "provider", "filesystem", "provider", float64(1)}, args)
+	b.driver = driverNameMySQL
+	condition, args = b.getJSONCondition(context.Background(), &JSONFilter{Path: "status", Operator: JSONOperatorNotEqual, Value: true})
+	assert.Equal(t, "CASE WHEN COALESCE(JSON_VALID(CONVERT(object_data USING utf8mb4)), 0) = 0 THEN FALSE "+
+		"WHEN JSON_TYPE(JSON_EXTRACT(CONVERT(object_data USING utf8mb4), ?)) = 'BOOLEAN' THEN "+
+		"JSON_UNQUOTE(JSON_EXTRACT(CONVERT(object_data USING utf8mb4), ?)) <> ? ELSE FALSE END", condition)
+	assert.Equal(t, []any{`$."status"`, `$."status"`, "true"}, args)
+}
+
+func TestSearchObjectData(t *testing.T) {
+	newProviderEvent := func(name, data string) ProviderEvent {
+		return ProviderEvent{
+			ID:         xid.New().String(),
+			Timestamp:  1300,
+			Action:     "update",
+			Username:   "admin",
+			ObjectType: "user",
+			ObjectName: name,
+			ObjectData: []byte(data),
+		}
+	}
+	providerEvents := []ProviderEvent{
+		newProviderEvent("u1", `{"status":1,"permissions":{"/":["*"]},"filesystem":{"provider":1},`+
+			`"public_keys":["k1"],"description":"first"}`),
+		newProviderEvent("u2", `{"status":0,"permissions":{"/":["list","download"]},"filesystem":{"provider":0},`+
+			`"description":null}`),
+		newProviderEvent("u3", `{"status":1.5,"enabled":true,"permissions":{"/":"*"}}`),
+		newProviderEvent("u4", `invalid json`),
+		newProviderEvent("u5", ``),
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&providerEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	search := func(expressions ...string) []string {
+		filters := &ProviderEventFilters{
+			ProviderEventSearch: eventsearcher.ProviderEventSearch{
+				CommonSearchParams: eventsearcher.CommonSearchParams{
+					StartTimestamp: 1300,
+					EndTimestamp:   1300,
+					Limit:          10,
+					Order:          1,
+				},
+			},
+		}
+		for _, expression := range expressions {
+			filter, err := ParseJSONFilter(expression)
+			if !assert.NoError(t, err) {
+				return nil
+			}
+			filters.ObjectData = append(filters.ObjectData, filter)
+		}
+		events, err := s.searchProviderEvents(filters)
+		assert.NoError(t, err)
+		var names []string
+		for _, ev := range events {
+			names = append(names, ev.ObjectName)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"u2"}, search(`status = 0`))
+	assert.Equal(t, []string{"u1", "u3"}, search(`status != 0`))
+	assert.Equal(t, []string{"u3"}, search(`status > 1`))
+	assert.Equal(t, []string{"u1", "u3"}, search(`status >= 1`))
+	assert.Equal(t, []string{"u1"}, search(`permissions./ contains "*"`))
+	assert.Equal(t, []string{"u3"}, search(`permissions./ = "*"`))
+	assert.Equal(t, []string{"u1"}, search(`filesystem.provider = 1`))
+	// redacted values cannot be filtered
+	err = (&ProviderEventFilters{
+		ObjectData: []JSONFilter{{Path: "public_keys.0", Operator: JSONOperatorEqual, Value: "k1"}},
+	}).validate()
+	assert.ErrorContains(t, err, "redacted")
+	err = SetRedactedPaths(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u1"}, search(`public_keys.0 = "k1"`))
+	err = SetRedactedPaths(DefaultRedactedPaths)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u1", "u2"}, search(`description exists`))
+	assert.Equal(t, []string{"u2"}, search(`description = null`))
+	assert.Equal(t, []string{"u1"}, search(`description != null`))
+	assert.Equal(t, []string{"u3"}, search(`enabled = true`))
+	assert.Len(t, search(`enabled = false`), 0)
+	assert.Equal(t, []string{"u2"}, search(`permissions./ contains "list"`, `status < 1`))
+
+	_, err = s.SearchProviderEventsPage(&ProviderEventFilters{
+		ProviderEventSearch: eventsearcher.ProviderEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				Limit: 10,
+			},
+		},
+		ObjectData: []JSONFilter{{Path: "status", Operator: "like", Value: "1"}},
+	}, CountOptions{})
+	assert.Error(t, err)
+
+	err = sess.Delete(&providerEvents).Error
+	assert.NoError(t, err)
+}
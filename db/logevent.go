@@ -25,6 +25,9 @@ type LogEvent struct {
 	Message    string `json:"message,omitempty"`
 	Role       string `json:"role,omitempty"`
 	InstanceID string `json:"instance_id,omitempty"`
+	// TimestampISO and EventName are only set if the enrichment is enabled
+	TimestampISO string `json:"timestamp_iso,omitempty" gorm:"-"`
+	EventName    string `json:"event_name,omitempty" gorm:"-"`
 }
 
 // TableName defines the database table name
@@ -0,0 +1,177 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	gosqlite "github.com/glebarez/go-sqlite"
+	"gorm.io/gorm"
+)
+
+// pgIPRegexp matches the strings that can be safely cast to inet. SFTPGo
+// always stores valid addresses, this guard avoids failing the whole query if
+// the column contains something else, for example an empty string
+const pgIPRegexp = `^([0-9]{1,3}[.]){3}[0-9]{1,3}$|^[0-9A-Fa-f]*:[0-9A-Fa-f:.]+$`
+
+func init() {
+	// inet6_aton mirrors the MySQL function, so the same SQL can be used for
+	// both drivers
+	gosqlite.MustRegisterDeterministicScalarFunction("inet6_aton", 1,
+		func(_ *gosqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			value, ok := args[0].(string)
+			if !ok {
+				return nil, nil
+			}
+			addr, err := netip.ParseAddr(value)
+			if err != nil || addr.Zone() != "" {
+				return nil, nil
+			}
+			return addr.AsSlice(), nil
+		})
+}
+
+// ipNetwork is a parsed network filter. For CIDRs and single addresses prefix
+// is valid, first and last are the first and the last address in any case
+type ipNetwork struct {
+	prefix netip.Prefix
+	first  netip.Addr
+	last   netip.Addr
+}
+
+func parseNetwork(value string) (ipNetwork, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return ipNetwork{}, fmt.Errorf("invalid network %q: %w", value, err)
+		}
+		prefix = prefix.Masked()
+		return ipNetwork{
+			prefix: prefix,
+			first:  prefix.Addr(),
+			last:   getLastAddr(prefix),
+		}, nil
+	}
+	if first, last, ok := strings.Cut(value, "-"); ok {
+		firstAddr, err := parseAddr(strings.TrimSpace(first))
+		if err != nil {
+			return ipNetwork{}, fmt.Errorf("invalid network %q: %w", value, err)
+		}
+		lastAddr, err := parseAddr(strings.TrimSpace(last))
+		if err != nil {
+			return ipNetwork{}, fmt.Errorf("invalid network %q: %w", value, err)
+		}
+		if firstAddr.BitLen() != lastAddr.BitLen() {
+			return ipNetwork{}, fmt.Errorf("invalid network %q: mixed IPv4 and IPv6 addresses", value)
+		}
+		if lastAddr.Less(firstAddr) {
+			return ipNetwork{}, fmt.Errorf("invalid network %q: the last address is lower than the first one", value)
+		}
+		return ipNetwork{
+			first: firstAddr,
+			last:  lastAddr,
+		}, nil
+	}
+	addr, err := parseAddr(value)
+	if err != nil {
+		return ipNetwork{}, fmt.Errorf("invalid network %q: %w", value, err)
+	}
+	return ipNetwork{
+		prefix: netip.PrefixFrom(addr, addr.BitLen()),
+		first:  addr,
+		last:   addr,
+	}, nil
+}
+
+func parseNetworks(values []string) ([]ipNetwork, error) {
+	var networks []ipNetwork
+	for _, value := range values {
+		network, err := parseNetwork(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func parseAddr(value string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return addr, err
+	}
+	if addr.Zone() != "" {
+		return addr, fmt.Errorf("IPv6 zones are not supported")
+	}
+	return addr, nil
+}
+
+// getLastAddr returns the last address within a masked prefix
+func getLastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(b)*8; bit++ {
+		b[bit/8] |= 1 << (7 - bit%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func (b *gormBackend) applyNetworkFilters(sess *gorm.DB, filters *NetworkFilters) *gorm.DB {
+	if len(filters.Networks) > 0 {
+		condition, args := b.getNetworkCondition(filters.Networks)
+		sess = sess.Where(condition, args...)
+	}
+	if len(filters.ExcludeNetworks) > 0 {
+		condition, args := b.getNetworkCondition(filters.ExcludeNetworks)
+		sess = sess.Where("NOT "+condition, args...)
+	}
+	return sess
+}
+
+// getNetworkCondition returns a condition that is true if the ip column is
+// within any of the given, already validated, networks and false, never NULL,
+// otherwise
+func (b *gormBackend) getNetworkCondition(values []string) (string, []any) {
+	networks, _ := parseNetworks(values)
+	var conditions []string
+	var args []any
+
+	switch b.driver {
+	case driverNamePostgreSQL:
+		for _, network := range networks {
+			if network.prefix.IsValid() {
+				conditions = append(conditions, "ip::inet <<= ?::inet")
+				args = append(args, network.prefix.String())
+			} else {
+				conditions = append(conditions, "ip::inet BETWEEN ?::inet AND ?::inet")
+				args = append(args, network.first.String(), network.last.String())
+			}
+		}
+		return fmt.Sprintf("(CASE WHEN ip ~ '%s' THEN (%s) ELSE FALSE END)", pgIPRegexp,
+			strings.Join(conditions, " OR ")), args
+	default:
+		// INET6_ATON returns 4 bytes for IPv4 and 16 bytes for IPv6 addresses
+		// in network byte order, so they can be compared as binary strings
+		for _, network := range networks {
+			conditions = append(conditions, "(LENGTH(INET6_ATON(ip)) = ? AND INET6_ATON(ip) BETWEEN ? AND ?)")
+			args = append(args, network.first.BitLen()/8, network.first.AsSlice(), network.last.AsSlice())
+		}
+		return fmt.Sprintf("(COALESCE(%s, 0) = 1)", strings.Join(conditions, " OR ")), args
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNetwork(t *testing.T) {
+	network, err := parseNetwork("10.20.30.40/16")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.20.0.0/16", network.prefix.String())
+	assert.Equal(t, "10.20.0.0", network.first.String())
+	assert.Equal(t, "10.20.255.255", network.last.String())
+
+	network, err = parseNetwork("2001:db8::/33")
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::", network.first.String())
+	assert.Equal(t, "2001:db8:7fff:ffff:ffff:ffff:ffff:ffff", network.last.String())
+
+	network, err = parseNetwork(" 192.168.1.10 - 192.168.1.20 ")
+	assert.NoError(t, err)
+	assert.False(t, network.prefix.IsValid())
+	assert.Equal(t, "192.168.1.10", network.first.String())
+	assert.Equal(t, "192.168.1.20", network.last.String())
+
+	network, err = parseNetwork("::1")
+	assert.NoError(t, err)
+	assert.Equal(t, "::1/128", network.prefix.String())
+
+	for _, value := range []string{"", "10.0.0.0/33", "10.0.0.2-10.0.0.1", "10.0.0.1-::2", "fe80::1%eth0",
+		"10.0.0.1-", "host.example.com"} {
+		_, err = parseNetwork(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestSearchNetworks(t *testing.T) {
+	ips := []string{"10.20.1.1", "10.20.255.254", "10.21.0.1", "192.168.1.15", "2001:db8::1", "2001:db9::1",
+		"::ffff:10.20.0.1", ""}
+	var fsEvents []FsEvent
+	var providerEvents []ProviderEvent
+	var logEvents []LogEvent
+	for _, ip := range ips {
+		fsEvents = append(fsEvents, FsEvent{
+			ID:        xid.New().String(),
+			Timestamp: 700,
+			Action:    "upload",
+			Username:  "user",
+			Protocol:  "SFTP",
+			IP:        ip,
+		})
+		providerEvents = append(providerEvents, ProviderEvent{
+			ID:         xid.New().String(),
+			Timestamp:  700,
+			Action:     "update",
+			Username:   "admin",
+			IP:         ip,
+			ObjectType: "user",
+			ObjectName: "user",
+		})
+		logEvents = append(logEvents, LogEvent{
+			ID:        xid.New().String(),
+			Timestamp: 700,
+			Event:     1,
+			Protocol:  "SSH",
+			IP:        ip,
+		})
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&providerEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&logEvents).Error
+	assert.NoError(t, err)
+
+	params := eventsearcher.CommonSearchParams{
+		StartTimestamp: 700,
+		EndTimestamp:   700,
+		Limit:          100,
+		Order:          1,
+	}
+	s := Searcher{}
+	search := func(networks NetworkFilters) []string {
+		fsPage, err := s.SearchFsEventsPage(&FsEventFilters{
+			FsEventSearch: eventsearcher.FsEventSearch{
+				CommonSearchParams: params,
+				FsProvider:         -1,
+			},
+			NetworkFilters: networks,
+		}, CountOptions{Mode: CountNone})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		var results []string
+		for _, ev := range fsPage.Events {
+			results = append(results, ev.IP)
+		}
+		// all the event types must return the same results
+		providerPage, err := s.SearchProviderEventsPage(&ProviderEventFilters{
+			ProviderEventSearch: eventsearcher.ProviderEventSearch{
+				CommonSearchParams: params,
+			},
+			NetworkFilters: networks,
+		}, CountOptions{Mode: CountNone})
+		if assert.NoError(t, err) && assert.Len(t, providerPage.Events, len(results)) {
+			for idx, ev := range providerPage.Events {
+				assert.Equal(t, results[idx], ev.IP)
+			}
+		}
+		logPage, err := s.SearchLogEventsPage(&LogEventFilters{
+			LogEventSearch: eventsearcher.LogEventSearch{
+				CommonSearchParams: params,
+			},
+			NetworkFilters: networks,
+		}, CountOptions{Mode: CountNone})
+		if assert.NoError(t, err) && assert.Len(t, logPage.Events, len(results)) {
+			for idx, ev := range logPage.Events {
+				assert.Equal(t, results[idx], ev.IP)
+			}
+		}
+		return results
+	}
+
+	assert.ElementsMatch(t, []string{"10.20.1.1", "10.20.255.254"},
+		search(NetworkFilters{Networks: []string{"10.20.0.0/16"}}))
+	assert.ElementsMatch(t, []string{"10.20.1.1", "10.20.255.254", "192.168.1.15", "2001:db8::1"},
+		search(NetworkFilters{Networks: []string{"10.20.0.0/16", "192.168.1.10-192.168.1.20", "2001:db8::/32"}}))
+	assert.ElementsMatch(t, []string{"2001:db8::1"}, search(NetworkFilters{Networks: []string{"2001:DB8::1"}}))
+	assert.ElementsMatch(t, []string{"::ffff:10.20.0.1"}, search(NetworkFilters{Networks: []string{"::ffff:0:0/96"}}))
+	assert.Len(t, search(NetworkFilters{Networks: []string{"192.168.1.16-192.168.1.20"}}), 0)
+	// events without an IP address are not excluded
+	assert.ElementsMatch(t, []string{"10.21.0.1", "192.168.1.15", "2001:db9::1", "::ffff:10.20.0.1", ""},
+		search(NetworkFilters{ExcludeNetworks: []string{"10.20.0.0/16", "2001:db8::/32"}}))
+	assert.ElementsMatch(t, []string{"10.21.0.1"},
+		search(NetworkFilters{Networks: []string{"10.0.0.0/8"}, ExcludeNetworks: []string{"10.20.0.0/16"}}))
+
+	_, err = s.SearchLogEventsPage(&LogEventFilters{
+		LogEventSearch: eventsearcher.LogEventSearch{
+			CommonSearchParams: params,
+		},
+		NetworkFilters: NetworkFilters{ExcludeNetworks: []string{"10.0.0.0/40"}},
+	}, CountOptions{})
+	assert.Error(t, err)
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&providerEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&logEvents).Error
+	assert.NoError(t, err)
+}
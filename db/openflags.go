@@ -0,0 +1,166 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// accessModeMask selects the access mode, O_RDONLY, O_WRONLY or O_RDWR, from
+// the open flags
+const accessModeMask = 0x3
+
+type openFlag struct {
+	name  string
+	value int
+}
+
+// openFlags are the Linux open flags as stored by SFTPGo. Flags including
+// other ones, such as O_SYNC that includes O_DSYNC, must be listed first
+var openFlags = []openFlag{
+	{"O_WRONLY", 0x1},
+	{"O_RDWR", 0x2},
+	{"O_CREAT", 0x40},
+	{"O_EXCL", 0x80},
+	{"O_NOCTTY", 0x100},
+	{"O_TRUNC", 0x200},
+	{"O_APPEND", 0x400},
+	{"O_NONBLOCK", 0x800},
+	{"O_SYNC", 0x101000},
+	{"O_DSYNC", 0x1000},
+	{"O_ASYNC", 0x2000},
+	{"O_DIRECT", 0x4000},
+	{"O_LARGEFILE", 0x8000},
+	{"O_DIRECTORY", 0x10000},
+	{"O_NOFOLLOW", 0x20000},
+	{"O_NOATIME", 0x40000},
+	{"O_CLOEXEC", 0x80000},
+}
+
+// OpenFlagsFilter defines a bitmask filter on the open flags. O_RDONLY is
+// zero, to match read-only opens use O_WRONLY|O_RDWR as NotSet
+type OpenFlagsFilter struct {
+	// Set defines the flags that must be set
+	Set int
+	// NotSet defines the flags that must not be set
+	NotSet int
+}
+
+func (f *OpenFlagsFilter) validate() error {
+	if f.Set < 0 || f.NotSet < 0 {
+		return fmt.Errorf("invalid open flags filter, negative values are not allowed")
+	}
+	if f.Set&f.NotSet != 0 {
+		return fmt.Errorf("invalid open flags filter, the flags %#x cannot be both set and not set", f.Set&f.NotSet)
+	}
+	return nil
+}
+
+// DecodeOpenFlags returns the symbolic names for the given open flags, for
+// example 0x241 is decoded as O_WRONLY, O_CREAT, O_TRUNC. Unknown bits are
+// returned as an hex number
+func DecodeOpenFlags(flags int) []string {
+	var names []string
+	if flags&accessModeMask == 0 {
+		names = append(names, "O_RDONLY")
+	}
+	for _, flag := range openFlags {
+		if flags&flag.value == flag.value {
+			names = append(names, flag.name)
+			flags &^= flag.value
+		}
+	}
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("%#x", flags))
+	}
+	return names
+}
+
+// ParseOpenFlags parses open flags separated by "|" or ",", for example
+// O_WRONLY|O_APPEND. Names are case-insensitive and the O_ prefix is
+// optional, numbers are accepted too
+func ParseOpenFlags(value string) (int, error) {
+	flags, _, err := parseOpenFlags(value)
+	return flags, err
+}
+
+// getOpenFlagsMask returns the mask and the masked value matching the given
+// open flags. O_RDONLY is zero, it requires the access mode bits to be unset
+func getOpenFlagsMask(value string) (int, int, error) {
+	flags, readOnly, err := parseOpenFlags(value)
+	if err != nil {
+		return 0, 0, err
+	}
+	if readOnly {
+		if flags&accessModeMask != 0 {
+			return 0, 0, fmt.Errorf("invalid open flags %q, O_RDONLY conflicts with O_WRONLY and O_RDWR", value)
+		}
+		return flags | accessModeMask, flags, nil
+	}
+	return flags, flags, nil
+}
+
+func parseOpenFlags(value string) (int, bool, error) {
+	var result int
+	var readOnly bool
+	fields := strings.FieldsFunc(value, func(r rune) bool { return r == '|' || r == ',' })
+	if len(fields) == 0 {
+		return 0, false, fmt.Errorf("invalid open flags %q", value)
+	}
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if n, err := strconv.ParseInt(field, 0, 32); err == nil && n >= 0 {
+			result |= int(n)
+			continue
+		}
+		name := strings.ToUpper(field)
+		if !strings.HasPrefix(name, "O_") {
+			name = "O_" + name
+		}
+		if name == "O_RDONLY" {
+			readOnly = true
+			continue
+		}
+		flag, ok := getOpenFlag(name)
+		if !ok {
+			return 0, false, fmt.Errorf("unknown open flag %q", field)
+		}
+		result |= flag
+	}
+	return result, readOnly, nil
+}
+
+func getOpenFlag(name string) (int, bool) {
+	for _, flag := range openFlags {
+		if flag.name == name {
+			return flag.value, true
+		}
+	}
+	return 0, false
+}
+
+func applyOpenFlagsFilter(sess *gorm.DB, filter OpenFlagsFilter) *gorm.DB {
+	if filter.Set != 0 {
+		sess = sess.Where("(open_flags & ?) = ?", filter.Set, filter.Set)
+	}
+	if filter.NotSet != 0 {
+		sess = sess.Where("(open_flags & ?) = 0", filter.NotSet)
+	}
+	return sess
+}
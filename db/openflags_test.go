@@ -0,0 +1,130 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeOpenFlags(t *testing.T) {
+	assert.Equal(t, []string{"O_RDONLY", "O_TRUNC"}, DecodeOpenFlags(512))
+	assert.Equal(t, []string{"O_WRONLY", "O_CREAT", "O_TRUNC"}, DecodeOpenFlags(0x241))
+	assert.Equal(t, []string{"O_RDWR", "O_APPEND", "O_SYNC"}, DecodeOpenFlags(0x101402))
+	assert.Equal(t, []string{"O_WRONLY", "O_DSYNC", "0x4000000"}, DecodeOpenFlags(0x4001001))
+	assert.Equal(t, []string{"O_RDONLY"}, DecodeOpenFlags(0))
+
+	flags, err := ParseOpenFlags("O_WRONLY|o_creat, TRUNC")
+	assert.NoError(t, err)
+	assert.Equal(t, 0x241, flags)
+	flags, err = ParseOpenFlags("0x400|1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0x401, flags)
+	_, err = ParseOpenFlags("O_UNKNOWN")
+	assert.Error(t, err)
+	_, err = ParseOpenFlags("")
+	assert.Error(t, err)
+
+	mask, value, err := getOpenFlagsMask("O_RDONLY|O_TRUNC")
+	assert.NoError(t, err)
+	assert.Equal(t, 0x203, mask)
+	assert.Equal(t, 0x200, value)
+	_, _, err = getOpenFlagsMask("O_RDONLY|O_RDWR")
+	assert.Error(t, err)
+
+	assert.Error(t, (&OpenFlagsFilter{Set: 0x200, NotSet: 0x201}).validate())
+	assert.Error(t, (&OpenFlagsFilter{Set: -1}).validate())
+}
+
+func TestSearchOpenFlags(t *testing.T) {
+	newFsEvent := func(action string, flags int) FsEvent {
+		return FsEvent{
+			ID:        xid.New().String(),
+			Timestamp: 1200,
+			Action:    action,
+			Username:  "user",
+			Protocol:  "SFTP",
+			OpenFlags: flags,
+		}
+	}
+	fsEvents := []FsEvent{
+		newFsEvent("upload", 0x241),
+		newFsEvent("upload", 0x441),
+		newFsEvent("upload", 0x442),
+		newFsEvent("download", 0),
+		newFsEvent("download", 0x200),
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	searchFs := func(filters FsEventFilters) []FsEvent {
+		filters.StartTimestamp = 1200
+		filters.EndTimestamp = 1200
+		filters.Limit = 100
+		filters.Order = 1
+		filters.FsProvider = -1
+		page, err := s.SearchFsEventsPage(&filters, CountOptions{Mode: CountNone})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return page.Events
+	}
+	getIDs := func(events []FsEvent) []string {
+		var ids []string
+		for _, ev := range events {
+			ids = append(ids, ev.ID)
+		}
+		return ids
+	}
+
+	// opened with truncate
+	assert.ElementsMatch(t, []string{fsEvents[0].ID, fsEvents[4].ID},
+		getIDs(searchFs(FsEventFilters{OpenFlags: OpenFlagsFilter{Set: 0x200}})))
+	// append-mode uploads
+	assert.ElementsMatch(t, []string{fsEvents[1].ID, fsEvents[2].ID}, getIDs(searchFs(FsEventFilters{
+		FsEventSearch: eventsearcher.FsEventSearch{Actions: []string{"upload"}},
+		OpenFlags:     OpenFlagsFilter{Set: 0x400},
+	})))
+	// read-only opens
+	assert.ElementsMatch(t, []string{fsEvents[3].ID, fsEvents[4].ID},
+		getIDs(searchFs(FsEventFilters{OpenFlags: OpenFlagsFilter{NotSet: 0x3}})))
+	assert.ElementsMatch(t, []string{fsEvents[1].ID},
+		getIDs(searchFs(FsEventFilters{OpenFlags: OpenFlagsFilter{Set: 0x401, NotSet: 0x2}})))
+	assert.ElementsMatch(t, []string{fsEvents[4].ID},
+		getIDs(searchFs(FsEventFilters{Query: "open_flags:O_RDONLY|O_TRUNC"})))
+	assert.ElementsMatch(t, []string{fsEvents[0].ID, fsEvents[2].ID, fsEvents[3].ID, fsEvents[4].ID},
+		getIDs(searchFs(FsEventFilters{Query: "NOT open_flags:(wronly,append)"})))
+
+	events := searchFs(FsEventFilters{DecodeOpenFlags: true})
+	if assert.Len(t, events, 5) {
+		assert.Equal(t, []string{"O_WRONLY", "O_CREAT", "O_TRUNC"}, events[0].OpenFlagNames)
+		assert.Equal(t, []string{"O_RDONLY"}, events[3].OpenFlagNames)
+	}
+	events = searchFs(FsEventFilters{})
+	if assert.Len(t, events, 5) {
+		assert.Nil(t, events[0].OpenFlagNames)
+	}
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Supported path match modes
+const (
+	// PathMatchExact matches the given path exactly
+	PathMatchExact = "exact"
+	// PathMatchPrefix matches the given directory and everything below it
+	PathMatchPrefix = "prefix"
+	// PathMatchGlob matches a pattern where "*" matches any sequence of
+	// characters, including "/", and "?" matches a single character
+	PathMatchGlob = "glob"
+)
+
+// likeEscape is the escape character used in LIKE patterns, a backslash
+// is not used to avoid any dependency on the MySQL SQL mode
+const likeEscape = '!'
+
+// pathFields are the columns that can be used in path filters
+var pathFields = []string{"virtual_path", "virtual_target_path", "fs_path", "fs_target_path"}
+
+// PathFilter defines a filter on the paths of filesystem events
+type PathFilter struct {
+	// Field is the path to match: virtual_path, virtual_target_path, fs_path,
+	// fs_target_path. If empty both virtual_path and virtual_target_path are
+	// matched, so renames to and from the path are included
+	Field string
+	// Mode is the match mode: exact, prefix or glob. Default exact
+	Mode string
+	// Value is the path or the pattern to match
+	Value string
+	// CaseInsensitive enables case-insensitive matching. For case-sensitive
+	// matching MySQL/MariaDB uses the column collation, it is usually
+	// case-insensitive too
+	CaseInsensitive bool
+}
+
+func (f *PathFilter) validate() error {
+	if f.Value == "" {
+		return errors.New("path filter value is required")
+	}
+	switch f.Mode {
+	case "", PathMatchExact, PathMatchPrefix, PathMatchGlob:
+	default:
+		return fmt.Errorf("unsupported path match mode %q", f.Mode)
+	}
+	if f.Field != "" {
+		for _, field := range pathFields {
+			if f.Field == field {
+				return nil
+			}
+		}
+		return fmt.Errorf("unsupported path field %q, allowed fields: %s", f.Field, strings.Join(pathFields, ", "))
+	}
+	return nil
+}
+
+func (f *PathFilter) getFields() []string {
+	if f.Field != "" {
+		return []string{f.Field}
+	}
+	return []string{"virtual_path", "virtual_target_path"}
+}
+
+// patternToken is a literal string or a wildcard
+type patternToken struct {
+	literal string
+	// wildcard is '*' for any sequence of characters and '?' for a single
+	// character, zero for literals
+	wildcard byte
+}
+
+type pathPattern []patternToken
+
+func parseGlob(value string) pathPattern {
+	var pattern pathPattern
+	var sb strings.Builder
+	for _, r := range value {
+		if r == '*' || r == '?' {
+			if sb.Len() > 0 {
+				pattern = append(pattern, patternToken{literal: sb.String()})
+				sb.Reset()
+			}
+			pattern = append(pattern, patternToken{wildcard: byte(r)})
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	if sb.Len() > 0 {
+		pattern = append(pattern, patternToken{literal: sb.String()})
+	}
+	return pattern
+}
+
+// toLike converts the pattern to a LIKE pattern escaped using likeEscape
+func (p pathPattern) toLike() string {
+	var sb strings.Builder
+	for _, token := range p {
+		switch token.wildcard {
+		case '*':
+			sb.WriteByte('%')
+		case '?':
+			sb.WriteByte('_')
+		default:
+			for _, r := range token.literal {
+				if r == '%' || r == '_' || r == likeEscape {
+					sb.WriteRune(likeEscape)
+				}
+				sb.WriteRune(r)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// toGlob converts the pattern to a case-sensitive SQLite GLOB pattern
+func (p pathPattern) toGlob() string {
+	var sb strings.Builder
+	for _, token := range p {
+		if token.wildcard != 0 {
+			sb.WriteByte(token.wildcard)
+			continue
+		}
+		for _, r := range token.literal {
+			switch r {
+			case '*', '?', '[':
+				sb.WriteByte('[')
+				sb.WriteRune(r)
+				sb.WriteByte(']')
+			default:
+				sb.WriteRune(r)
+			}
+		}
+	}
+	return sb.String()
+}
+
+// getPathCondition returns the SQL condition for a validated path filter
+func (b *gormBackend) getPathCondition(filter *PathFilter) (string, []any) {
+	var conditions []string
+	var args []any
+
+	for _, field := range filter.getFields() {
+		switch filter.Mode {
+		case PathMatchPrefix:
+			// a prefix matches the directory itself and its contents
+			dir := strings.TrimSuffix(filter.Value, "/")
+			exact, exactArgs := b.getEqualCondition(field, dir, filter.CaseInsensitive)
+			pattern := pathPattern{{literal: dir + "/"}, {wildcard: '*'}}
+			match, matchArgs := b.getPatternCondition(field, pattern, filter.CaseInsensitive)
+			conditions = append(conditions, exact, match)
+			args = append(args, exactArgs...)
+			args = append(args, matchArgs...)
+		case PathMatchGlob:
+			match, matchArgs := b.getPatternCondition(field, parseGlob(filter.Value), filter.CaseInsensitive)
+			conditions = append(conditions, match)
+			args = append(args, matchArgs...)
+		default:
+			exact, exactArgs := b.getEqualCondition(field, filter.Value, filter.CaseInsensitive)
+			conditions = append(conditions, exact)
+			args = append(args, exactArgs...)
+		}
+	}
+
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
+
+func (b *gormBackend) getEqualCondition(field, value string, caseInsensitive bool) (string, []any) {
+	if caseInsensitive {
+		return fmt.Sprintf("LOWER(%s) = LOWER(?)", field), []any{value}
+	}
+	return field + " = ?", []any{value}
+}
+
+func (b *gormBackend) getPatternCondition(field string, pattern pathPattern, caseInsensitive bool) (string, []any) {
+	switch b.driver {
+	case driverNamePostgreSQL:
+		if caseInsensitive {
+			return fmt.Sprintf("%s ILIKE ? ESCAPE '%c'", field, likeEscape), []any{pattern.toLike()}
+		}
+		return fmt.Sprintf("%s LIKE ? ESCAPE '%c'", field, likeEscape), []any{pattern.toLike()}
+	case driverNameSQLite:
+		// LIKE is case-insensitive in SQLite, GLOB is case-sensitive
+		if caseInsensitive {
+			return fmt.Sprintf("%s LIKE ? ESCAPE '%c'", field, likeEscape), []any{pattern.toLike()}
+		}
+		return field + " GLOB ?", []any{pattern.toGlob()}
+	default:
+		if caseInsensitive {
+			return fmt.Sprintf("LOWER(%s) LIKE LOWER(?) ESCAPE '%c'", field, likeEscape), []any{pattern.toLike()}
+		}
+		return fmt.Sprintf("%s LIKE ? ESCAPE '%c'", field, likeEscape), []any{pattern.toLike()}
+	}
+}
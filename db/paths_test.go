@@ -0,0 +1,127 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathPatterns(t *testing.T) {
+	pattern := parseGlob("/data/*_100%!/file?.[txt]")
+	assert.Equal(t, "/data/%!_100!%!!/file_.[txt]", pattern.toLike())
+	assert.Equal(t, "/data/*_100%!/file?.[[]txt]", pattern.toGlob())
+	assert.Len(t, parseGlob(""), 0)
+	assert.Equal(t, "%", parseGlob("*").toLike())
+
+	assert.Error(t, (&PathFilter{}).validate())
+	assert.Error(t, (&PathFilter{Value: "/", Mode: "regexp"}).validate())
+	assert.Error(t, (&PathFilter{Value: "/", Field: "ssh_cmd"}).validate())
+	assert.NoError(t, (&PathFilter{Value: "/", Field: "fs_target_path", Mode: PathMatchPrefix}).validate())
+}
+
+func TestSearchPaths(t *testing.T) {
+	newEvent := func(action, virtualPath, virtualTargetPath string) FsEvent {
+		return FsEvent{
+			ID:                xid.New().String(),
+			Timestamp:         600,
+			Action:            action,
+			Username:          "user",
+			Protocol:          "SFTP",
+			FsPath:            "/srv" + virtualPath,
+			VirtualPath:       virtualPath,
+			VirtualTargetPath: virtualTargetPath,
+		}
+	}
+	fsEvents := []FsEvent{
+		newEvent("upload", "/finance/2026", ""),
+		newEvent("upload", "/finance/2026/q1/report.PDF", ""),
+		newEvent("upload", "/finance/20261/report.pdf", ""),
+		newEvent("rename", "/tmp/draft.pdf", "/finance/2026/q2/report.pdf"),
+		newEvent("upload", "/Finance/2026/summary.txt", ""),
+		newEvent("upload", "/reports/100%_done.txt", ""),
+		newEvent("upload", "/reports/100a_done.txt", ""),
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	search := func(paths ...PathFilter) []string {
+		page, err := s.SearchFsEventsPage(&FsEventFilters{
+			FsEventSearch: eventsearcher.FsEventSearch{
+				CommonSearchParams: eventsearcher.CommonSearchParams{
+					StartTimestamp: 600,
+					EndTimestamp:   600,
+					Limit:          100,
+					Order:          1,
+				},
+				FsProvider: -1,
+			},
+			Paths: paths,
+		}, CountOptions{Mode: CountNone})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		var results []string
+		for _, ev := range page.Events {
+			results = append(results, ev.VirtualPath)
+		}
+		return results
+	}
+
+	assert.Equal(t, []string{"/finance/2026"}, search(PathFilter{Value: "/finance/2026"}))
+	assert.Equal(t, []string{"/finance/2026", "/finance/2026/q1/report.PDF", "/tmp/draft.pdf"},
+		search(PathFilter{Value: "/finance/2026/", Mode: PathMatchPrefix}))
+	assert.Equal(t, []string{"/finance/2026", "/finance/2026/q1/report.PDF"},
+		search(PathFilter{Value: "/finance/2026", Mode: PathMatchPrefix, Field: "virtual_path"}))
+	assert.Equal(t, []string{"/finance/2026", "/finance/2026/q1/report.PDF", "/tmp/draft.pdf",
+		"/Finance/2026/summary.txt"},
+		search(PathFilter{Value: "/FINANCE/2026", Mode: PathMatchPrefix, CaseInsensitive: true}))
+	assert.Equal(t, []string{"/finance/2026/q1/report.PDF", "/finance/20261/report.pdf"},
+		search(PathFilter{Value: "/srv/finance/*/report.pdf", Mode: PathMatchGlob, Field: "fs_path",
+			CaseInsensitive: true}))
+	assert.Equal(t, []string{"/finance/20261/report.pdf", "/tmp/draft.pdf"},
+		search(PathFilter{Value: "*.pdf", Mode: PathMatchGlob}))
+	// LIKE wildcards are matched literally
+	assert.Equal(t, []string{"/reports/100%_done.txt"},
+		search(PathFilter{Value: "/reports/100%_*", Mode: PathMatchGlob}))
+	assert.Equal(t, []string{"/reports/100%_done.txt", "/reports/100a_done.txt"},
+		search(PathFilter{Value: "/reports/100?_done.txt", Mode: PathMatchGlob}))
+	// all the filters must match
+	assert.Equal(t, []string{"/finance/2026/q1/report.PDF"},
+		search(PathFilter{Value: "/finance/2026", Mode: PathMatchPrefix, Field: "virtual_path"},
+			PathFilter{Value: "*.pdf", Mode: PathMatchGlob, CaseInsensitive: true, Field: "virtual_path"}))
+	assert.Len(t, search(PathFilter{Value: "/", Mode: PathMatchPrefix}), len(fsEvents))
+
+	_, err = s.SearchFsEventsPage(&FsEventFilters{
+		FsEventSearch: eventsearcher.FsEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				Limit: 100,
+			},
+		},
+		Paths: []PathFilter{{Value: "/", Mode: "invalid"}},
+	}, CountOptions{})
+	assert.Error(t, err)
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+}
@@ -26,6 +26,8 @@ type ProviderEvent struct {
 	ObjectData []byte `json:"object_data,omitempty"`
 	Role       string `json:"role,omitempty"`
 	InstanceID string `json:"instance_id,omitempty"`
+	// TimestampISO is only set if the enrichment is enabled
+	TimestampISO string `json:"timestamp_iso,omitempty" gorm:"-"`
 }
 
 // TableName defines the database table name
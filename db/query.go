@@ -0,0 +1,576 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxQueryDepth limits the nesting of parentheses and NOT operators
+const maxQueryDepth = 50
+
+// QueryError is returned for queries that cannot be parsed
+type QueryError struct {
+	// Position is the 1-based position, in characters, of the error
+	Position int
+	Message  string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("invalid query at position %d: %s", e.Position, e.Message)
+}
+
+type queryFieldType int
+
+const (
+	queryFieldString queryFieldType = iota
+	queryFieldInt
+	queryFieldSize
+	queryFieldElapsed
+	queryFieldTimestamp
+	queryFieldIP
+	queryFieldPath
+	queryFieldOpenFlags
+)
+
+// queryField maps a query field to a column. For path fields an empty column
+// means both virtual_path and virtual_target_path
+type queryField struct {
+	column    string
+	fieldType queryFieldType
+}
+
+func (f queryField) isNumeric() bool {
+	switch f.fieldType {
+	case queryFieldInt, queryFieldSize, queryFieldElapsed, queryFieldTimestamp:
+		return true
+	default:
+		return false
+	}
+}
+
+var (
+	fsEventQueryFields = map[string]queryField{
+		"timestamp":           {"timestamp", queryFieldTimestamp},
+		"action":              {"action", queryFieldString},
+		"username":            {"username", queryFieldString},
+		"user":                {"username", queryFieldString},
+		"path":                {"", queryFieldPath},
+		"virtual_path":        {"virtual_path", queryFieldPath},
+		"virtual_target_path": {"virtual_target_path", queryFieldPath},
+		"fs_path":             {"fs_path", queryFieldPath},
+		"fs_target_path":      {"fs_target_path", queryFieldPath},
+		"ssh_cmd":             {"ssh_cmd", queryFieldString},
+		"size":                {"file_size", queryFieldSize},
+		"file_size":           {"file_size", queryFieldSize},
+		"elapsed":             {"elapsed", queryFieldElapsed},
+		"status":              {"status", queryFieldInt},
+		"protocol":            {"protocol", queryFieldString},
+		"ip":                  {"ip", queryFieldIP},
+		"session_id":          {"session_id", queryFieldString},
+		"fs_provider":         {"fs_provider", queryFieldInt},
+		"open_flags":          {"open_flags", queryFieldOpenFlags},
+		"bucket":              {"bucket", queryFieldString},
+		"endpoint":            {"endpoint", queryFieldString},
+		"role":                {"role", queryFieldString},
+		"instance_id":         {"instance_id", queryFieldString},
+	}
+	providerEventQueryFields = map[string]queryField{
+		"timestamp":   {"timestamp", queryFieldTimestamp},
+		"action":      {"action", queryFieldString},
+		"username":    {"username", queryFieldString},
+		"user":        {"username", queryFieldString},
+		"ip":          {"ip", queryFieldIP},
+		"object_type": {"object_type", queryFieldString},
+		"object_name": {"object_name", queryFieldString},
+		"role":        {"role", queryFieldString},
+		"instance_id": {"instance_id", queryFieldString},
+	}
+	logEventQueryFields = map[string]queryField{
+		"timestamp":   {"timestamp", queryFieldTimestamp},
+		"event":       {"event", queryFieldInt},
+		"protocol":    {"protocol", queryFieldString},
+		"username":    {"username", queryFieldString},
+		"user":        {"username", queryFieldString},
+		"ip":          {"ip", queryFieldIP},
+		"message":     {"message", queryFieldString},
+		"role":        {"role", queryFieldString},
+		"instance_id": {"instance_id", queryFieldString},
+	}
+)
+
+type queryNodeKind int
+
+const (
+	queryNodeTerm queryNodeKind = iota
+	queryNodeAnd
+	queryNodeOr
+	queryNodeNot
+)
+
+// queryNode is a node of a parsed query, terms are the leaves
+type queryNode struct {
+	kind     queryNodeKind
+	children []*queryNode
+	term     queryTerm
+}
+
+// queryTerm is a comparison between a field and a value
+type queryTerm struct {
+	field    queryField
+	operator string
+	value    string
+	// number is the parsed value for numeric fields and the expected value
+	// of the masked bits for open flags
+	number int64
+	// mask is the bitmask for open flags
+	mask int64
+	// wildcard is true for unquoted values containing "*" or "?"
+	wildcard bool
+}
+
+// queryFieldRef is a field referenced in a query
+type queryFieldRef struct {
+	name  string
+	field queryField
+}
+
+// queryParser parses queries such as:
+//
+//	username:alice AND action:(upload OR rename) AND size>10MB AND path:/finance/*
+//
+// Terms are combined using AND, OR and NOT, in order of increasing precedence
+// OR, AND, NOT, and parentheses. Adjacent terms are combined using AND.
+// Unquoted values can contain the "*" and "?" wildcards, quoted values are
+// matched literally
+type queryParser struct {
+	input  string
+	pos    int
+	depth  int
+	fields map[string]queryField
+}
+
+func parseQuery(input string, fields map[string]queryField) (*queryNode, error) {
+	p := &queryParser{
+		input:  input,
+		fields: fields,
+	}
+	p.skipSpaces()
+	if p.eof() {
+		return nil, p.errorf(p.pos, "empty query")
+	}
+	node, err := p.parseOr(nil)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if !p.eof() {
+		return nil, p.errorf(p.pos, "unexpected %q", p.input[p.pos])
+	}
+	return node, nil
+}
+
+func (p *queryParser) errorf(pos int, format string, args ...any) error {
+	return &QueryError{
+		Position: utf8.RuneCountInString(p.input[:pos]) + 1,
+		Message:  fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *queryParser) eof() bool {
+	return p.pos >= len(p.input)
+}
+
+func (p *queryParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *queryParser) skipSpaces() {
+	for !p.eof() && isQuerySpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// isKeyword returns true if the input at the current position is the given
+// keyword, case-insensitive, followed by a space, a parenthesis or the end
+func (p *queryParser) isKeyword(keyword string) bool {
+	end := p.pos + len(keyword)
+	if end > len(p.input) || !strings.EqualFold(p.input[p.pos:end], keyword) {
+		return false
+	}
+	return end == len(p.input) || isQuerySpace(p.input[end]) || p.input[end] == '(' || p.input[end] == ')'
+}
+
+func (p *queryParser) acceptKeyword(keyword string) bool {
+	if p.isKeyword(keyword) {
+		p.pos += len(keyword)
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) parseOr(ref *queryFieldRef) (*queryNode, error) {
+	node, err := p.parseAnd(ref)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpaces()
+		if !p.acceptKeyword("OR") {
+			return node, nil
+		}
+		right, err := p.parseAnd(ref)
+		if err != nil {
+			return nil, err
+		}
+		node = joinQueryNodes(queryNodeOr, node, right)
+	}
+}
+
+func (p *queryParser) parseAnd(ref *queryFieldRef) (*queryNode, error) {
+	node, err := p.parseNot(ref)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpaces()
+		if p.eof() || p.peek() == ')' || p.isKeyword("OR") {
+			return node, nil
+		}
+		p.acceptKeyword("AND")
+		right, err := p.parseNot(ref)
+		if err != nil {
+			return nil, err
+		}
+		node = joinQueryNodes(queryNodeAnd, node, right)
+	}
+}
+
+func (p *queryParser) parseNot(ref *queryFieldRef) (*queryNode, error) {
+	p.skipSpaces()
+	start := p.pos
+	if !p.acceptKeyword("NOT") {
+		return p.parsePrimary(ref)
+	}
+	if p.depth >= maxQueryDepth {
+		return nil, p.errorf(start, "the query is too deeply nested")
+	}
+	p.depth++
+	child, err := p.parseNot(ref)
+	if err != nil {
+		return nil, err
+	}
+	p.depth--
+	return &queryNode{kind: queryNodeNot, children: []*queryNode{child}}, nil
+}
+
+func (p *queryParser) parsePrimary(ref *queryFieldRef) (*queryNode, error) {
+	p.skipSpaces()
+	if p.eof() {
+		return nil, p.errorf(p.pos, "unexpected end of query")
+	}
+	switch p.peek() {
+	case '(':
+		return p.parseGroup(ref)
+	case ')':
+		return nil, p.errorf(p.pos, "unexpected ')'")
+	}
+	if ref != nil {
+		// within field:(...) values without a field refer to that field
+		return p.parseValue(ref, ":")
+	}
+	return p.parseTerm()
+}
+
+func (p *queryParser) parseGroup(ref *queryFieldRef) (*queryNode, error) {
+	start := p.pos
+	if p.depth >= maxQueryDepth {
+		return nil, p.errorf(start, "the query is too deeply nested")
+	}
+	p.depth++
+	p.pos++
+	node, err := p.parseOr(ref)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.peek() != ')' {
+		return nil, p.errorf(start, "unclosed parenthesis")
+	}
+	p.pos++
+	p.depth--
+	return node, nil
+}
+
+func (p *queryParser) parseTerm() (*queryNode, error) {
+	start := p.pos
+	for !p.eof() && isQueryFieldChar(p.input[p.pos]) {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+	if name == "" {
+		return nil, p.errorf(start, "expected a field name")
+	}
+	operator := p.parseOperator()
+	if operator == "" {
+		return nil, p.errorf(p.pos, "expected ':', '>', '>=', '<' or '<=' after %q", name)
+	}
+	field, ok := p.fields[strings.ToLower(name)]
+	if !ok {
+		return nil, p.errorf(start, "unknown field %q, supported fields: %s", name, getQueryFieldNames(p.fields))
+	}
+	ref := &queryFieldRef{
+		name:  name,
+		field: field,
+	}
+	if operator == ":" && p.peek() == '(' {
+		return p.parseGroup(ref)
+	}
+	return p.parseValue(ref, operator)
+}
+
+func (p *queryParser) parseOperator() string {
+	for _, operator := range []string{">=", "<=", ":", ">", "<"} {
+		if strings.HasPrefix(p.input[p.pos:], operator) {
+			p.pos += len(operator)
+			return operator
+		}
+	}
+	return ""
+}
+
+func (p *queryParser) parseValue(ref *queryFieldRef, operator string) (*queryNode, error) {
+	start := p.pos
+	var value string
+	quoted := p.peek() == '"'
+	if quoted {
+		var err error
+		value, err = p.parseQuoted()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for !p.eof() && !isQuerySpace(p.input[p.pos]) && p.input[p.pos] != '(' && p.input[p.pos] != ')' {
+			p.pos++
+		}
+		value = p.input[start:p.pos]
+		if value == "" {
+			return nil, p.errorf(start, "missing value for field %q", ref.name)
+		}
+	}
+	term := queryTerm{
+		field:    ref.field,
+		operator: operator,
+		value:    value,
+		wildcard: !quoted && strings.ContainsAny(value, "*?"),
+	}
+	if err := validateQueryTerm(ref, &term); err != nil {
+		return nil, p.errorf(start, "%v", err)
+	}
+	return &queryNode{kind: queryNodeTerm, term: term}, nil
+}
+
+func (p *queryParser) parseQuoted() (string, error) {
+	start := p.pos
+	p.pos++
+	var sb strings.Builder
+	for !p.eof() {
+		c := p.input[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", p.errorf(start, "unterminated quoted value")
+			}
+			sb.WriteByte(p.input[p.pos])
+			p.pos++
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", p.errorf(start, "unterminated quoted value")
+}
+
+func validateQueryTerm(ref *queryFieldRef, term *queryTerm) error {
+	var err error
+
+	if !term.field.isNumeric() {
+		if term.operator != ":" {
+			return fmt.Errorf("operator %q is not supported for field %q", term.operator, ref.name)
+		}
+		switch term.field.fieldType {
+		case queryFieldIP:
+			if !term.wildcard {
+				_, err = parseNetwork(term.value)
+			}
+		case queryFieldPath:
+			err = (&PathFilter{Field: term.field.column, Value: term.value}).validate()
+		case queryFieldOpenFlags:
+			var mask, flags int
+			mask, flags, err = getOpenFlagsMask(term.value)
+			term.mask, term.number = int64(mask), int64(flags)
+		}
+		return err
+	}
+	switch term.field.fieldType {
+	case queryFieldSize:
+		term.number, err = ParseSize(term.value)
+	case queryFieldElapsed:
+		term.number, err = ParseElapsed(term.value)
+	case queryFieldTimestamp:
+		term.number, err = ParseTimestamp(term.value)
+	default:
+		term.number, err = strconv.ParseInt(term.value, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("invalid value %q for field %q, an integer is required", term.value, ref.name)
+		}
+	}
+	return err
+}
+
+func joinQueryNodes(kind queryNodeKind, left, right *queryNode) *queryNode {
+	if left.kind == kind {
+		left.children = append(left.children, right)
+		return left
+	}
+	return &queryNode{kind: kind, children: []*queryNode{left, right}}
+}
+
+func isQuerySpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isQueryFieldChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_'
+}
+
+func getQueryFieldNames(fields map[string]queryField) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// getQueryColumns returns the columns referenced in a validated query, path
+// fields without a column are omitted. It returns nil for an empty or invalid
+// query
+func getQueryColumns(query string, fields map[string]queryField) []string {
+	if query == "" {
+		return nil
+	}
+	node, err := parseQuery(query, fields)
+	if err != nil {
+		return nil
+	}
+	var columns []string
+	var walk func(*queryNode)
+	walk = func(node *queryNode) {
+		if node.kind == queryNodeTerm {
+			if node.term.field.column != "" {
+				columns = append(columns, node.term.field.column)
+			}
+			return
+		}
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+	walk(node)
+	return columns
+}
+
+// getQueryCondition returns the SQL condition for an already validated query,
+// values are always bound as parameters
+func (b *gormBackend) getQueryCondition(query string, fields map[string]queryField) (string, []any) {
+	node, err := parseQuery(query, fields)
+	if err != nil {
+		return "1 = 0", nil
+	}
+	return b.getQueryNodeCondition(node)
+}
+
+func (b *gormBackend) getQueryNodeCondition(node *queryNode) (string, []any) {
+	switch node.kind {
+	case queryNodeAnd, queryNodeOr:
+		separator := " AND "
+		if node.kind == queryNodeOr {
+			separator = " OR "
+		}
+		var conditions []string
+		var args []any
+		for _, child := range node.children {
+			condition, childArgs := b.getQueryNodeCondition(child)
+			conditions = append(conditions, condition)
+			args = append(args, childArgs...)
+		}
+		return "(" + strings.Join(conditions, separator) + ")", args
+	case queryNodeNot:
+		// like the exclusion filters, NOT matches the events with a NULL field
+		condition, args := b.getQueryNodeCondition(node.children[0])
+		return fmt.Sprintf("(NOT COALESCE(%s, FALSE))", condition), args
+	default:
+		return b.getQueryTermCondition(&node.term)
+	}
+}
+
+func (b *gormBackend) getQueryTermCondition(term *queryTerm) (string, []any) {
+	column := term.field.column
+
+	switch term.field.fieldType {
+	case queryFieldPath:
+		filter := PathFilter{
+			Field: column,
+			Value: term.value,
+		}
+		if term.wildcard {
+			filter.Mode = PathMatchGlob
+		}
+		return b.getPathCondition(&filter)
+	case queryFieldIP:
+		if term.wildcard {
+			return b.getPatternCondition(column, parseGlob(term.value), false)
+		}
+		network, _ := parseNetwork(term.value)
+		if network.first == network.last {
+			return column + " = ?", []any{network.first.String()}
+		}
+		return b.getNetworkCondition([]string{term.value})
+	case queryFieldString:
+		if term.wildcard {
+			return b.getPatternCondition(column, parseGlob(term.value), false)
+		}
+		return b.getEqualCondition(column, term.value, false)
+	case queryFieldOpenFlags:
+		// the open flags are matched if all the given flags are set
+		return fmt.Sprintf("(%s & ?) = ?", column), []any{term.mask, term.number}
+	default:
+		operator := term.operator
+		if operator == ":" {
+			operator = "="
+		}
+		return fmt.Sprintf("%s %s ?", column, operator), []any{term.number}
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQuery(t *testing.T) {
+	b := &gormBackend{driver: driverNamePostgreSQL}
+
+	node, err := parseQuery(`username:alice AND action:(upload OR rename) AND size>10MB AND path:/finance/*`,
+		fsEventQueryFields)
+	if assert.NoError(t, err) {
+		condition, args := b.getQueryNodeCondition(node)
+		assert.Equal(t, `(username = ? AND (action = ? OR action = ?) AND file_size > ? AND `+
+			`(virtual_path LIKE ? ESCAPE '!' OR virtual_target_path LIKE ? ESCAPE '!'))`, condition)
+		assert.Equal(t, []any{"alice", "upload", "rename", int64(10000000), "/finance/%", "/finance/%"}, args)
+	}
+	// NOT binds tighter than AND, AND tighter than OR, adjacent terms are ANDed
+	node, err = parseQuery(`not status:1 elapsed>=30s or user:"bob smith" ip:10.0.0.0/8`, fsEventQueryFields)
+	if assert.NoError(t, err) {
+		condition, args := b.getQueryNodeCondition(node)
+		assert.Equal(t, `(((NOT COALESCE(status = ?, FALSE)) AND elapsed >= ?) OR (username = ? AND `+
+			`(CASE WHEN ip ~ '`+pgIPRegexp+`' THEN (ip::inet <<= ?::inet) ELSE FALSE END)))`, condition)
+		assert.Equal(t, []any{int64(1), int64(30000), "bob smith", "10.0.0.0/8"}, args)
+	}
+	// values are never interpolated, quoted values are matched literally
+	node, err = parseQuery(`message:"it's a * \"test\"" OR message:*denied*`, logEventQueryFields)
+	if assert.NoError(t, err) {
+		condition, args := b.getQueryNodeCondition(node)
+		assert.Equal(t, `(message = ? OR message LIKE ? ESCAPE '!')`, condition)
+		assert.Equal(t, []any{`it's a * "test"`, "%denied%"}, args)
+	}
+	node, err = parseQuery(`timestamp>=2026-03-01T10:00:00.5Z ip:2001:DB8::1`, providerEventQueryFields)
+	if assert.NoError(t, err) {
+		condition, args := b.getQueryNodeCondition(node)
+		assert.Equal(t, `(timestamp >= ? AND ip = ?)`, condition)
+		assert.Equal(t, []any{int64(1772359200500000000), "2001:db8::1"}, args)
+	}
+	// integer seconds since the epoch
+	node, err = parseQuery(`timestamp<1772359200`, providerEventQueryFields)
+	if assert.NoError(t, err) {
+		condition, args := b.getQueryNodeCondition(node)
+		assert.Equal(t, `timestamp < ?`, condition)
+		assert.Equal(t, []any{int64(1772359200000000000)}, args)
+	}
+
+	for query, position := range map[string]int{
+		"":                                  1,
+		"username:alice AND":                19,
+		"username:alice )":                  16,
+		"(username:alice":                   1,
+		"username alice":                    9,
+		"usr:alice":                         1,
+		"username:":                         10,
+		"action:(upload OR )":               19,
+		"size>10XB":                         6,
+		"username>alice":                    10,
+		"status:ok":                         8,
+		`username:"alice`:                   10,
+		"ip:10.0.0.0/33":                    4,
+		"elapsed<1 AND ssh_cmd:x AND è:1":   29,
+		"timestamp>yesterday":               11,
+		"username:alice AND NOT NOT (((x))": 32,
+	} {
+		_, err = parseQuery(query, fsEventQueryFields)
+		var queryErr *QueryError
+		if assert.True(t, errors.As(err, &queryErr), query) {
+			assert.Equal(t, position, queryErr.Position, "%s: %v", query, err)
+		}
+	}
+	_, err = parseQuery("event:1", fsEventQueryFields)
+	assert.Error(t, err)
+	deep := ""
+	for i := 0; i <= maxQueryDepth; i++ {
+		deep += "("
+	}
+	_, err = parseQuery(deep+"status:1", fsEventQueryFields)
+	assert.ErrorContains(t, err, "nested")
+}
+
+func TestSearchQuery(t *testing.T) {
+	newFsEvent := func(username, action, virtualPath string, size, elapsed int64) FsEvent {
+		return FsEvent{
+			ID:          xid.New().String(),
+			Timestamp:   900,
+			Action:      action,
+			Username:    username,
+			Protocol:    "SFTP",
+			VirtualPath: virtualPath,
+			FileSize:    size,
+			Elapsed:     elapsed,
+			Status:      1,
+		}
+	}
+	fsEvents := []FsEvent{
+		newFsEvent("alice", "upload", "/finance/2026/q1.xlsx", 20000000, 1000),
+		newFsEvent("alice", "upload", "/finance/2026/small.txt", 100, 10),
+		newFsEvent("alice", "download", "/finance/2026/q1.xlsx", 20000000, 700000),
+		newFsEvent("bob", "upload", "/finance/2026/q2.xlsx", 30000000, 1000),
+		newFsEvent("alice", "upload", "/home/big.iso", 40000000, 1000),
+	}
+	logEvents := []LogEvent{
+		{ID: xid.New().String(), Timestamp: 900, Event: 1, Protocol: "SSH", Message: "Login failed: permission denied"},
+		{ID: xid.New().String(), Timestamp: 900, Event: 1, Protocol: "FTP", Message: "Login failed: no such user"},
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&logEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	searchFs := func(query string) []string {
+		page, err := s.SearchFsEventsPage(&FsEventFilters{
+			FsEventSearch: eventsearcher.FsEventSearch{
+				CommonSearchParams: eventsearcher.CommonSearchParams{
+					StartTimestamp: 900,
+					EndTimestamp:   900,
+					Limit:          100,
+				},
+				FsProvider: -1,
+			},
+			Query: query,
+		}, CountOptions{Mode: CountNone})
+		if !assert.NoError(t, err, query) {
+			return nil
+		}
+		var results []string
+		for _, ev := range page.Events {
+			results = append(results, ev.ID)
+		}
+		return results
+	}
+
+	assert.ElementsMatch(t, []string{fsEvents[0].ID},
+		searchFs(`username:alice AND action:(upload OR rename) AND size>10MB AND path:/finance/*`))
+	assert.ElementsMatch(t, []string{fsEvents[2].ID}, searchFs(`elapsed>10m`))
+	assert.ElementsMatch(t, []string{fsEvents[3].ID, fsEvents[4].ID}, searchFs(`user:bob OR path:*.iso`))
+	assert.ElementsMatch(t, []string{fsEvents[1].ID, fsEvents[3].ID},
+		searchFs(`NOT (user:alice AND size>=10MB)`))
+	assert.ElementsMatch(t, []string{fsEvents[0].ID, fsEvents[2].ID, fsEvents[3].ID},
+		searchFs(`path:/finance/2026/q?.xlsx`))
+
+	page, err := s.SearchLogEventsPage(&LogEventFilters{
+		LogEventSearch: eventsearcher.LogEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				StartTimestamp: 900,
+				EndTimestamp:   900,
+				Limit:          100,
+			},
+		},
+		Query: `event:1 AND message:*denied*`,
+	}, CountOptions{Mode: CountNone})
+	if assert.NoError(t, err) && assert.Len(t, page.Events, 1) {
+		assert.Equal(t, logEvents[0].ID, page.Events[0].ID)
+	}
+	_, err = s.SearchLogEventsPage(&LogEventFilters{
+		LogEventSearch: eventsearcher.LogEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				Limit: 100,
+			},
+		},
+		Query: `size>1`,
+	}, CountOptions{})
+	var queryErr *QueryError
+	assert.ErrorAs(t, err, &queryErr)
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&logEvents).Error
+	assert.NoError(t, err)
+}
+
+func TestParseUnits(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"500":     500,
+		"500B":    500,
+		"10MB":    10000000,
+		"1.5 GiB": 1610612736,
+		"2gb":     2000000000,
+		"1KiB":    1024,
+	} {
+		size, err := ParseSize(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, size, value)
+	}
+	for _, value := range []string{"", "MB", "1.2.3MB", "10XB", "-1MB", "10000000TB"} {
+		_, err := ParseSize(value)
+		assert.Error(t, err, value)
+	}
+	for value, expected := range map[string]int64{
+		"1500":  1500,
+		"30s":   30000,
+		"1h30m": 5400000,
+		"250ms": 250,
+		"1.5s":  1500,
+	} {
+		elapsed, err := ParseElapsed(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, elapsed, value)
+	}
+	for _, value := range []string{"", "-1", "-1s", "10 minutes"} {
+		_, err := ParseElapsed(value)
+		assert.Error(t, err, value)
+	}
+	ts, err := ParseTimestamp("2026-03-01T10:00:00.123456789+01:00")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1772355600123456789), ts)
+	ts, err = ParseTimestamp("1772355600123456789")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1772355600123456789), ts)
+	for value, expected := range map[string]int64{
+		"2026-03-01":                   1772323200000000000,
+		"2026-03-01 10:00:00.5":        1772359200500000000,
+		"2026-03-01T10:00:00.000001":   1772359200000001000,
+		"2026-03-01 11:00:00.25+01:00": 1772359200250000000,
+		"1772359200.5":                 1772359200500000000,
+		"1772359200.000000001":         1772359200000000001,
+		"1700000000.0":                 1700000000000000000,
+		"1700000000":                   1700000000000000000,
+		"1700000000123":                1700000000123000000,
+		"1700000000123456":             1700000000123456000,
+		"1700000000123456789":          1700000000123456789,
+		"0":                            0,
+		"-86400":                       -86400000000000,
+	} {
+		ts, err = ParseTimestamp(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, ts, value)
+	}
+	for _, value := range []string{"", "yesterday", "2026-13-01", "1772359200.", "1772359200.0000000001", "-1.5",
+		"9999999999", "-9999999999"} {
+		_, err = ParseTimestamp(value)
+		assert.Error(t, err, value)
+	}
+}
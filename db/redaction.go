@@ -0,0 +1,237 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"sync"
+)
+
+// RedactedValue replaces the sensitive values within the object data
+const RedactedValue = "[REDACTED]"
+
+// DefaultRedactedPaths are the JSON paths redacted by default. They cover the
+// password hashes, public keys, TOTP and recovery secrets and the storage
+// credentials of users, groups, folders, admins, actions and configs
+var DefaultRedactedPaths = []string{
+	"**.password",
+	"**.public_keys",
+	"**.secret",
+	"**.recovery_codes",
+	"**.access_secret",
+	"**.sse_customer_key",
+	"**.credentials",
+	"**.account_key",
+	"**.sas_url",
+	"**.passphrase",
+	"**.private_key",
+	"**.key_passphrase",
+	"**.api_key",
+	"**.client_secret",
+	"**.refresh_token",
+}
+
+var redaction = struct {
+	sync.RWMutex
+	paths [][]string
+}{
+	paths: mustParseRedactedPaths(DefaultRedactedPaths),
+}
+
+// SetRedactedPaths replaces the JSON paths redacted within the provider events
+// object data. Paths use the JSONFilter syntax, a "*" segment matches any key
+// or array index and a "**" segment matches any number of segments. Null and
+// empty values are not redacted. JSON filters on redacted paths are rejected.
+// An empty list disables the redaction
+func SetRedactedPaths(paths []string) error {
+	parsed, err := parseRedactedPaths(paths)
+	if err != nil {
+		return err
+	}
+	redaction.Lock()
+	defer redaction.Unlock()
+
+	redaction.paths = parsed
+	return nil
+}
+
+func getRedactedPaths() [][]string {
+	redaction.RLock()
+	defer redaction.RUnlock()
+
+	return redaction.paths
+}
+
+func parseRedactedPaths(paths []string) ([][]string, error) {
+	parsed := make([][]string, 0, len(paths))
+	for _, path := range paths {
+		segments, err := parseJSONPath(path)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, segments)
+	}
+	return parsed, nil
+}
+
+func mustParseRedactedPaths(paths []string) [][]string {
+	parsed, err := parseRedactedPaths(paths)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// matchRedactedPath returns true if the path matches the given pattern
+func matchRedactedPath(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for idx := 0; idx <= len(path); idx++ {
+			if matchRedactedPath(pattern[1:], path[idx:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 || (pattern[0] != "*" && pattern[0] != path[0]) {
+		return false
+	}
+	return matchRedactedPath(pattern[1:], path[1:])
+}
+
+func isRedactedPath(patterns [][]string, path []string) bool {
+	for _, pattern := range patterns {
+		if matchRedactedPath(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWithinRedactedPath returns true if the path or one of its parents is
+// redacted
+func isWithinRedactedPath(patterns [][]string, path []string) bool {
+	for end := 1; end <= len(path); end++ {
+		if isRedactedPath(patterns, path[:end]) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactValue returns the value at the given path with the sensitive values
+// masked and true if something was masked
+func redactValue(patterns [][]string, path []string, value any) (any, bool) {
+	if isEmptyJSONValue(value) {
+		return value, false
+	}
+	if isRedactedPath(patterns, path) {
+		return RedactedValue, true
+	}
+	var redacted bool
+	switch v := value.(type) {
+	case map[string]any:
+		result := make(map[string]any, len(v))
+		for key, item := range v {
+			var ok bool
+			result[key], ok = redactValue(patterns, append(path[:len(path):len(path)], key), item)
+			redacted = redacted || ok
+		}
+		return result, redacted
+	case []any:
+		result := make([]any, 0, len(v))
+		for idx, item := range v {
+			item, ok := redactValue(patterns, append(path[:len(path):len(path)], strconv.Itoa(idx)), item)
+			result = append(result, item)
+			redacted = redacted || ok
+		}
+		return result, redacted
+	}
+	return value, false
+}
+
+func isEmptyJSONValue(value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case map[string]any:
+		return len(v) == 0
+	case []any:
+		return len(v) == 0
+	}
+	return false
+}
+
+// redactObjectData returns the object data with the sensitive values masked.
+// Data without sensitive values is returned as is. Data that is not valid JSON
+// cannot be inspected and nil is returned
+func redactObjectData(data []byte) []byte {
+	patterns := getRedactedPaths()
+	if len(patterns) == 0 || len(data) == 0 {
+		return data
+	}
+	if !json.Valid(data) {
+		return nil
+	}
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil
+	}
+	redacted, ok := redactValue(patterns, nil, value)
+	if !ok {
+		return data
+	}
+	result, err := json.Marshal(redacted)
+	if err != nil {
+		return nil
+	}
+	return result
+}
+
+func redactProviderEvents(events []ProviderEvent) {
+	for idx := range events {
+		events[idx].ObjectData = redactObjectData(events[idx].ObjectData)
+	}
+}
+
+// redactFieldChanges masks the sensitive values within the given changes,
+// changes nested within a sensitive value, for example the payload of a
+// secret, are masked too
+func redactFieldChanges(changes []fieldChange) {
+	patterns := getRedactedPaths()
+	if len(patterns) == 0 {
+		return
+	}
+	for idx := range changes {
+		change := &changes[idx]
+		for end := 1; end < len(change.path); end++ {
+			if isRedactedPath(patterns, change.path[:end]) {
+				change.oldValue, _ = redactValue([][]string{{"**"}}, nil, change.oldValue)
+				change.newValue, _ = redactValue([][]string{{"**"}}, nil, change.newValue)
+				break
+			}
+		}
+		change.oldValue, _ = redactValue(patterns, change.path, change.oldValue)
+		change.newValue, _ = redactValue(patterns, change.path, change.newValue)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactObjectData(t *testing.T) {
+	assert.True(t, matchRedactedPath([]string{"**", "password"}, []string{"password"}))
+	assert.True(t, matchRedactedPath([]string{"**", "password"}, []string{"filesystem", "sftpconfig", "password"}))
+	assert.False(t, matchRedactedPath([]string{"**", "password"}, []string{"password", "hash"}))
+	assert.True(t, matchRedactedPath([]string{"virtual_folders", "*", "name"}, []string{"virtual_folders", "0", "name"}))
+	assert.False(t, matchRedactedPath([]string{"virtual_folders", "*"}, []string{"virtual_folders"}))
+
+	data := []byte(`{"username":"alice","password":"$2a$10$hash","public_keys":["ssh-ed25519 AAAA"],` +
+		`"home_dir":"/srv/alice","filters":{"totp_config":{"enabled":true,"secret":{"status":"AES-256-GCM",` +
+		`"payload":"p"}},"recovery_codes":[]},"filesystem":{"provider":1,"s3config":{"bucket":"b",` +
+		`"access_key":"ak","access_secret":{"status":"Plain","payload":"s"}},"sftpconfig":{"password":{}}},` +
+		`"virtual_folders":[{"name":"f1","filesystem":{"gcsconfig":{"credentials":{"payload":"c"}}}}],` +
+		`"description":""}`)
+	var redacted map[string]any
+	err := json.Unmarshal(redactObjectData(data), &redacted)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"username":    "alice",
+		"password":    RedactedValue,
+		"public_keys": RedactedValue,
+		"home_dir":    "/srv/alice",
+		"filters": map[string]any{
+			"totp_config":    map[string]any{"enabled": true, "secret": RedactedValue},
+			"recovery_codes": []any{},
+		},
+		"filesystem": map[string]any{
+			"provider":   float64(1),
+			"s3config":   map[string]any{"bucket": "b", "access_key": "ak", "access_secret": RedactedValue},
+			"sftpconfig": map[string]any{"password": map[string]any{}},
+		},
+		"virtual_folders": []any{map[string]any{
+			"name":       "f1",
+			"filesystem": map[string]any{"gcsconfig": map[string]any{"credentials": RedactedValue}},
+		}},
+		"description": "",
+	}, redacted)
+
+	unchanged := []byte(`{"username": "alice",  "status": 1}`)
+	assert.Equal(t, unchanged, redactObjectData(unchanged))
+	// data that is not valid JSON is never returned
+	assert.Nil(t, redactObjectData([]byte("data")))
+	assert.Nil(t, redactObjectData([]byte(`{"password":"hash"`)))
+	assert.Nil(t, redactObjectData([]byte(`{"username":"alice"}{"password":"hash"}`)))
+	// JSON values that are not objects are redacted too
+	assert.JSONEq(t, `[{"username":"alice","password":"[REDACTED]"}]`,
+		string(redactObjectData([]byte(`[{"username":"alice","password":"hash"}]`))))
+	assert.Equal(t, []byte(`"hash"`), redactObjectData([]byte(`"hash"`)))
+
+	changes := diffObjectData(nil, decodeObjectData([]byte(`{"password":"a","filters":{"totp_config":`+
+		`{"secret":{"payload":"p1"}}},"home_dir":"/a"}`)), decodeObjectData([]byte(`{"password":"b",`+
+		`"filters":{"totp_config":{"secret":{"payload":"p2"}}},"home_dir":"/b","filesystem":{"s3config":`+
+		`{"access_secret":{"payload":"s"}}}}`)))
+	redactFieldChanges(changes)
+	assert.Equal(t, []FieldChange{
+		{Path: "filesystem", Change: FieldAdded, NewValue: map[string]any{
+			"s3config": map[string]any{"access_secret": RedactedValue},
+		}},
+		{Path: "filters.totp_config.secret.payload", Change: FieldChanged, OldValue: RedactedValue,
+			NewValue: RedactedValue},
+		{Path: "home_dir", Change: FieldChanged, OldValue: "/a", NewValue: "/b"},
+		{Path: "password", Change: FieldChanged, OldValue: RedactedValue, NewValue: RedactedValue},
+	}, formatFieldChanges(changes))
+
+	err = SetRedactedPaths([]string{"a..b"})
+	assert.Error(t, err)
+	err = SetRedactedPaths(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, data, redactObjectData(data))
+	err = SetRedactedPaths([]string{"home_dir"})
+	assert.NoError(t, err)
+	assert.Contains(t, string(redactObjectData(data)), `"password":"$2a$10$hash"`)
+	assert.NotContains(t, string(redactObjectData(data)), "/srv/alice")
+	err = SetRedactedPaths(DefaultRedactedPaths)
+	assert.NoError(t, err)
+}
+
+func TestSearchRedactedObjectData(t *testing.T) {
+	providerEvents := []ProviderEvent{
+		{ID: xid.New().String(), Timestamp: 1500, Action: "add", Username: "admin", ObjectType: "user",
+			ObjectName: "redacted", ObjectData: []byte(`{"username":"redacted","password":"hash1"}`)},
+		{ID: xid.New().String(), Timestamp: 1501, Action: "update", Username: "admin", ObjectType: "user",
+			ObjectName: "redacted", ObjectData: []byte(`{"username":"redacted","password":"hash2"}`)},
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&providerEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	filters := eventsearcher.ProviderEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: 1500,
+			EndTimestamp:   1501,
+			Limit:          10,
+		},
+	}
+	data, err := s.SearchProviderEvents(&filters)
+	assert.NoError(t, err)
+	var events []ProviderEvent
+	err = json.Unmarshal(data, &events)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		assert.JSONEq(t, `{"username":"redacted","password":"[REDACTED]"}`, string(events[0].ObjectData))
+	}
+	page, err := s.SearchProviderEventsPage(&ProviderEventFilters{ProviderEventSearch: filters}, CountOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, page.Events, 2) {
+		assert.NotContains(t, string(page.Events[1].ObjectData), "hash1")
+	}
+	history, err := s.GetObjectHistory(ObjectHistoryQuery{
+		ObjectType:        "user",
+		ObjectName:        "redacted",
+		Limit:             10,
+		IncludeObjectData: true,
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, history.Events, 2) {
+		assert.NotContains(t, string(history.Events[1].ObjectData), "hash2")
+		assert.Equal(t, []FieldChange{
+			{Path: "password", Change: FieldChanged, OldValue: RedactedValue, NewValue: RedactedValue},
+		}, history.Events[1].Changes)
+	}
+
+	err = sess.Delete(&providerEvents).Error
+	assert.NoError(t, err)
+}
@@ -0,0 +1,342 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/logger"
+)
+
+var (
+	errMissingColumn    = errors.New("missing column")
+	errTableUnavailable = errors.New("table unavailable")
+)
+
+// schemaError describes a table or a column missing in the database, kind is
+// one of the sentinel errors above
+type schemaError struct {
+	kind    error
+	message string
+}
+
+func newSchemaError(kind error, format string, args ...any) error {
+	return &schemaError{
+		kind:    kind,
+		message: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *schemaError) Error() string {
+	return e.message
+}
+
+func (e *schemaError) Unwrap() error {
+	return e.kind
+}
+
+// tableSchema defines the eventstore schema versions for an events table
+type tableSchema struct {
+	table string
+	// versions are the columns added by each schema version, starting from
+	// version 1
+	versions [][]string
+	// indexedColumns are the columns indexed in the latest schema version
+	indexedColumns []string
+}
+
+func (s *tableSchema) getLatestVersion() int {
+	return len(s.versions)
+}
+
+// eventstoreSchemas are the schemas created by the SFTPGo eventstore plugin
+var eventstoreSchemas = []tableSchema{
+	{
+		table: (&FsEvent{}).TableName(),
+		versions: [][]string{
+			{"id", "timestamp", "action", "username", "fs_path", "fs_target_path", "virtual_path",
+				"virtual_target_path", "ssh_cmd", "file_size", "status", "protocol", "ip", "session_id"},
+			{"fs_provider", "bucket", "endpoint"},
+			{"open_flags"},
+			{"role", "elapsed"},
+			{"instance_id"},
+		},
+		indexedColumns: []string{"timestamp", "action", "username", "ssh_cmd", "status", "protocol", "ip",
+			"fs_provider", "bucket", "endpoint", "role", "instance_id"},
+	},
+	{
+		table: (&ProviderEvent{}).TableName(),
+		versions: [][]string{
+			{"id", "timestamp", "action", "username", "ip", "object_type", "object_name"},
+			{"object_data"},
+			{"role"},
+			{"instance_id"},
+		},
+		indexedColumns: []string{"timestamp", "action", "username", "ip", "object_type", "object_name", "role",
+			"instance_id"},
+	},
+	{
+		table: (&LogEvent{}).TableName(),
+		versions: [][]string{
+			{"id", "timestamp", "event", "protocol", "username", "ip", "message", "role", "instance_id"},
+		},
+		indexedColumns: []string{"timestamp", "event", "protocol", "username", "ip", "role", "instance_id"},
+	},
+}
+
+// TableDefinition defines the columns and the indexes of a table
+type TableDefinition struct {
+	Columns []string
+	// Indexes are the columns of each index, in index order
+	Indexes [][]string
+}
+
+// SchemaInspector is implemented by the backends able to inspect the events
+// tables
+type SchemaInspector interface {
+	// GetTableDefinition returns nil if the table does not exist
+	GetTableDefinition(ctx context.Context, table string) (*TableDefinition, error)
+}
+
+// TableSchema describes the schema detected for an events table
+type TableSchema struct {
+	Table  string `json:"table"`
+	Exists bool   `json:"exists"`
+	// Version is the detected eventstore schema version, 0 if the table does
+	// not exist or the columns of the first version are missing
+	Version       int `json:"version"`
+	LatestVersion int `json:"latest_version"`
+	// MissingColumns are the columns of the latest version not found in the
+	// table, searches using them are refused
+	MissingColumns []string `json:"missing_columns,omitempty"`
+	// MissingIndexes are the columns without an index, searches filtering on
+	// them can be slow
+	MissingIndexes []string `json:"missing_indexes,omitempty"`
+}
+
+// IsUsable returns true if the table can be searched, possibly without the
+// missing columns
+func (s *TableSchema) IsUsable() bool {
+	return s.Version > 0
+}
+
+// IsUpToDate returns true if the table has all the columns and the indexes of
+// the latest schema version
+func (s *TableSchema) IsUpToDate() bool {
+	return s.Version == s.LatestVersion && len(s.MissingColumns) == 0 && len(s.MissingIndexes) == 0
+}
+
+// SchemaReport describes the schema of the events tables
+type SchemaReport struct {
+	Tables []TableSchema `json:"tables"`
+}
+
+// Err returns an error if any of the tables cannot be searched
+func (r *SchemaReport) Err() error {
+	var errs []error
+	for idx := range r.Tables {
+		if err := r.Tables[idx].getError(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// getError returns an error if the table cannot be searched
+func (s *TableSchema) getError() error {
+	switch {
+	case !s.Exists:
+		return newSchemaError(errTableUnavailable, "the %s table does not exist", s.Table)
+	case !s.IsUsable():
+		return newSchemaError(errTableUnavailable, "the %s table has an unsupported schema, missing columns: %s",
+			s.Table, strings.Join(s.MissingColumns, ", "))
+	}
+	return nil
+}
+
+// schemaCheckInterval defines how often the schema is checked again while a
+// table cannot be searched or has missing columns, SFTPGo may create or
+// upgrade the tables after the plugin is started
+const schemaCheckInterval = time.Minute
+
+var detectedSchema = struct {
+	sync.RWMutex
+	tables    map[string]TableSchema
+	checkedAt time.Time
+}{}
+
+// CheckSchema inspects the events tables and detects their eventstore schema
+// version. After a successful check, searches on the tables that cannot be
+// searched, or using columns missing in the database, are refused with a
+// descriptive error. The report is nil if the configured backend cannot
+// inspect its schema
+func CheckSchema() (*SchemaReport, error) {
+	b, err := getBackend()
+	if err != nil {
+		return nil, err
+	}
+	inspector, ok := b.(SchemaInspector)
+	if !ok {
+		return nil, nil
+	}
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	report := &SchemaReport{
+		Tables: make([]TableSchema, 0, len(eventstoreSchemas)),
+	}
+	for idx := range eventstoreSchemas {
+		schema := &eventstoreSchemas[idx]
+		definition, err := inspector.GetTableDefinition(ctx, schema.table)
+		if err != nil {
+			return nil, fmt.Errorf("unable to inspect the %s table: %w", schema.table, err)
+		}
+		report.Tables = append(report.Tables, detectTableSchema(schema, definition))
+	}
+
+	detectedSchema.Lock()
+	defer detectedSchema.Unlock()
+
+	detectedSchema.tables = make(map[string]TableSchema, len(report.Tables))
+	for _, table := range report.Tables {
+		detectedSchema.tables[table.Table] = table
+	}
+	detectedSchema.checkedAt = time.Now()
+	return report, nil
+}
+
+// detectTableSchema returns the latest schema version whose columns, and the
+// ones of the previous versions, are all defined
+func detectTableSchema(schema *tableSchema, definition *TableDefinition) TableSchema {
+	result := TableSchema{
+		Table:         schema.table,
+		LatestVersion: schema.getLatestVersion(),
+	}
+	if definition == nil {
+		return result
+	}
+	result.Exists = true
+	columns := make(map[string]bool, len(definition.Columns))
+	for _, column := range definition.Columns {
+		columns[strings.ToLower(column)] = true
+	}
+	detecting := true
+	for idx, version := range schema.versions {
+		for _, column := range version {
+			if !columns[column] {
+				result.MissingColumns = append(result.MissingColumns, column)
+				detecting = false
+			}
+		}
+		if detecting {
+			result.Version = idx + 1
+		}
+	}
+	for _, column := range schema.indexedColumns {
+		if columns[column] && !slices.ContainsFunc(definition.Indexes, func(index []string) bool {
+			return len(index) > 0 && strings.EqualFold(index[0], column)
+		}) {
+			result.MissingIndexes = append(result.MissingIndexes, column)
+		}
+	}
+	return result
+}
+
+// checkColumns returns an error if the given table cannot be searched or if
+// any of the given columns is missing. Nothing is missing if the schema was
+// not checked. The schema is checked again, at most once per
+// schemaCheckInterval, before returning an error
+func checkColumns(table string, columns ...string) error {
+	err := getColumnsError(table, columns...)
+	if err == nil || !isSchemaCheckDue() {
+		return err
+	}
+	if _, checkErr := CheckSchema(); checkErr != nil {
+		logger.AppLogger.Warn("unable to check the schema again", "error", checkErr)
+		return err
+	}
+	return getColumnsError(table, columns...)
+}
+
+// isSchemaCheckDue returns true, and updates the check time so that
+// concurrent searches do not check the schema too, if the schema was checked
+// more than schemaCheckInterval ago
+func isSchemaCheckDue() bool {
+	detectedSchema.Lock()
+	defer detectedSchema.Unlock()
+
+	if time.Since(detectedSchema.checkedAt) < schemaCheckInterval {
+		return false
+	}
+	detectedSchema.checkedAt = time.Now()
+	return true
+}
+
+func getColumnsError(table string, columns ...string) error {
+	detectedSchema.RLock()
+	defer detectedSchema.RUnlock()
+
+	schema, ok := detectedSchema.tables[table]
+	if !ok {
+		return nil
+	}
+	if err := schema.getError(); err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if slices.Contains(schema.MissingColumns, column) {
+			return newSchemaError(errMissingColumn, "the %s column is not available in the %s table, "+
+				"schema version %d of %d, please upgrade the eventstore plugin", column, table, schema.Version,
+				schema.LatestVersion)
+		}
+	}
+	return nil
+}
+
+func isColumnAvailable(table, column string) bool {
+	return checkColumns(table, column) == nil
+}
+
+func (b *gormBackend) GetTableDefinition(ctx context.Context, table string) (*TableDefinition, error) {
+	migrator := b.getSession(ctx).Migrator()
+	if !migrator.HasTable(table) {
+		return nil, ctx.Err()
+	}
+	columnTypes, err := migrator.ColumnTypes(table)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := migrator.GetIndexes(table)
+	if err != nil {
+		return nil, err
+	}
+	definition := &TableDefinition{
+		Columns: make([]string, 0, len(columnTypes)),
+		Indexes: make([][]string, 0, len(indexes)),
+	}
+	for _, columnType := range columnTypes {
+		definition.Columns = append(definition.Columns, columnType.Name())
+	}
+	for _, index := range indexes {
+		definition.Indexes = append(definition.Indexes, index.Columns())
+	}
+	return definition, nil
+}
@@ -0,0 +1,218 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectTableSchema(t *testing.T) {
+	schema := &eventstoreSchemas[0]
+	columns := slices.Concat(schema.versions...)
+	indexes := make([][]string, 0, len(schema.indexedColumns))
+	for _, column := range schema.indexedColumns {
+		indexes = append(indexes, []string{column})
+	}
+
+	result := detectTableSchema(schema, &TableDefinition{Columns: columns, Indexes: indexes})
+	assert.True(t, result.Exists)
+	assert.Equal(t, 5, result.Version)
+	assert.Equal(t, 5, result.LatestVersion)
+	assert.True(t, result.IsUpToDate())
+
+	result = detectTableSchema(schema, &TableDefinition{
+		Columns: slices.Concat(schema.versions[:3]...),
+		Indexes: [][]string{{"TIMESTAMP", "id"}, {"id", "action"}},
+	})
+	assert.Equal(t, 3, result.Version)
+	assert.True(t, result.IsUsable())
+	assert.False(t, result.IsUpToDate())
+	assert.Equal(t, []string{"role", "elapsed", "instance_id"}, result.MissingColumns)
+	assert.Equal(t, []string{"action", "username", "ssh_cmd", "status", "protocol", "ip", "fs_provider", "bucket",
+		"endpoint"}, result.MissingIndexes)
+	assert.NoError(t, (&SchemaReport{Tables: []TableSchema{result}}).Err())
+	// a column added later does not raise the version if a previous one is missing
+	result = detectTableSchema(schema, &TableDefinition{
+		Columns: slices.Concat(schema.versions[0], schema.versions[2]),
+	})
+	assert.Equal(t, 1, result.Version)
+	assert.Equal(t, []string{"fs_provider", "bucket", "endpoint", "role", "elapsed", "instance_id"},
+		result.MissingColumns)
+
+	result = detectTableSchema(schema, &TableDefinition{Columns: []string{"id", "timestamp"}})
+	assert.True(t, result.Exists)
+	assert.Equal(t, 0, result.Version)
+	assert.False(t, result.IsUsable())
+	assert.Error(t, (&SchemaReport{Tables: []TableSchema{result}}).Err())
+
+	result = detectTableSchema(schema, nil)
+	assert.False(t, result.Exists)
+	assert.Equal(t, 0, result.Version)
+	assert.ErrorContains(t, (&SchemaReport{Tables: []TableSchema{result}}).Err(), "does not exist")
+}
+
+func TestCheckSchema(t *testing.T) {
+	defer resetDetectedSchema()
+
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	definition, err := getTestBackend().GetTableDefinition(ctx, "eventstore_missing_events")
+	assert.NoError(t, err)
+	assert.Nil(t, definition)
+
+	report, err := CheckSchema()
+	assert.NoError(t, err)
+	if !assert.NotNil(t, report) || !assert.Len(t, report.Tables, 3) {
+		return
+	}
+	assert.NoError(t, report.Err())
+	for _, table := range report.Tables {
+		assert.True(t, table.IsUpToDate(), table.Table)
+		assert.Equal(t, table.LatestVersion, table.Version)
+		assert.Empty(t, table.MissingColumns)
+		assert.Empty(t, table.MissingIndexes)
+	}
+	assert.NoError(t, checkColumns((&FsEvent{}).TableName(), "role", "instance_id", "elapsed"))
+}
+
+func TestMissingColumns(t *testing.T) {
+	defer resetDetectedSchema()
+
+	fsSchema := &eventstoreSchemas[0]
+	providerSchema := &eventstoreSchemas[1]
+	detectedSchema.Lock()
+	detectedSchema.tables = map[string]TableSchema{
+		fsSchema.table: detectTableSchema(fsSchema, &TableDefinition{
+			Columns: slices.Concat(fsSchema.versions[:3]...),
+		}),
+		providerSchema.table: detectTableSchema(providerSchema, &TableDefinition{
+			Columns: providerSchema.versions[0],
+		}),
+	}
+	// the schema is not checked again
+	detectedSchema.checkedAt = time.Now()
+	detectedSchema.Unlock()
+
+	s := Searcher{}
+	fsSearch := func() *FsEventFilters {
+		return &FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{Limit: 1},
+			FsProvider:         -1,
+		}}
+	}
+	_, err := s.searchFsEvents(fsSearch())
+	assert.NoError(t, err)
+	filters := fsSearch()
+	filters.Role = "r"
+	_, err = s.searchFsEvents(filters)
+	assert.ErrorIs(t, err, errMissingColumn)
+	assert.ErrorContains(t, err, "the role column")
+	filters = fsSearch()
+	filters.ExcludeInstanceIDs = []string{"i"}
+	_, err = s.searchFsEvents(filters)
+	assert.ErrorIs(t, err, errMissingColumn)
+	filters = fsSearch()
+	filters.Query = "username:a OR (bucket:b AND elapsed>1s)"
+	_, err = s.searchFsEvents(filters)
+	assert.ErrorContains(t, err, "the elapsed column")
+	filters = fsSearch()
+	filters.Query = "username:a OR bucket:b"
+	_, err = s.searchFsEvents(filters)
+	assert.NoError(t, err)
+	_, err = s.AggregateFsEvents(fsSearch(), AggregationOptions{GroupBy: []string{"username", "role"}})
+	assert.ErrorIs(t, err, errMissingColumn)
+	_, err = s.AggregateFsEvents(fsSearch(), AggregationOptions{GroupBy: []string{"username", "bucket"}})
+	assert.NoError(t, err)
+	_, err = s.AnalyzeTransfers(fsSearch(), TransferOptions{})
+	assert.ErrorIs(t, err, errMissingColumn)
+
+	providerFilters := &ProviderEventFilters{ProviderEventSearch: eventsearcher.ProviderEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{Limit: 1},
+	}}
+	_, err = s.searchProviderEvents(providerFilters)
+	assert.NoError(t, err)
+	providerFilters.ObjectData = []JSONFilter{{Path: "status", Operator: JSONOperatorEqual, Value: 1}}
+	_, err = s.searchProviderEvents(providerFilters)
+	assert.ErrorContains(t, err, "the object_data column")
+	// the log events table was not checked
+	_, err = s.searchLogEvents(&LogEventFilters{LogEventSearch: eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{Limit: 1, Role: "r"},
+	}})
+	assert.NoError(t, err)
+
+	stats, err := s.GetStats(StatsOptions{ExactCount: true})
+	assert.NoError(t, err)
+	if assert.Len(t, stats, 3) {
+		assert.Equal(t, Count{Relation: CountRelationEqual}, stats[1].DistinctInstances)
+	}
+
+	logSchema := &eventstoreSchemas[2]
+	detectedSchema.Lock()
+	detectedSchema.tables[logSchema.table] = detectTableSchema(logSchema, nil)
+	detectedSchema.Unlock()
+
+	_, err = s.searchLogEvents(&LogEventFilters{LogEventSearch: eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{Limit: 1},
+	}})
+	assert.ErrorIs(t, err, errTableUnavailable)
+	assert.EqualError(t, err, "the eventstore_log_events table does not exist")
+	stats, err = s.GetStats(StatsOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, stats, 2)
+}
+
+func TestSchemaCheckedAgain(t *testing.T) {
+	defer resetDetectedSchema()
+
+	logSchema := &eventstoreSchemas[2]
+	setUnavailable := func(checkedAt time.Time) {
+		detectedSchema.Lock()
+		defer detectedSchema.Unlock()
+
+		detectedSchema.tables = map[string]TableSchema{
+			logSchema.table: detectTableSchema(logSchema, nil),
+		}
+		detectedSchema.checkedAt = checkedAt
+	}
+	setUnavailable(time.Now())
+	assert.ErrorIs(t, checkColumns(logSchema.table), errTableUnavailable)
+	// the table was created after the last check
+	setUnavailable(time.Now().Add(-schemaCheckInterval))
+	assert.NoError(t, checkColumns(logSchema.table, "instance_id"))
+	detectedSchema.RLock()
+	table := detectedSchema.tables[logSchema.table]
+	checkedAt := detectedSchema.checkedAt
+	detectedSchema.RUnlock()
+	assert.True(t, table.IsUpToDate())
+	assert.Less(t, time.Since(checkedAt), schemaCheckInterval)
+	// a check just started by another search is not repeated
+	setUnavailable(time.Now().Add(-schemaCheckInterval))
+	assert.True(t, isSchemaCheckDue())
+	assert.ErrorIs(t, checkColumns(logSchema.table), errTableUnavailable)
+}
+
+func resetDetectedSchema() {
+	detectedSchema.Lock()
+	defer detectedSchema.Unlock()
+
+	detectedSchema.tables = nil
+	detectedSchema.checkedAt = time.Time{}
+}
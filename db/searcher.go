@@ -17,6 +17,7 @@ package db
 import (
 	"encoding/json"
 	"errors"
+	"time"
 
 	"github.com/sftpgo/sdk/plugin/eventsearcher"
 
@@ -24,77 +25,105 @@ import (
 )
 
 var (
-	errNoLimit = errors.New("please specify a limit")
+	errNoLimit      = errors.New("please specify a limit")
+	errNotSupported = errors.New("not supported by the configured backend")
 )
 
+// Searcher implements the eventsearcher.Searcher interface using the
+// configured backend
 type Searcher struct{}
 
+// SearchFsEvents implements the plugin interface and returns the matching fs
+// events as a JSON array. The SFTPGo plugin protocol has no room for the page
+// envelope: the total, has_more and next_cursor fields are only returned by
+// SearchFsEventsPage
 func (s *Searcher) SearchFsEvents(filters *eventsearcher.FsEventSearch) ([]byte, error) {
-	if filters.Limit <= 0 {
-		return nil, errNoLimit
+	results, err := s.searchFsEvents(&FsEventFilters{FsEventSearch: *filters})
+	if err != nil {
+		return nil, err
 	}
 
-	sess, cancel := getDefaultSession()
-	defer cancel()
-
-	var results []FsEvent
-	if filters.StartTimestamp > 0 {
-		sess = sess.Where("timestamp >= ?", filters.StartTimestamp)
-	}
-	if filters.EndTimestamp > 0 {
-		sess = sess.Where("timestamp <= ?", filters.EndTimestamp)
-	}
-	if len(filters.Actions) > 0 {
-		sess = sess.Where("action IN ?", filters.Actions)
+	data, err := json.Marshal(results)
+	if err != nil {
+		return nil, err
 	}
-	if filters.Username != "" {
-		sess = sess.Where("username = ?", filters.Username)
+
+	return data, err
+}
+
+// SearchFsEventsPage returns a page of fs events and the total number of
+// matching events computed as specified by countOptions. Use the returned
+// cursor as FromID to get the next page
+func (s *Searcher) SearchFsEventsPage(filters *FsEventFilters, countOptions CountOptions,
+) (*Page[FsEvent], error) {
+	b, err := getBackend()
+	if err != nil {
+		return nil, err
 	}
-	if filters.IP != "" {
-		sess = sess.Where("ip = ?", filters.IP)
+	search := *filters
+	if search.Limit > 0 {
+		search.Limit++
 	}
-	if filters.SSHCmd != "" {
-		sess = sess.Where("ssh_cmd = ?", filters.SSHCmd)
+	results, err := s.searchFsEvents(&search)
+	if err != nil {
+		return nil, err
 	}
-	if len(filters.Protocols) > 0 {
-		sess = sess.Where("protocol IN ?", filters.Protocols)
+
+	page := newPage(results, filters.Limit, func(ev *FsEvent) (int64, string) {
+		return ev.Timestamp, ev.ID
+	})
+	if err := setPageTotal(b, page, filters, filters.FromID, countOptions, Counter.CountFsEvents); err != nil {
+		logger.AppLogger.Warn("unable to count fs events", "error", err)
+		return nil, err
 	}
-	if len(filters.InstanceIDs) > 0 {
-		sess = sess.Where("instance_id IN ?", filters.InstanceIDs)
+
+	return page, nil
+}
+
+func (s *Searcher) searchFsEvents(filters *FsEventFilters) ([]FsEvent, error) {
+	if filters.Limit <= 0 {
+		return nil, errNoLimit
 	}
-	if len(filters.Statuses) > 0 {
-		sess = sess.Where("status IN ?", filters.Statuses)
+	if err := filters.validate(); err != nil {
+		return nil, err
 	}
-	if filters.FsProvider >= 0 {
-		sess = sess.Where("fs_provider = ?", filters.FsProvider)
+	b, err := getBackend()
+	if err != nil {
+		return nil, err
 	}
-	if filters.Bucket != "" {
-		sess = sess.Where("bucket = ?", filters.Bucket)
+
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	start := time.Now()
+	results, err := b.SearchFsEvents(ctx, filters)
+	explainSlowSearch(b, filters, time.Since(start), ctx.Err() != nil, Explainer.ExplainFsEvents)
+	if err != nil {
+		logger.AppLogger.Warn("unable to search fs events", "error", err)
+		return nil, err
 	}
-	if filters.Endpoint != "" {
-		sess = sess.Where("endpoint = ?", filters.Endpoint)
+	if filters.DecodeOpenFlags {
+		for idx := range results {
+			results[idx].OpenFlagNames = DecodeOpenFlags(results[idx].OpenFlags)
+		}
 	}
-	if filters.Role != "" {
-		sess = sess.Where("role = ?", filters.Role)
+	if e, _ := filters.Enrichment.getEnricher(); e != nil {
+		e.enrichFsEvents(results)
 	}
-	sess = sess.Limit(filters.Limit)
 
-	if filters.Order == 0 {
-		if filters.FromID != "" {
-			sess = sess.Where("id < ?", filters.FromID)
-		}
-		sess = sess.Order("timestamp DESC, id DESC").Find(&results)
-	} else {
-		if filters.FromID != "" {
-			sess = sess.Where("id > ?", filters.FromID)
-		}
-		sess = sess.Order("timestamp ASC, id ASC").Find(&results)
-	}
-	err := sess.Error
+	return results, nil
+}
+
+// SearchProviderEvents implements the plugin interface and returns the matching provider
+// events as a JSON array. The SFTPGo plugin protocol has no room for the page
+// envelope: the total, has_more and next_cursor fields are only returned by
+// SearchProviderEventsPage
+func (s *Searcher) SearchProviderEvents(filters *eventsearcher.ProviderEventSearch) ([]byte, error) {
+	results, err := s.searchProviderEvents(&ProviderEventFilters{ProviderEventSearch: *filters})
 	if err != nil {
-		logger.AppLogger.Warn("unable to search fs events", "error", err)
 		return nil, err
 	}
+	redactProviderEvents(results)
 
 	data, err := json.Marshal(results)
 	if err != nil {
@@ -104,61 +133,72 @@ func (s *Searcher) SearchFsEvents(filters *eventsearcher.FsEventSearch) ([]byte,
 	return data, err
 }
 
-func (s *Searcher) SearchProviderEvents(filters *eventsearcher.ProviderEventSearch) ([]byte, error) {
-	if filters.Limit <= 0 {
-		return nil, errNoLimit
-	}
-
-	sess, cancel := getDefaultSession()
-	defer cancel()
-
-	var results []ProviderEvent
-	if filters.OmitObjectData {
-		sess = sess.Omit("object_data")
-	}
-	if filters.StartTimestamp > 0 {
-		sess = sess.Where("timestamp >= ?", filters.StartTimestamp)
+// SearchProviderEventsPage returns a page of provider events and the total number of
+// matching events computed as specified by countOptions. Use the returned
+// cursor as FromID to get the next page
+func (s *Searcher) SearchProviderEventsPage(filters *ProviderEventFilters, countOptions CountOptions,
+) (*Page[ProviderEvent], error) {
+	b, err := getBackend()
+	if err != nil {
+		return nil, err
 	}
-	if filters.EndTimestamp > 0 {
-		sess = sess.Where("timestamp <= ?", filters.EndTimestamp)
+	search := *filters
+	if search.Limit > 0 {
+		search.Limit++
 	}
-	if len(filters.Actions) > 0 {
-		sess = sess.Where("action IN ?", filters.Actions)
+	results, err := s.searchProviderEvents(&search)
+	if err != nil {
+		return nil, err
 	}
-	if filters.Username != "" {
-		sess = sess.Where("username = ?", filters.Username)
+	redactProviderEvents(results)
+
+	page := newPage(results, filters.Limit, func(ev *ProviderEvent) (int64, string) {
+		return ev.Timestamp, ev.ID
+	})
+	if err := setPageTotal(b, page, filters, filters.FromID, countOptions, Counter.CountProviderEvents); err != nil {
+		logger.AppLogger.Warn("unable to count provider events", "error", err)
+		return nil, err
 	}
-	if filters.IP != "" {
-		sess = sess.Where("ip = ?", filters.IP)
+
+	return page, nil
+}
+
+func (s *Searcher) searchProviderEvents(filters *ProviderEventFilters) ([]ProviderEvent, error) {
+	if filters.Limit <= 0 {
+		return nil, errNoLimit
 	}
-	if len(filters.ObjectTypes) > 0 {
-		sess = sess.Where("object_type IN ?", filters.ObjectTypes)
+	if err := filters.validate(); err != nil {
+		return nil, err
 	}
-	if filters.ObjectName != "" {
-		sess = sess.Where("object_name = ?", filters.ObjectName)
+	b, err := getBackend()
+	if err != nil {
+		return nil, err
 	}
-	if len(filters.InstanceIDs) > 0 {
-		sess = sess.Where("instance_id IN ?", filters.InstanceIDs)
+
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	start := time.Now()
+	results, err := b.SearchProviderEvents(ctx, filters)
+	explainSlowSearch(b, filters, time.Since(start), ctx.Err() != nil, Explainer.ExplainProviderEvents)
+	if err != nil {
+		logger.AppLogger.Warn("unable to search provider events", "error", err)
+		return nil, err
 	}
-	if filters.Role != "" {
-		sess = sess.Where("role = ?", filters.Role)
+	if e, _ := filters.Enrichment.getEnricher(); e != nil {
+		e.enrichProviderEvents(results)
 	}
-	sess = sess.Limit(filters.Limit)
 
-	if filters.Order == 0 {
-		if filters.FromID != "" {
-			sess = sess.Where("id < ?", filters.FromID)
-		}
-		sess = sess.Order("timestamp DESC, id DESC").Find(&results)
-	} else {
-		if filters.FromID != "" {
-			sess = sess.Where("id > ?", filters.FromID)
-		}
-		sess = sess.Order("timestamp ASC, id ASC").Find(&results)
-	}
-	err := sess.Error
+	return results, nil
+}
+
+// SearchLogEvents implements the plugin interface and returns the matching log
+// events as a JSON array. The SFTPGo plugin protocol has no room for the page
+// envelope: the total, has_more and next_cursor fields are only returned by
+// SearchLogEventsPage
+func (s *Searcher) SearchLogEvents(filters *eventsearcher.LogEventSearch) ([]byte, error) {
+	results, err := s.searchLogEvents(&LogEventFilters{LogEventSearch: *filters})
 	if err != nil {
-		logger.AppLogger.Warn("unable to search provider events", "error", err)
 		return nil, err
 	}
 
@@ -170,62 +210,68 @@ func (s *Searcher) SearchProviderEvents(filters *eventsearcher.ProviderEventSear
 	return data, err
 }
 
-func (s *Searcher) SearchLogEvents(filters *eventsearcher.LogEventSearch) ([]byte, error) {
-	if filters.Limit <= 0 {
-		return nil, errNoLimit
-	}
-
-	sess, cancel := getDefaultSession()
-	defer cancel()
-
-	var results []LogEvent
-	if filters.StartTimestamp > 0 {
-		sess = sess.Where("timestamp >= ?", filters.StartTimestamp)
-	}
-	if filters.EndTimestamp > 0 {
-		sess = sess.Where("timestamp <= ?", filters.EndTimestamp)
-	}
-	if len(filters.Events) > 0 {
-		sess = sess.Where("event IN ?", filters.Events)
+// SearchLogEventsPage returns a page of log events and the total number of
+// matching events computed as specified by countOptions. Use the returned
+// cursor as FromID to get the next page
+func (s *Searcher) SearchLogEventsPage(filters *LogEventFilters, countOptions CountOptions,
+) (*Page[LogEvent], error) {
+	if err := filters.validate(); err != nil {
+		return nil, err
 	}
-	if len(filters.Protocols) > 0 {
-		sess = sess.Where("protocol IN ?", filters.Protocols)
+	b, err := getBackend()
+	if err != nil {
+		return nil, err
 	}
-	if filters.Username != "" {
-		sess = sess.Where("username = ?", filters.Username)
+	filters, messageSearch, err := getMessageSearchFilters(filters)
+	if err != nil {
+		return nil, err
 	}
-	if filters.IP != "" {
-		sess = sess.Where("ip = ?", filters.IP)
+	search := *filters
+	if search.Limit > 0 {
+		search.Limit++
 	}
-	if len(filters.InstanceIDs) > 0 {
-		sess = sess.Where("instance_id IN ?", filters.InstanceIDs)
+	results, err := s.searchLogEvents(&search)
+	if err != nil {
+		return nil, err
 	}
-	if filters.Role != "" {
-		sess = sess.Where("role = ?", filters.Role)
+
+	page := newPage(results, filters.Limit, func(ev *LogEvent) (int64, string) {
+		return ev.Timestamp, ev.ID
+	})
+	page.MessageSearch = messageSearch
+	if err := setPageTotal(b, page, filters, filters.FromID, countOptions, Counter.CountLogEvents); err != nil {
+		logger.AppLogger.Warn("unable to count log events", "error", err)
+		return nil, err
 	}
-	sess = sess.Limit(filters.Limit)
 
-	if filters.Order == 0 {
-		if filters.FromID != "" {
-			sess = sess.Where("id < ?", filters.FromID)
-		}
-		sess = sess.Order("timestamp DESC, id DESC").Find(&results)
-	} else {
-		if filters.FromID != "" {
-			sess = sess.Where("id > ?", filters.FromID)
-		}
-		sess = sess.Order("timestamp ASC, id ASC").Find(&results)
+	return page, nil
+}
+
+func (s *Searcher) searchLogEvents(filters *LogEventFilters) ([]LogEvent, error) {
+	if filters.Limit <= 0 {
+		return nil, errNoLimit
 	}
-	err := sess.Error
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	b, err := getBackend()
 	if err != nil {
-		logger.AppLogger.Warn("unable to search log events", "error", err)
 		return nil, err
 	}
 
-	data, err := json.Marshal(results)
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	start := time.Now()
+	results, err := b.SearchLogEvents(ctx, filters)
+	explainSlowSearch(b, filters, time.Since(start), ctx.Err() != nil, Explainer.ExplainLogEvents)
 	if err != nil {
+		logger.AppLogger.Warn("unable to search log events", "error", err)
 		return nil, err
 	}
+	if e, _ := filters.Enrichment.getEnricher(); e != nil {
+		e.enrichLogEvents(results)
+	}
 
-	return data, err
+	return results, nil
 }
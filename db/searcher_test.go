@@ -654,7 +654,7 @@ func TestSearchProviderEvents(t *testing.T) {
 			IP:         "127.1.1.1",
 			ObjectType: "api_key",
 			ObjectName: "123",
-			ObjectData: []byte("data"),
+			ObjectData: []byte(`{"name":"data"}`),
 			Role:       "role1",
 			InstanceID: "instance1",
 		},
@@ -666,7 +666,7 @@ func TestSearchProviderEvents(t *testing.T) {
 			IP:         "127.1.0.1",
 			ObjectType: "admin",
 			ObjectName: "456",
-			ObjectData: []byte("data"),
+			ObjectData: []byte(`{"name":"data"}`),
 			InstanceID: "instance2",
 		},
 		{
@@ -677,7 +677,7 @@ func TestSearchProviderEvents(t *testing.T) {
 			IP:         "127.1.0.1",
 			ObjectType: "user",
 			ObjectName: "678",
-			ObjectData: []byte("data"),
+			ObjectData: []byte(`{"name":"data"}`),
 			InstanceID: "instance1",
 		},
 		{
@@ -688,7 +688,7 @@ func TestSearchProviderEvents(t *testing.T) {
 			IP:         "127.1.0.1",
 			ObjectType: "user",
 			ObjectName: "678",
-			ObjectData: []byte("data"),
+			ObjectData: []byte(`{"name":"data"}`),
 			InstanceID: "instance1",
 		},
 		{
@@ -699,7 +699,7 @@ func TestSearchProviderEvents(t *testing.T) {
 			IP:         "127.1.0.1",
 			ObjectType: "admin",
 			ObjectName: "0123",
-			ObjectData: []byte("data"),
+			ObjectData: []byte(`{"name":"data"}`),
 			InstanceID: "instance3",
 		},
 	}
@@ -728,7 +728,7 @@ func TestSearchProviderEvents(t *testing.T) {
 	assert.Equal(t, providerEvents[0].ID, events[0].ID)
 	assert.Equal(t, providerEvents[4].ID, events[4].ID)
 	for _, ev := range events {
-		assert.Equal(t, []byte("data"), ev.ObjectData)
+		assert.Equal(t, []byte(`{"name":"data"}`), ev.ObjectData)
 	}
 	// test omit object data
 	data, err = s.SearchProviderEvents(&eventsearcher.ProviderEventSearch{
@@ -1187,3 +1187,223 @@ func TestSearchLogEvents(t *testing.T) {
 	err = sess.Delete(&logEvents).Error
 	assert.NoError(t, err)
 }
+
+func TestKeysetPagination(t *testing.T) {
+	// IDs are not ordered like timestamps, for example they come from
+	// instances with a clock skew
+	fsEvents := []FsEvent{
+		{ID: "keyset_e", Timestamp: 200, Action: "upload", Username: "user", Protocol: "SFTP", InstanceID: "keyset"},
+		{ID: "keyset_d", Timestamp: 201, Action: "upload", Username: "user", Protocol: "SFTP", InstanceID: "keyset"},
+		{ID: "keyset_a", Timestamp: 202, Action: "upload", Username: "user", Protocol: "SFTP", InstanceID: "keyset"},
+		{ID: "keyset_c", Timestamp: 202, Action: "upload", Username: "user", Protocol: "SFTP", InstanceID: "keyset"},
+		{ID: "keyset_b", Timestamp: 203, Action: "upload", Username: "user", Protocol: "SFTP", InstanceID: "keyset"},
+		{ID: "keyset_f", Timestamp: 204, Action: "upload", Username: "user", Protocol: "SFTP", InstanceID: "keyset"},
+	}
+	expectedASC := []string{"keyset_e", "keyset_d", "keyset_a", "keyset_c", "keyset_b", "keyset_f"}
+	expectedDESC := []string{"keyset_f", "keyset_b", "keyset_c", "keyset_a", "keyset_d", "keyset_e"}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	for _, pageSize := range []int{1, 2, 4, 6, 10} {
+		for order, expected := range [][]string{expectedDESC, expectedASC} {
+			var ids []string
+			var legacyIDs []string
+			fromID := ""
+			legacyFromID := ""
+			for range 10 {
+				filters := FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{
+					CommonSearchParams: eventsearcher.CommonSearchParams{
+						InstanceIDs: []string{"keyset"},
+						Limit:       pageSize,
+						Order:       order,
+						FromID:      fromID,
+					},
+					FsProvider: -1,
+				}}
+				page, err := s.SearchFsEventsPage(&filters, CountOptions{})
+				assert.NoError(t, err)
+				assert.LessOrEqual(t, len(page.Events), pageSize)
+				for _, ev := range page.Events {
+					ids = append(ids, ev.ID)
+				}
+				// an event ID, as sent by SFTPGo, is still accepted
+				filters.FromID = legacyFromID
+				data, err := s.SearchFsEvents(&filters.FsEventSearch)
+				assert.NoError(t, err)
+				var events []FsEvent
+				err = json.Unmarshal(data, &events)
+				assert.NoError(t, err)
+				for _, ev := range events {
+					legacyIDs = append(legacyIDs, ev.ID)
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				fromID = page.NextCursor
+				legacyFromID = events[len(events)-1].ID
+			}
+			assert.Equal(t, expected, ids, "page size %d, order %d", pageSize, order)
+			assert.Equal(t, expected, legacyIDs, "page size %d, order %d", pageSize, order)
+		}
+	}
+	// a cursor can be used with the SDK search too
+	page, err := s.SearchFsEventsPage(&FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			InstanceIDs: []string{"keyset"},
+			Limit:       3,
+			Order:       1,
+		},
+		FsProvider: -1,
+	}}, CountOptions{})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, page.NextCursor)
+	data, err := s.SearchFsEvents(&eventsearcher.FsEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			InstanceIDs: []string{"keyset"},
+			Limit:       3,
+			Order:       1,
+			FromID:      page.NextCursor,
+		},
+		FsProvider: -1,
+	})
+	assert.NoError(t, err)
+	var events []FsEvent
+	err = json.Unmarshal(data, &events)
+	assert.NoError(t, err)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, "keyset_c", events[0].ID)
+	}
+	_, err = s.SearchFsEventsPage(&FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{}}, CountOptions{})
+	assert.ErrorIs(t, err, errNoLimit)
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+}
+
+func TestSearchPageTotal(t *testing.T) {
+	var logEvents []LogEvent
+	var providerEvents []ProviderEvent
+	for idx := range 5 {
+		logEvents = append(logEvents, LogEvent{
+			ID:         xid.New().String(),
+			Timestamp:  int64(300 + idx),
+			Event:      1,
+			Protocol:   "SSH",
+			Username:   "total",
+			InstanceID: "total",
+		})
+		providerEvents = append(providerEvents, ProviderEvent{
+			ID:         xid.New().String(),
+			Timestamp:  int64(300 + idx),
+			Action:     "update",
+			Username:   "total",
+			ObjectType: "user",
+			ObjectName: "total",
+			InstanceID: "total",
+		})
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&logEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&providerEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	filters := LogEventFilters{LogEventSearch: eventsearcher.LogEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			InstanceIDs: []string{"total"},
+			Limit:       10,
+		},
+	}}
+	// all the events fit in the first page, no count query is required
+	page, err := s.SearchLogEventsPage(&filters, CountOptions{Mode: CountNone})
+	assert.NoError(t, err)
+	assert.Len(t, page.Events, 5)
+	assert.False(t, page.HasMore)
+	assert.Empty(t, page.NextCursor)
+	if assert.NotNil(t, page.Total) {
+		assert.Equal(t, Count{Value: 5, Relation: CountRelationEqual}, *page.Total)
+	}
+
+	filters.Limit = 2
+	page, err = s.SearchLogEventsPage(&filters, CountOptions{Mode: CountNone})
+	assert.NoError(t, err)
+	assert.Len(t, page.Events, 2)
+	assert.True(t, page.HasMore)
+	assert.NotEmpty(t, page.NextCursor)
+	assert.Nil(t, page.Total)
+
+	page, err = s.SearchLogEventsPage(&filters, CountOptions{Mode: CountExact})
+	assert.NoError(t, err)
+	if assert.NotNil(t, page.Total) {
+		assert.Equal(t, Count{Value: 5, Relation: CountRelationEqual}, *page.Total)
+	}
+	// the total ignores the pagination
+	filters.FromID = page.NextCursor
+	page, err = s.SearchLogEventsPage(&filters, CountOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, page.Events, 2)
+	if assert.NotNil(t, page.Total) {
+		assert.Equal(t, Count{Value: 5, Relation: CountRelationEqual}, *page.Total)
+	}
+	filters.FromID = page.NextCursor
+	page, err = s.SearchLogEventsPage(&filters, CountOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, page.Events, 1)
+	assert.False(t, page.HasMore)
+	assert.Empty(t, page.NextCursor)
+	// above the limit the count is a lower bound or an estimate
+	page, err = s.SearchLogEventsPage(&filters, CountOptions{Limit: 3})
+	assert.NoError(t, err)
+	if assert.NotNil(t, page.Total) {
+		assert.Contains(t, []string{CountRelationGreaterOrEqual, CountRelationEstimate}, page.Total.Relation)
+		assert.GreaterOrEqual(t, page.Total.Value, int64(3))
+	}
+	page, err = s.SearchLogEventsPage(&filters, CountOptions{Mode: CountEstimated, Limit: 3})
+	assert.NoError(t, err)
+	if assert.NotNil(t, page.Total) {
+		assert.Contains(t, []string{CountRelationGreaterOrEqual, CountRelationEstimate}, page.Total.Relation)
+	}
+
+	providerPage, err := s.SearchProviderEventsPage(&ProviderEventFilters{ProviderEventSearch: eventsearcher.ProviderEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			InstanceIDs: []string{"total"},
+			Limit:       4,
+			Order:       1,
+		},
+		ObjectName: "total",
+	}}, CountOptions{Mode: CountExact})
+	assert.NoError(t, err)
+	assert.Len(t, providerPage.Events, 4)
+	assert.True(t, providerPage.HasMore)
+	if assert.NotNil(t, providerPage.Total) {
+		assert.Equal(t, Count{Value: 5, Relation: CountRelationEqual}, *providerPage.Total)
+	}
+
+	fsPage, err := s.SearchFsEventsPage(&FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			InstanceIDs: []string{"total"},
+			Limit:       1,
+		},
+		FsProvider: -1,
+	}}, CountOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, fsPage.Events, 0)
+	assert.False(t, fsPage.HasMore)
+	if assert.NotNil(t, fsPage.Total) {
+		assert.Equal(t, Count{Value: 0, Relation: CountRelationEqual}, *fsPage.Total)
+	}
+
+	err = sess.Delete(&logEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&providerEvents).Error
+	assert.NoError(t, err)
+}
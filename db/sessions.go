@@ -0,0 +1,209 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+)
+
+const (
+	defaultSessionWindow = 5 * time.Minute
+	maxSessionFsEvents   = 10000
+	maxSessionLogEvents  = 1000
+)
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	// logEventProtocols maps the fs events protocols to the log events ones
+	logEventProtocols = map[string]string{
+		"SFTP":      "SSH",
+		"SCP":       "SSH",
+		"SSH":       "SSH",
+		"FTP":       "FTP",
+		"DAV":       "DAV",
+		"HTTP":      "HTTP",
+		"HTTPShare": "HTTP",
+	}
+)
+
+// SessionTimelineQuery identifies the session to reconstruct
+type SessionTimelineQuery struct {
+	// SessionID is the connection identifier
+	SessionID string
+	// Username and Timestamp are used if SessionID is empty: the session is the
+	// one of the last fs event for the user at or before the timestamp, or of
+	// the first one after it if there is none
+	Username  string
+	Timestamp int64
+	// Window defines how long before the first and after the last fs event to
+	// search for log events. Default 5 minutes
+	Window     time.Duration
+	Enrichment EnrichmentOptions
+}
+
+func (q *SessionTimelineQuery) getWindow() int64 {
+	if q.Window > 0 {
+		return q.Window.Nanoseconds()
+	}
+	return defaultSessionWindow.Nanoseconds()
+}
+
+// SessionTimeline is a connection reconstructed from its fs events and the
+// log events for the same user, IP and protocol around them
+type SessionTimeline struct {
+	SessionID  string `json:"session_id"`
+	Username   string `json:"username"`
+	IP         string `json:"ip,omitempty"`
+	Protocol   string `json:"protocol"`
+	InstanceID string `json:"instance_id,omitempty"`
+	// StartTimestamp is the start of the first fs event, the event timestamp
+	// minus the elapsed time
+	StartTimestamp int64 `json:"start_timestamp"`
+	EndTimestamp   int64 `json:"end_timestamp"`
+	// Duration is in nanoseconds
+	Duration        time.Duration `json:"duration"`
+	UploadedBytes   int64         `json:"uploaded_bytes"`
+	DownloadedBytes int64         `json:"downloaded_bytes"`
+	FsEvents        []FsEvent     `json:"fs_events"`
+	LogEvents       []LogEvent    `json:"log_events"`
+	// Truncated is true if the session has more fs events than the ones returned
+	Truncated bool `json:"truncated,omitempty"`
+	// LogEventsTruncated is true if there are more log events than the ones
+	// returned
+	LogEventsTruncated bool `json:"log_events_truncated,omitempty"`
+}
+
+// GetSessionTimeline returns the fs events of a session, in order, and the
+// surrounding log events
+func (s *Searcher) GetSessionTimeline(query SessionTimelineQuery) (*SessionTimeline, error) {
+	sessionID := query.SessionID
+	if sessionID == "" {
+		if query.Username == "" || query.Timestamp <= 0 {
+			return nil, errors.New("a session ID or a username and a timestamp are required")
+		}
+		var err error
+		sessionID, err = s.findSessionID(query.Username, query.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fsEvents, err := s.searchFsEvents(&FsEventFilters{
+		FsEventSearch: eventsearcher.FsEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				Limit: maxSessionFsEvents + 1,
+				Order: 1,
+			},
+			FsProvider: -1,
+		},
+		SessionID:  sessionID,
+		Enrichment: query.Enrichment,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(fsEvents) == 0 {
+		return nil, errSessionNotFound
+	}
+	timeline := &SessionTimeline{
+		SessionID:  sessionID,
+		Username:   fsEvents[0].Username,
+		IP:         fsEvents[0].IP,
+		Protocol:   fsEvents[0].Protocol,
+		InstanceID: fsEvents[0].InstanceID,
+	}
+	if len(fsEvents) > maxSessionFsEvents {
+		fsEvents = fsEvents[:maxSessionFsEvents]
+		timeline.Truncated = true
+	}
+	timeline.FsEvents = fsEvents
+	timeline.StartTimestamp = fsEvents[0].Timestamp
+	timeline.EndTimestamp = fsEvents[len(fsEvents)-1].Timestamp
+	for idx := range fsEvents {
+		ev := &fsEvents[idx]
+		start := ev.Timestamp - (time.Duration(ev.Elapsed) * time.Millisecond).Nanoseconds()
+		if start < timeline.StartTimestamp {
+			timeline.StartTimestamp = start
+		}
+		switch ev.Action {
+		case actionUpload:
+			timeline.UploadedBytes += ev.FileSize
+		case actionDownload:
+			timeline.DownloadedBytes += ev.FileSize
+		}
+	}
+	timeline.Duration = time.Duration(timeline.EndTimestamp - timeline.StartTimestamp)
+
+	logFilters := &LogEventFilters{
+		LogEventSearch: eventsearcher.LogEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				StartTimestamp: timeline.StartTimestamp - query.getWindow(),
+				EndTimestamp:   timeline.EndTimestamp + query.getWindow(),
+				Username:       timeline.Username,
+				IP:             timeline.IP,
+				Limit:          maxSessionLogEvents + 1,
+				Order:          1,
+			},
+		},
+		Enrichment: query.Enrichment,
+	}
+	if protocol, ok := logEventProtocols[timeline.Protocol]; ok {
+		logFilters.Protocols = []string{protocol}
+	}
+	timeline.LogEvents, err = s.searchLogEvents(logFilters)
+	if err != nil {
+		return nil, err
+	}
+	if len(timeline.LogEvents) > maxSessionLogEvents {
+		timeline.LogEvents = timeline.LogEvents[:maxSessionLogEvents]
+		timeline.LogEventsTruncated = true
+	}
+
+	return timeline, nil
+}
+
+// findSessionID returns the session ID of the last fs event for the user at or
+// before the given timestamp or, if there is none, of the first one after it
+func (s *Searcher) findSessionID(username string, timestamp int64) (string, error) {
+	filters := &FsEventFilters{
+		FsEventSearch: eventsearcher.FsEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				EndTimestamp: timestamp,
+				Username:     username,
+				Limit:        1,
+			},
+			FsProvider: -1,
+		},
+	}
+	events, err := s.searchFsEvents(filters)
+	if err != nil {
+		return "", err
+	}
+	if len(events) == 0 {
+		filters.EndTimestamp = 0
+		filters.StartTimestamp = timestamp
+		filters.Order = 1
+		events, err = s.searchFsEvents(filters)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(events) == 0 || events[0].SessionID == "" {
+		return "", errSessionNotFound
+	}
+	return events[0].SessionID, nil
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionTimeline(t *testing.T) {
+	base := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC).UnixNano()
+	ts := func(d time.Duration) int64 {
+		return base + d.Nanoseconds()
+	}
+	newFsEvent := func(sessionID, action string, timestamp, size, elapsed int64) FsEvent {
+		return FsEvent{
+			ID:        xid.New().String(),
+			Timestamp: timestamp,
+			Action:    action,
+			Username:  "session_user",
+			Protocol:  "SFTP",
+			IP:        "192.168.1.5",
+			SessionID: sessionID,
+			FileSize:  size,
+			Elapsed:   elapsed,
+			Status:    1,
+		}
+	}
+	fsEvents := []FsEvent{
+		newFsEvent("s1", "upload", ts(2*time.Minute), 1000, 30000),
+		newFsEvent("s1", "mkdir", ts(3*time.Minute), 0, 0),
+		newFsEvent("s1", "download", ts(4*time.Minute), 500, 1000),
+		newFsEvent("s2", "upload", ts(time.Hour), 200, 100),
+	}
+	newLogEvent := func(event int, protocol, ip string, timestamp int64) LogEvent {
+		return LogEvent{
+			ID:        xid.New().String(),
+			Timestamp: timestamp,
+			Event:     event,
+			Protocol:  protocol,
+			Username:  "session_user",
+			IP:        ip,
+		}
+	}
+	logEvents := []LogEvent{
+		newLogEvent(1, "SSH", "192.168.1.5", ts(0)),
+		newLogEvent(5, "SSH", "192.168.1.5", ts(time.Minute)),
+		newLogEvent(5, "FTP", "192.168.1.5", ts(time.Minute)),
+		newLogEvent(5, "SSH", "192.168.1.6", ts(time.Minute)),
+		newLogEvent(5, "SSH", "192.168.1.5", ts(30*time.Minute)),
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&logEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	timeline, err := s.GetSessionTimeline(SessionTimelineQuery{SessionID: "s1"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "session_user", timeline.Username)
+		assert.Equal(t, "192.168.1.5", timeline.IP)
+		assert.Equal(t, "SFTP", timeline.Protocol)
+		assert.Equal(t, ts(90*time.Second), timeline.StartTimestamp)
+		assert.Equal(t, ts(4*time.Minute), timeline.EndTimestamp)
+		assert.Equal(t, 150*time.Second, timeline.Duration)
+		assert.Equal(t, int64(1000), timeline.UploadedBytes)
+		assert.Equal(t, int64(500), timeline.DownloadedBytes)
+		assert.False(t, timeline.Truncated)
+		assert.False(t, timeline.LogEventsTruncated)
+		if assert.Len(t, timeline.FsEvents, 3) {
+			assert.Equal(t, "upload", timeline.FsEvents[0].Action)
+			assert.Equal(t, "download", timeline.FsEvents[2].Action)
+		}
+		if assert.Len(t, timeline.LogEvents, 2) {
+			assert.Equal(t, logEvents[0].ID, timeline.LogEvents[0].ID)
+			assert.Equal(t, logEvents[1].ID, timeline.LogEvents[1].ID)
+		}
+	}
+	timeline, err = s.GetSessionTimeline(SessionTimelineQuery{SessionID: "s1", Window: 45 * time.Second})
+	if assert.NoError(t, err) && assert.Len(t, timeline.LogEvents, 1) {
+		assert.Equal(t, logEvents[1].ID, timeline.LogEvents[0].ID)
+	}
+	timeline, err = s.GetSessionTimeline(SessionTimelineQuery{Username: "session_user", Timestamp: ts(10 * time.Minute)})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "s1", timeline.SessionID)
+	}
+	timeline, err = s.GetSessionTimeline(SessionTimelineQuery{Username: "session_user", Timestamp: ts(time.Hour)})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "s2", timeline.SessionID)
+		assert.Len(t, timeline.FsEvents, 1)
+		assert.Len(t, timeline.LogEvents, 0)
+	}
+	// no events before the timestamp, the first session after it is returned
+	timeline, err = s.GetSessionTimeline(SessionTimelineQuery{Username: "session_user", Timestamp: ts(0)})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "s1", timeline.SessionID)
+	}
+
+	_, err = s.GetSessionTimeline(SessionTimelineQuery{SessionID: "missing"})
+	assert.ErrorIs(t, err, errSessionNotFound)
+	_, err = s.GetSessionTimeline(SessionTimelineQuery{Username: "missing", Timestamp: ts(0)})
+	assert.ErrorIs(t, err, errSessionNotFound)
+	_, err = s.GetSessionTimeline(SessionTimelineQuery{Username: "session_user"})
+	assert.Error(t, err)
+
+	page, err := s.SearchFsEventsPage(&FsEventFilters{
+		FsEventSearch: eventsearcher.FsEventSearch{
+			CommonSearchParams: eventsearcher.CommonSearchParams{
+				Limit: 10,
+			},
+			FsProvider: -1,
+		},
+		SessionID: "s2",
+	}, CountOptions{})
+	if assert.NoError(t, err) && assert.Len(t, page.Events, 1) {
+		assert.Equal(t, fsEvents[3].ID, page.Events[0].ID)
+	}
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&logEvents).Error
+	assert.NoError(t, err)
+}
+
+func TestSessionTimelineTruncatedLogEvents(t *testing.T) {
+	fsEvent := FsEvent{
+		ID:        xid.New().String(),
+		Timestamp: 2000,
+		Action:    "upload",
+		Username:  "truncated_user",
+		Protocol:  "SFTP",
+		SessionID: "truncated_session",
+		Status:    1,
+	}
+	logEvents := make([]LogEvent, 0, maxSessionLogEvents+1)
+	for idx := 0; idx <= maxSessionLogEvents; idx++ {
+		logEvents = append(logEvents, LogEvent{
+			ID:        xid.New().String(),
+			Timestamp: int64(1000 + idx),
+			Event:     5,
+			Protocol:  "SSH",
+			Username:  "truncated_user",
+		})
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvent).Error
+	assert.NoError(t, err)
+	err = sess.CreateInBatches(&logEvents, 200).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	timeline, err := s.GetSessionTimeline(SessionTimelineQuery{SessionID: "truncated_session"})
+	if assert.NoError(t, err) {
+		assert.False(t, timeline.Truncated)
+		assert.True(t, timeline.LogEventsTruncated)
+		if assert.Len(t, timeline.LogEvents, maxSessionLogEvents) {
+			assert.Equal(t, logEvents[0].ID, timeline.LogEvents[0].ID)
+		}
+	}
+
+	err = sess.Delete(&fsEvent).Error
+	assert.NoError(t, err)
+	err = sess.Delete(&logEvents).Error
+	assert.NoError(t, err)
+}
@@ -0,0 +1,378 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/schema"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/logger"
+)
+
+// statsQueryTimeout is higher than the default timeout, exact counts scan the
+// whole tables
+const statsQueryTimeout = 15 * time.Minute
+
+// statsDistinctColumns defines the columns whose distinct values are reported
+var statsDistinctColumns = []string{"username", "ip", "instance_id"}
+
+// StatsOptions defines the options for the events tables statistics
+type StatsOptions struct {
+	// ExactCount counts the rows and the distinct values exactly instead of
+	// using the estimates from the catalog. They are always counted exactly
+	// if an estimate is not available
+	ExactCount bool
+}
+
+// TableStats defines the statistics for an events table
+type TableStats struct {
+	Table             string `json:"table"`
+	Rows              Count  `json:"rows"`
+	OldestTimestamp   int64  `json:"oldest_timestamp,omitempty"`
+	NewestTimestamp   int64  `json:"newest_timestamp,omitempty"`
+	DistinctUsers     Count  `json:"distinct_users"`
+	DistinctIPs       Count  `json:"distinct_ips"`
+	DistinctInstances Count  `json:"distinct_instances"`
+	// Size is read from the catalog, it is nil if not available
+	Size *TableSize `json:"size,omitempty"`
+}
+
+// TableSize defines the disk space, in bytes, used by a table. The catalog
+// may be outdated until the table is analyzed
+type TableSize struct {
+	Data    int64 `json:"data"`
+	Indexes int64 `json:"indexes"`
+	// IndexSizes is empty if the size of each index is not available
+	IndexSizes []IndexSize `json:"index_sizes,omitempty"`
+}
+
+// IndexSize defines the disk space, in bytes, used by an index
+type IndexSize struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// StatsProvider is implemented by the backends able to report statistics
+// about the events tables
+type StatsProvider interface {
+	// GetStats returns the statistics for the filesystem, provider and log
+	// events tables, in this order. The tables that cannot be searched, as
+	// detected by CheckSchema, are omitted
+	GetStats(ctx context.Context, options StatsOptions) ([]TableStats, error)
+}
+
+// GetStats returns the statistics for the events tables
+func (s *Searcher) GetStats(options StatsOptions) ([]TableStats, error) {
+	b, err := getBackend()
+	if err != nil {
+		return nil, err
+	}
+	provider, ok := b.(StatsProvider)
+	if !ok {
+		return nil, errNotSupported
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), statsQueryTimeout)
+	defer cancel()
+
+	stats, err := provider.GetStats(ctx, options)
+	if err != nil {
+		logger.AppLogger.Warn("unable to get table stats", "error", err)
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (b *gormBackend) GetStats(ctx context.Context, options StatsOptions) ([]TableStats, error) {
+	models := []schema.Tabler{&FsEvent{}, &ProviderEvent{}, &LogEvent{}}
+	result := make([]TableStats, 0, len(models))
+	for _, model := range models {
+		if errors.Is(checkColumns(model.TableName()), errTableUnavailable) {
+			continue
+		}
+		stats, err := b.getTableStats(ctx, model, options)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, stats)
+	}
+	return result, nil
+}
+
+func (b *gormBackend) getTableStats(ctx context.Context, model schema.Tabler,
+	options StatsOptions,
+) (TableStats, error) {
+	stats := TableStats{
+		Table: model.TableName(),
+	}
+	size, estimate, err := b.getTableSize(ctx, stats.Table)
+	if err != nil {
+		return stats, err
+	}
+	stats.Size = size
+	if err := b.getTimestampRange(ctx, model, &stats); err != nil {
+		return stats, err
+	}
+	counts := make(map[string]Count)
+	if !options.ExactCount {
+		if estimate >= 0 {
+			counts["total"] = Count{Value: estimate, Relation: CountRelationEstimate}
+		}
+		estimates, err := b.getDistinctEstimates(ctx, stats.Table, estimate)
+		if err != nil {
+			return stats, err
+		}
+		for column, value := range estimates {
+			counts[column] = Count{Value: value, Relation: CountRelationEstimate}
+		}
+	}
+	var columns []string
+	for _, column := range statsDistinctColumns {
+		if _, ok := counts[column]; ok {
+			continue
+		}
+		// older schema versions have no instance_id column
+		if !isColumnAvailable(stats.Table, column) {
+			counts[column] = Count{Relation: CountRelationEqual}
+			continue
+		}
+		columns = append(columns, fmt.Sprintf("COUNT(DISTINCT NULLIF(%s, '')) AS %s", column, column))
+	}
+	if _, ok := counts["total"]; !ok {
+		columns = append(columns, "COUNT(*) AS total")
+	}
+	if len(columns) > 0 {
+		if err := b.countStatsColumns(ctx, model, columns, counts); err != nil {
+			return stats, err
+		}
+	}
+	stats.Rows = counts["total"]
+	stats.DistinctUsers = counts["username"]
+	stats.DistinctIPs = counts["ip"]
+	stats.DistinctInstances = counts["instance_id"]
+	return stats, nil
+}
+
+// getTimestampRange sets the oldest and newest timestamps. Each aggregate is
+// a separate subquery, so the timestamp index is used on every database
+func (b *gormBackend) getTimestampRange(ctx context.Context, model schema.Tabler, stats *TableStats) error {
+	rows, err := b.getSession(ctx).Raw("SELECT (?) AS oldest, (?) AS newest",
+		b.getSession(ctx).Model(model).Select("MIN(timestamp)"),
+		b.getSession(ctx).Model(model).Select("MAX(timestamp)")).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	results, err := scanRowsToMaps(rows)
+	if err != nil {
+		return err
+	}
+	if len(results) > 0 {
+		stats.OldestTimestamp = toInt64(results[0]["oldest"])
+		stats.NewestTimestamp = toInt64(results[0]["newest"])
+	}
+	return nil
+}
+
+// countStatsColumns runs the given COUNT columns, scanning the whole table, and
+// adds the exact counts to counts
+func (b *gormBackend) countStatsColumns(ctx context.Context, model schema.Tabler, columns []string,
+	counts map[string]Count,
+) error {
+	rows, err := b.getSession(ctx).Model(model).Select(strings.Join(columns, ", ")).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	results, err := scanRowsToMaps(rows)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	for name, value := range results[0] {
+		counts[name] = Count{Value: toInt64(value), Relation: CountRelationEqual}
+	}
+	return nil
+}
+
+// getDistinctEstimates returns the number of distinct values estimated by the
+// database statistics for statsDistinctColumns, the columns without an
+// estimate are omitted. rows is the estimated number of rows, negative if not
+// available
+func (b *gormBackend) getDistinctEstimates(ctx context.Context, table string, rows int64) (map[string]int64, error) {
+	var results []struct {
+		Name  string
+		Value float64
+	}
+	switch b.driver {
+	case driverNamePostgreSQL:
+		err := b.getSession(ctx).Raw(`SELECT attname AS name, n_distinct AS value FROM pg_stats `+
+			`WHERE schemaname = current_schema() AND tablename = ? AND attname IN ?`, table, statsDistinctColumns).
+			Scan(&results).Error
+		if err != nil {
+			return nil, err
+		}
+	case driverNameMySQL:
+		// the cardinality of the indexes starting with the column
+		err := b.getSession(ctx).Raw(`SELECT LOWER(column_name) AS name, MAX(cardinality) AS value `+
+			`FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? `+
+			`AND seq_in_index = 1 AND cardinality IS NOT NULL AND LOWER(column_name) IN ? `+
+			`GROUP BY LOWER(column_name)`, table, statsDistinctColumns).Scan(&results).Error
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	estimates := make(map[string]int64)
+	for _, result := range results {
+		value := result.Value
+		if b.driver == driverNamePostgreSQL {
+			var ok bool
+			if value, ok = getPostgreSQLDistinct(value, rows); !ok {
+				continue
+			}
+		}
+		estimates[result.Name] = int64(value)
+	}
+	return estimates, nil
+}
+
+// getPostgreSQLDistinct converts pg_stats.n_distinct to a number of values.
+// A negative n_distinct is the ratio of distinct values to rows
+func getPostgreSQLDistinct(nDistinct float64, rows int64) (float64, bool) {
+	if nDistinct >= 0 {
+		return nDistinct, true
+	}
+	if rows < 0 {
+		return 0, false
+	}
+	return math.Round(-nDistinct * float64(rows)), true
+}
+
+// getTableSize returns the size of the given table and the estimated number of
+// rows from the catalog. The size is nil and the estimate is negative if not
+// available
+func (b *gormBackend) getTableSize(ctx context.Context, table string) (*TableSize, int64, error) {
+	switch b.driver {
+	case driverNamePostgreSQL:
+		return b.getPostgreSQLTableSize(ctx, table)
+	case driverNameMySQL:
+		return b.getMySQLTableSize(ctx, table)
+	case driverNameSQLite:
+		return b.getSQLiteTableSize(ctx, table), -1, nil
+	}
+	return nil, -1, nil
+}
+
+func (b *gormBackend) getPostgreSQLTableSize(ctx context.Context, table string) (*TableSize, int64, error) {
+	var results []struct {
+		EstimatedRows int64
+		TableSize     int64
+		IndexesSize   int64
+	}
+	err := b.getSession(ctx).Raw(`SELECT c.reltuples::bigint AS estimated_rows, pg_table_size(c.oid) AS table_size, `+
+		`pg_indexes_size(c.oid) AS indexes_size FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace `+
+		`WHERE n.nspname = current_schema() AND c.relname = ? AND c.relkind IN ('r', 'p')`, table).
+		Scan(&results).Error
+	if err != nil {
+		return nil, -1, err
+	}
+	if len(results) == 0 {
+		return nil, -1, nil
+	}
+	size := &TableSize{
+		Data:    results[0].TableSize,
+		Indexes: results[0].IndexesSize,
+	}
+	err = b.getSession(ctx).Raw(`SELECT ic.relname AS name, pg_relation_size(ic.oid) AS size FROM pg_index i `+
+		`JOIN pg_class ic ON ic.oid = i.indexrelid JOIN pg_class c ON c.oid = i.indrelid `+
+		`JOIN pg_namespace n ON n.oid = c.relnamespace WHERE n.nspname = current_schema() AND c.relname = ? `+
+		`ORDER BY ic.relname`, table).Scan(&size.IndexSizes).Error
+	if err != nil {
+		return nil, -1, err
+	}
+	// reltuples is -1 if the table was never analyzed
+	return size, results[0].EstimatedRows, nil
+}
+
+func (b *gormBackend) getMySQLTableSize(ctx context.Context, table string) (*TableSize, int64, error) {
+	var results []struct {
+		EstimatedRows int64
+		TableSize     int64
+		IndexesSize   int64
+	}
+	err := b.getSession(ctx).Raw(`SELECT COALESCE(table_rows, -1) AS estimated_rows, `+
+		`COALESCE(data_length, 0) AS table_size, COALESCE(index_length, 0) AS indexes_size `+
+		`FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?`, table).Scan(&results).Error
+	if err != nil {
+		return nil, -1, err
+	}
+	if len(results) == 0 {
+		return nil, -1, nil
+	}
+	size := &TableSize{
+		Data:    results[0].TableSize,
+		Indexes: results[0].IndexesSize,
+	}
+	// InnoDB index statistics require the SELECT privilege on the mysql schema
+	err = b.getSession(ctx).Raw(`SELECT index_name AS name, stat_value * @@innodb_page_size AS size `+
+		`FROM mysql.innodb_index_stats WHERE database_name = DATABASE() AND table_name = ? `+
+		`AND stat_name = 'size' ORDER BY index_name`, table).Scan(&size.IndexSizes).Error
+	if err != nil {
+		logger.AppLogger.Debug("unable to get index sizes", "table", table, "error", err)
+		size.IndexSizes = nil
+	}
+	return size, results[0].EstimatedRows, nil
+}
+
+// getSQLiteTableSize returns nil if SQLite is built without the dbstat
+// virtual table
+func (b *gormBackend) getSQLiteTableSize(ctx context.Context, table string) *TableSize {
+	var results []struct {
+		Name string
+		Type string
+		Size int64
+	}
+	err := b.getSession(ctx).Raw(`SELECT m.name AS name, m.type AS type, COALESCE(SUM(s.pgsize), 0) AS size `+
+		`FROM sqlite_master m LEFT JOIN dbstat s ON s.name = m.name WHERE m.tbl_name = ? `+
+		`AND m.type IN ('table', 'index') GROUP BY m.name, m.type ORDER BY m.name`, table).Scan(&results).Error
+	if err != nil {
+		logger.AppLogger.Debug("unable to get table size", "table", table, "error", err)
+		return nil
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	size := &TableSize{}
+	for _, result := range results {
+		if result.Type == "table" {
+			size.Data += result.Size
+			continue
+		}
+		size.Indexes += result.Size
+		size.IndexSizes = append(size.IndexSizes, IndexSize{Name: result.Name, Size: result.Size})
+	}
+	return size
+}
@@ -0,0 +1,117 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	fsEvents := []FsEvent{
+		{ID: xid.New().String(), Timestamp: 1500, Action: "upload", Username: "stats1", Protocol: "SFTP",
+			IP: "192.0.2.1", InstanceID: "stats"},
+		{ID: xid.New().String(), Timestamp: 1501, Action: "upload", Username: "stats2", Protocol: "SFTP",
+			IP: "192.0.2.2", InstanceID: "stats"},
+	}
+	providerEvents := []ProviderEvent{
+		{ID: xid.New().String(), Timestamp: 1500, Action: "add", Username: "stats1", ObjectType: "user"},
+	}
+	logEvents := []LogEvent{
+		{ID: xid.New().String(), Timestamp: 1500, Event: 1, Protocol: "SSH", IP: "192.0.2.3"},
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&providerEvents).Error
+	assert.NoError(t, err)
+	err = sess.Create(&logEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	for _, options := range []StatsOptions{{ExactCount: true}, {}} {
+		stats, err := s.GetStats(options)
+		assert.NoError(t, err)
+		if !assert.Len(t, stats, 3) {
+			continue
+		}
+		assert.Equal(t, []string{"eventstore_fs_events", "eventstore_provider_events", "eventstore_log_events"},
+			[]string{stats[0].Table, stats[1].Table, stats[2].Table})
+		if options.ExactCount {
+			assert.Equal(t, CountRelationEqual, stats[0].Rows.Relation)
+		}
+		// the catalog estimate may be outdated
+		if stats[0].Rows.Relation == CountRelationEqual {
+			assert.GreaterOrEqual(t, stats[0].Rows.Value, int64(2))
+		}
+		assert.LessOrEqual(t, stats[0].OldestTimestamp, int64(1500))
+		assert.GreaterOrEqual(t, stats[0].NewestTimestamp, int64(1501))
+		if options.ExactCount {
+			assert.Equal(t, CountRelationEqual, stats[0].DistinctUsers.Relation)
+			assert.GreaterOrEqual(t, stats[0].DistinctUsers.Value, int64(2))
+			assert.GreaterOrEqual(t, stats[0].DistinctIPs.Value, int64(2))
+			assert.GreaterOrEqual(t, stats[0].DistinctInstances.Value, int64(1))
+			assert.GreaterOrEqual(t, stats[1].DistinctUsers.Value, int64(1))
+			assert.GreaterOrEqual(t, stats[2].DistinctIPs.Value, int64(1))
+		}
+		if b := getTestBackend(); b.driver == driverNameSQLite {
+			// SQLite has no estimates
+			assert.Equal(t, CountRelationEqual, stats[0].Rows.Relation)
+			assert.Equal(t, CountRelationEqual, stats[0].DistinctIPs.Relation)
+		}
+		for _, table := range stats {
+			if assert.NotNil(t, table.Size, table.Table) {
+				assert.Greater(t, table.Size.Data, int64(0))
+			}
+		}
+	}
+
+	b := getTestBackend()
+	if b.driver == driverNameSQLite {
+		size := b.getSQLiteTableSize(sess.Statement.Context, (&FsEvent{}).TableName())
+		if !assert.NotNil(t, size) {
+			return
+		}
+		assert.True(t, slices.ContainsFunc(size.IndexSizes, func(index IndexSize) bool {
+			return index.Name == "idx_fs_events_timestamp" && index.Size > 0
+		}))
+		var total int64
+		for _, index := range size.IndexSizes {
+			total += index.Size
+		}
+		assert.Equal(t, total, size.Indexes)
+	}
+}
+
+func TestGetPostgreSQLDistinct(t *testing.T) {
+	value, ok := getPostgreSQLDistinct(42, -1)
+	assert.True(t, ok)
+	assert.Equal(t, float64(42), value)
+	value, ok = getPostgreSQLDistinct(-0.25, 1000)
+	assert.True(t, ok)
+	assert.Equal(t, float64(250), value)
+	// -1 means that all the values are distinct
+	value, ok = getPostgreSQLDistinct(-1, 10)
+	assert.True(t, ok)
+	assert.Equal(t, float64(10), value)
+	_, ok = getPostgreSQLDistinct(-0.5, -1)
+	assert.False(t, ok)
+}
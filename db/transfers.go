@@ -0,0 +1,288 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/sftpgo/sftpgo-plugin-eventsearch/logger"
+)
+
+const (
+	actionUpload   = "upload"
+	actionDownload = "download"
+	// throughputExpr is the transfer throughput in bytes per second, elapsed
+	// is in milliseconds
+	throughputExpr = "file_size * 1000.0 / elapsed"
+)
+
+var (
+	defaultThroughputPercentiles = []float64{50, 90, 99}
+	transferGroupableFields      = map[string]fieldType{
+		"username":    fieldTypeString,
+		"protocol":    fieldTypeString,
+		"instance_id": fieldTypeString,
+		"bucket":      fieldTypeString,
+		"role":        fieldTypeString,
+		"fs_provider": fieldTypeInt,
+	}
+)
+
+// TransferOptions defines the options for a transfer analytics search
+type TransferOptions struct {
+	// GroupBy is an optional field used to group the transfers
+	GroupBy string
+	// Percentiles defines the throughput percentiles to compute, values must
+	// be between 0 and 100. If empty the 50th, 90th and 99th percentiles are
+	// computed
+	Percentiles []float64
+}
+
+func (o *TransferOptions) getPercentiles() []float64 {
+	if len(o.Percentiles) > 0 {
+		return o.Percentiles
+	}
+	return defaultThroughputPercentiles
+}
+
+func (o *TransferOptions) validate() error {
+	if o.GroupBy != "" {
+		if err := validateFields([]string{o.GroupBy}, transferGroupableFields); err != nil {
+			return err
+		}
+	}
+	for _, p := range o.Percentiles {
+		if p < 0 || p > 100 || math.IsNaN(p) {
+			return fmt.Errorf("invalid percentile %v, it must be between 0 and 100", p)
+		}
+	}
+	// the throughput is computed from the elapsed time
+	columns := []string{"elapsed"}
+	if o.GroupBy != "" {
+		columns = append(columns, o.GroupBy)
+	}
+	return checkColumns((&FsEvent{}).TableName(), columns...)
+}
+
+// TransferStats defines the transfer analytics for a group of transfers.
+// Throughput values are in bytes per second and only consider the transfers
+// with a positive elapsed time
+type TransferStats struct {
+	Key                   any                `json:"key,omitempty"`
+	UploadedBytes         int64              `json:"uploaded_bytes"`
+	DownloadedBytes       int64              `json:"downloaded_bytes"`
+	Uploads               int64              `json:"uploads"`
+	Downloads             int64              `json:"downloads"`
+	Transfers             int64              `json:"transfers"`
+	AvgThroughput         float64            `json:"avg_throughput"`
+	ThroughputPercentiles map[string]float64 `json:"throughput_percentiles"`
+}
+
+// TransferResult defines the result of a transfer analytics search, groups
+// are sorted by transferred bytes, descending
+type TransferResult struct {
+	GroupBy string          `json:"group_by,omitempty"`
+	Groups  []TransferStats `json:"groups"`
+}
+
+// TransferAnalyzer is implemented by the backends able to compute transfer
+// analytics for the upload and download events matching a search
+type TransferAnalyzer interface {
+	AnalyzeTransfers(ctx context.Context, filters *FsEventFilters, options TransferOptions,
+	) ([]TransferStats, error)
+}
+
+// AnalyzeTransfers returns the transferred bytes, the number of transfers and
+// the throughput statistics for the uploads and downloads matching the given
+// filters, optionally grouped by a field
+func (s *Searcher) AnalyzeTransfers(filters *FsEventFilters, options TransferOptions,
+) (*TransferResult, error) {
+	if err := filters.validate(); err != nil {
+		return nil, err
+	}
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	b, err := getBackend()
+	if err != nil {
+		return nil, err
+	}
+	analyzer, ok := b.(TransferAnalyzer)
+	if !ok {
+		return nil, errNotSupported
+	}
+	ctx, cancel := getDefaultContext()
+	defer cancel()
+
+	groups, err := analyzer.AnalyzeTransfers(ctx, filters, options)
+	if err != nil {
+		logger.AppLogger.Warn("unable to analyze transfers", "error", err)
+		return nil, err
+	}
+	if groups == nil {
+		groups = []TransferStats{}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].UploadedBytes+groups[i].DownloadedBytes > groups[j].UploadedBytes+groups[j].DownloadedBytes
+	})
+	return &TransferResult{
+		GroupBy: options.GroupBy,
+		Groups:  groups,
+	}, nil
+}
+
+func (b *gormBackend) AnalyzeTransfers(ctx context.Context, filters *FsEventFilters,
+	options TransferOptions,
+) ([]TransferStats, error) {
+	sess := b.applyFsEventFilters(b.getSession(ctx).Model(&FsEvent{}), filters).
+		Where("action IN ?", []string{actionUpload, actionDownload}).
+		Session(&gorm.Session{})
+	percentiles := options.getPercentiles()
+
+	columns := []string{
+		fmt.Sprintf("SUM(CASE WHEN action = '%s' THEN file_size ELSE 0 END) AS uploaded_bytes", actionUpload),
+		fmt.Sprintf("SUM(CASE WHEN action = '%s' THEN file_size ELSE 0 END) AS downloaded_bytes", actionDownload),
+		fmt.Sprintf("SUM(CASE WHEN action = '%s' THEN 1 ELSE 0 END) AS uploads", actionUpload),
+		fmt.Sprintf("SUM(CASE WHEN action = '%s' THEN 1 ELSE 0 END) AS downloads", actionDownload),
+		fmt.Sprintf("AVG(CASE WHEN elapsed > 0 THEN %s END) AS avg_throughput", throughputExpr),
+	}
+	query := sess
+	if b.driver == driverNamePostgreSQL {
+		for idx, p := range percentiles {
+			// percentiles are validated floats, NULL values are ignored
+			columns = append(columns, fmt.Sprintf(
+				"percentile_cont(%s) WITHIN GROUP (ORDER BY CASE WHEN elapsed > 0 THEN %s END) AS p%d",
+				strconv.FormatFloat(p/100, 'f', -1, 64), throughputExpr, idx))
+		}
+	} else {
+		query = b.getRankedTransfers(ctx, sess, options.GroupBy)
+		columns = append(columns, getThroughputRankColumns(percentiles)...)
+	}
+	if options.GroupBy != "" {
+		columns = append([]string{options.GroupBy}, columns...)
+		query = query.Group(options.GroupBy)
+	}
+	rows, err := query.Select(strings.Join(columns, ", ")).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results, err := scanRowsToMaps(rows)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]TransferStats, 0, len(results))
+	for _, result := range results {
+		s := TransferStats{
+			UploadedBytes:         toInt64(result["uploaded_bytes"]),
+			DownloadedBytes:       toInt64(result["downloaded_bytes"]),
+			Uploads:               toInt64(result["uploads"]),
+			Downloads:             toInt64(result["downloads"]),
+			AvgThroughput:         toFloat64(result["avg_throughput"]),
+			ThroughputPercentiles: make(map[string]float64, len(percentiles)),
+		}
+		s.Transfers = s.Uploads + s.Downloads
+		if s.Transfers == 0 {
+			// aggregates without GROUP BY always return a row
+			continue
+		}
+		if options.GroupBy != "" {
+			s.Key = convertFieldValue(result[options.GroupBy], transferGroupableFields[options.GroupBy])
+		}
+		if b.driver == driverNamePostgreSQL {
+			for idx, p := range percentiles {
+				s.ThroughputPercentiles[getPercentileName(p)] = toFloat64(result[fmt.Sprintf("p%d", idx)])
+			}
+		} else if count := toInt64(result["throughput_count"]); count > 0 {
+			for idx, p := range percentiles {
+				lower := toFloat64(result[fmt.Sprintf("p%d_lower", idx)])
+				upper := lower
+				if value := result[fmt.Sprintf("p%d_upper", idx)]; value != nil {
+					upper = toFloat64(value)
+				}
+				s.ThroughputPercentiles[getPercentileName(p)] = interpolatePercentile(lower, upper,
+					getPercentileRank(count, p))
+			}
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// getRankedTransfers returns the transfers with the rank of their throughput
+// within the group, starting from 0, and the number of transfers with a
+// throughput in the group. It is used by the databases without percentile
+// functions: the groups are computed by the database, so they match the
+// GROUP BY ones also using case-insensitive collations, and the values are
+// never loaded in memory
+func (b *gormBackend) getRankedTransfers(ctx context.Context, sess *gorm.DB, groupBy string) *gorm.DB {
+	columns := []string{"action", "file_size", "elapsed"}
+	// the transfers without a throughput are ranked in a separate partition
+	rankPartition := "PARTITION BY CASE WHEN elapsed > 0 THEN 1 ELSE 0 END"
+	var countPartition string
+	if groupBy != "" {
+		columns = append(columns, groupBy)
+		rankPartition += ", " + groupBy
+		countPartition = "PARTITION BY " + groupBy
+	}
+	columns = append(columns,
+		fmt.Sprintf("ROW_NUMBER() OVER (%s ORDER BY %s) - 1 AS throughput_rank", rankPartition, throughputExpr),
+		fmt.Sprintf("COUNT(CASE WHEN elapsed > 0 THEN 1 END) OVER (%s) AS throughput_count", countPartition))
+
+	return b.getSession(ctx).Table("(?) AS transfers", sess.Select(strings.Join(columns, ", ")))
+}
+
+// getThroughputRankColumns returns the columns selecting, for each percentile,
+// the throughput at the lower and upper ranks used for the interpolation.
+// The ranks are compared without FLOOR and CEIL, missing in some SQLite
+// builds
+func getThroughputRankColumns(percentiles []float64) []string {
+	columns := []string{"MAX(throughput_count) AS throughput_count"}
+	for idx, p := range percentiles {
+		// percentiles are validated floats
+		rank := strconv.FormatFloat(p/100, 'f', -1, 64) + " * (throughput_count - 1)"
+		columns = append(columns,
+			fmt.Sprintf("MAX(CASE WHEN elapsed > 0 AND throughput_rank <= %s AND throughput_rank + 1 > %s "+
+				"THEN %s END) AS p%d_lower", rank, rank, throughputExpr, idx),
+			fmt.Sprintf("MAX(CASE WHEN elapsed > 0 AND throughput_rank >= %s AND throughput_rank - 1 < %s "+
+				"THEN %s END) AS p%d_upper", rank, rank, throughputExpr, idx))
+	}
+	return columns
+}
+
+// getPercentileRank returns the rank, starting from 0, of the percentile p,
+// between 0 and 100, within count sorted values. Fractional ranks are
+// interpolated, as percentile_cont in PostgreSQL
+func getPercentileRank(count int64, p float64) float64 {
+	return p / 100 * float64(count-1)
+}
+
+// interpolatePercentile returns the percentile at the given rank using linear
+// interpolation between the values at the lower and upper ranks
+func interpolatePercentile(lower, upper, rank float64) float64 {
+	return lower + (upper-lower)*(rank-math.Floor(rank))
+}
+
+func getPercentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
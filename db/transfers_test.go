@@ -0,0 +1,144 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/rs/xid"
+	"github.com/sftpgo/sdk/plugin/eventsearcher"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyzeTransfers(t *testing.T) {
+	newEvent := func(action, username, protocol string, size, elapsed int64) FsEvent {
+		return FsEvent{
+			ID:        xid.New().String(),
+			Timestamp: 500,
+			Action:    action,
+			Username:  username,
+			Protocol:  protocol,
+			FileSize:  size,
+			Elapsed:   elapsed,
+			Status:    1,
+		}
+	}
+	fsEvents := []FsEvent{
+		// throughput 1000, 2000, 3000, 4000 bytes/s
+		newEvent("upload", "user1", "SFTP", 1000, 1000),
+		newEvent("upload", "user1", "SFTP", 4000, 2000),
+		newEvent("download", "user1", "HTTP", 3000, 1000),
+		newEvent("download", "user1", "HTTP", 8000, 2000),
+		// zero elapsed, excluded from the throughput statistics
+		newEvent("upload", "user2", "SFTP", 500, 0),
+		newEvent("download", "user2", "SFTP", 10000, 1000),
+		// not a transfer
+		newEvent("rename", "user3", "SFTP", 100000, 1000),
+	}
+
+	sess, cancel := getDefaultSession()
+	defer cancel()
+
+	err := sess.Create(&fsEvents).Error
+	assert.NoError(t, err)
+
+	s := Searcher{}
+	filters := FsEventFilters{FsEventSearch: eventsearcher.FsEventSearch{
+		CommonSearchParams: eventsearcher.CommonSearchParams{
+			StartTimestamp: 500,
+			EndTimestamp:   500,
+		},
+		FsProvider: -1,
+	}}
+	_, err = s.AnalyzeTransfers(&filters, TransferOptions{GroupBy: "action"})
+	assert.Error(t, err)
+	_, err = s.AnalyzeTransfers(&filters, TransferOptions{Percentiles: []float64{101}})
+	assert.Error(t, err)
+
+	result, err := s.AnalyzeTransfers(&filters, TransferOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, result.Groups, 1) {
+		stats := result.Groups[0]
+		assert.Nil(t, stats.Key)
+		assert.Equal(t, int64(5500), stats.UploadedBytes)
+		assert.Equal(t, int64(21000), stats.DownloadedBytes)
+		assert.Equal(t, int64(3), stats.Uploads)
+		assert.Equal(t, int64(3), stats.Downloads)
+		assert.Equal(t, int64(6), stats.Transfers)
+		assert.InDelta(t, 4000, stats.AvgThroughput, 0.001)
+		assert.InDelta(t, 3000, stats.ThroughputPercentiles["p50"], 0.001)
+		assert.InDelta(t, 7600, stats.ThroughputPercentiles["p90"], 0.001)
+	}
+
+	result, err = s.AnalyzeTransfers(&filters, TransferOptions{
+		GroupBy:     "username",
+		Percentiles: []float64{0, 25, 50, 75, 100},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "username", result.GroupBy)
+	if assert.Len(t, result.Groups, 2) {
+		stats := result.Groups[0]
+		assert.Equal(t, "user1", stats.Key)
+		assert.Equal(t, int64(5000), stats.UploadedBytes)
+		assert.Equal(t, int64(11000), stats.DownloadedBytes)
+		assert.Equal(t, int64(4), stats.Transfers)
+		assert.InDelta(t, 2500, stats.AvgThroughput, 0.001)
+		assert.InDelta(t, 1000, stats.ThroughputPercentiles["p0"], 0.001)
+		assert.InDelta(t, 1750, stats.ThroughputPercentiles["p25"], 0.001)
+		assert.InDelta(t, 2500, stats.ThroughputPercentiles["p50"], 0.001)
+		assert.InDelta(t, 3250, stats.ThroughputPercentiles["p75"], 0.001)
+		assert.InDelta(t, 4000, stats.ThroughputPercentiles["p100"], 0.001)
+
+		stats = result.Groups[1]
+		assert.Equal(t, "user2", stats.Key)
+		assert.Equal(t, int64(500), stats.UploadedBytes)
+		assert.Equal(t, int64(10000), stats.DownloadedBytes)
+		assert.Equal(t, int64(2), stats.Transfers)
+		assert.InDelta(t, 10000, stats.AvgThroughput, 0.001)
+		assert.InDelta(t, 10000, stats.ThroughputPercentiles["p50"], 0.001)
+	}
+	// only uploads
+	filters.Actions = []string{"upload", "rename"}
+	result, err = s.AnalyzeTransfers(&filters, TransferOptions{GroupBy: "protocol"})
+	assert.NoError(t, err)
+	if assert.Len(t, result.Groups, 1) {
+		assert.Equal(t, "SFTP", result.Groups[0].Key)
+		assert.Equal(t, int64(3), result.Groups[0].Uploads)
+		assert.Equal(t, int64(0), result.Groups[0].Downloads)
+	}
+	// no transfers
+	filters.Actions = []string{"rename"}
+	result, err = s.AnalyzeTransfers(&filters, TransferOptions{})
+	assert.NoError(t, err)
+	assert.NotNil(t, result.Groups)
+	assert.Len(t, result.Groups, 0)
+
+	err = sess.Delete(&fsEvents).Error
+	assert.NoError(t, err)
+}
+
+func TestGetPercentile(t *testing.T) {
+	assert.Equal(t, float64(0), getPercentileRank(1, 90))
+	assert.Equal(t, float64(5), interpolatePercentile(5, 5, getPercentileRank(1, 90)))
+	// values 1, 2, 3, 4
+	assert.Equal(t, float64(0), getPercentileRank(4, 0))
+	assert.Equal(t, float64(1), interpolatePercentile(1, 1, getPercentileRank(4, 0)))
+	assert.Equal(t, 1.5, getPercentileRank(4, 50))
+	assert.Equal(t, 2.5, interpolatePercentile(2, 3, getPercentileRank(4, 50)))
+	assert.InDelta(t, 3.7, interpolatePercentile(3, 4, getPercentileRank(4, 90)), 0.0001)
+	assert.Equal(t, float64(3), getPercentileRank(4, 100))
+	assert.Equal(t, float64(4), interpolatePercentile(4, 4, getPercentileRank(4, 100)))
+	assert.Equal(t, "p99.9", getPercentileName(99.9))
+}
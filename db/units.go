@@ -0,0 +1,146 @@
+// Copyright (C) 2021-2023 Nicola Murino
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, version 3.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <https://www.gnu.org/licenses/>.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// ParseSize parses a size in bytes, such as 500MB or 1.5GiB. KB, MB, GB and
+// TB are decimal units, KiB, MiB, GiB and TiB are binary ones
+func ParseSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	idx := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	number, unit := value, ""
+	if idx >= 0 {
+		number, unit = value[:idx], strings.TrimSpace(value[idx:])
+	}
+	multiplier, ok := sizeUnits[strings.ToLower(unit)]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q", value, unit)
+	}
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	size := math.Round(f * multiplier)
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q: value out of range", value)
+	}
+	return int64(size), nil
+}
+
+// ParseElapsed parses an elapsed time, such as 30s or 1h30m, and returns it in
+// milliseconds. Numbers without a unit are milliseconds
+func ParseElapsed(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if ms < 0 {
+			return 0, errors.New("the elapsed time cannot be negative")
+		}
+		return ms, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid elapsed time %q", value)
+	}
+	if d < 0 {
+		return 0, errors.New("the elapsed time cannot be negative")
+	}
+	return d.Milliseconds(), nil
+}
+
+// timestampLayouts are the accepted timestamp layouts, fractional seconds
+// are optional and parsed by time.Parse even if not included in the layout.
+// Timestamps without a time zone are in UTC
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// ParseTimestamp parses a timestamp and returns it in nanoseconds since the
+// Unix epoch. The accepted formats are RFC 3339, optionally with a space
+// instead of "T" and without a time zone, dates, integers and decimal seconds
+// since the epoch such as 1772359200.5. Integers are seconds, milliseconds,
+// microseconds or nanoseconds depending on their magnitude, see
+// getTimestampUnit
+func ParseTimestamp(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		unit := int64(getTimestampUnit(n))
+		if n > math.MaxInt64/unit || n < math.MinInt64/unit {
+			return 0, fmt.Errorf("invalid timestamp %q: out of range", value)
+		}
+		return n * unit, nil
+	}
+	if secs, fraction, ok := strings.Cut(value, "."); ok && secs != "" && fraction != "" && len(fraction) <= 9 {
+		s, err := strconv.ParseInt(secs, 10, 64)
+		if err == nil && s >= 0 {
+			fraction += strings.Repeat("0", 9-len(fraction))
+			ns, err := strconv.ParseUint(fraction, 10, 64)
+			if err == nil {
+				return time.Unix(s, int64(ns)).UnixNano(), nil
+			}
+		}
+	}
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UnixNano(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid timestamp %q, use RFC 3339, a date or seconds since the epoch", value)
+}
+
+// getTimestampUnit returns the unit of an integer timestamp: values below 1e11
+// are seconds, below 1e14 milliseconds, below 1e17 microseconds and
+// nanoseconds otherwise, so the dates after 1973 are never ambiguous
+func getTimestampUnit(n int64) time.Duration {
+	if n < 0 {
+		n = -n
+	}
+	switch {
+	case n < 1e11:
+		return time.Second
+	case n < 1e14:
+		return time.Millisecond
+	case n < 1e17:
+		return time.Microsecond
+	default:
+		return time.Nanosecond
+	}
+}